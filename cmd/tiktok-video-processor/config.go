@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server"
+)
+
+// Config holds the settings shared by all subcommands. Values are taken from
+// flags, then environment variables, then the config file.
+type Config struct {
+	DBPath     string `json:"db"`
+	DBBackend  string `json:"db_backend"`
+	OutPath    string `json:"out"`
+	FetcherKey string `json:"fetcher_key"`
+	ScraperKey string `json:"scraper_key"`
+	TikWMKey   string `json:"tikwm_key"`
+	Addr       string `json:"addr"`
+
+	FullSyncInterval string `json:"full_sync_interval"`
+
+	BackupDir      string `json:"backup_dir"`
+	BackupInterval string `json:"backup_interval"`
+	BackupKeep     string `json:"backup_keep"`
+
+	// Number of jobs each pipeline stage works on at once
+	LimitResolve  string `json:"limit_resolve"`
+	LimitDownload string `json:"limit_download"`
+	LimitValidate string `json:"limit_validate"`
+	LimitProcess  string `json:"limit_process"`
+	LimitStore    string `json:"limit_store"`
+
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey string `json:"s3_secret_key"`
+}
+
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	def   string
+	value func(c *Config) *string
+}
+
+var settings = []setting{
+	{"db", "TVP_DB", "path of the database", "./data/db", func(c *Config) *string { return &c.DBPath }},
+	{"db-backend", "TVP_DB_BACKEND", "storage backend of the database, lmdb or bolt, detected if empty", "", func(c *Config) *string { return &c.DBBackend }},
+	{"out", "TVP_OUT", "directory videos, comments and results are stored in", "./data/out", func(c *Config) *string { return &c.OutPath }},
+	{"fetcher-key", "TVP_FETCHER_KEY", "RapidAPI key of the video fetcher", "", func(c *Config) *string { return &c.FetcherKey }},
+	{"scraper-key", "TVP_SCRAPER_KEY", "RapidAPI key of the scraper", "", func(c *Config) *string { return &c.ScraperKey }},
+	{"tikwm-key", "TVP_TIKWM_KEY", "RapidAPI key of the TikWM scraper, used when the scraper fails", "", func(c *Config) *string { return &c.TikWMKey }},
+	{"addr", "TVP_ADDR", "address of the management API, disabled if empty", "", func(c *Config) *string { return &c.Addr }},
+	{"full-sync-interval", "TVP_FULL_SYNC_INTERVAL", "interval of the full syncs that notice deleted awemes, disabled if 0", server.DefaultFullSyncInterval.String(), func(c *Config) *string { return &c.FullSyncInterval }},
+	{"backup-dir", "TVP_BACKUP_DIR", "directory serve writes scheduled database backups to, disabled if empty", "", func(c *Config) *string { return &c.BackupDir }},
+	{"backup-interval", "TVP_BACKUP_INTERVAL", "interval of scheduled backups", "24h", func(c *Config) *string { return &c.BackupInterval }},
+	{"backup-keep", "TVP_BACKUP_KEEP", "number of scheduled backups kept", "7", func(c *Config) *string { return &c.BackupKeep }},
+	{"limit-resolve", "TVP_LIMIT_RESOLVE", "number of jobs resolving video URLs at once", strconv.Itoa(server.DefaultStageLimits.Resolve), func(c *Config) *string { return &c.LimitResolve }},
+	{"limit-download", "TVP_LIMIT_DOWNLOAD", "number of jobs downloading videos at once", strconv.Itoa(server.DefaultStageLimits.Download), func(c *Config) *string { return &c.LimitDownload }},
+	{"limit-validate", "TVP_LIMIT_VALIDATE", "number of jobs validating videos at once", strconv.Itoa(server.DefaultStageLimits.Validate), func(c *Config) *string { return &c.LimitValidate }},
+	{"limit-process", "TVP_LIMIT_PROCESS", "number of jobs rendering and editing videos at once", strconv.Itoa(server.DefaultStageLimits.Process), func(c *Config) *string { return &c.LimitProcess }},
+	{"limit-store", "TVP_LIMIT_STORE", "number of jobs storing videos at once", strconv.Itoa(server.DefaultStageLimits.Store), func(c *Config) *string { return &c.LimitStore }},
+	{"s3-endpoint", "TVP_S3_ENDPOINT", "URL of an S3-compatible server to store videos, comments and results in instead of out, disabled if empty", "", func(c *Config) *string { return &c.S3Endpoint }},
+	{"s3-region", "TVP_S3_REGION", "region of the S3 bucket", "us-east-1", func(c *Config) *string { return &c.S3Region }},
+	{"s3-bucket", "TVP_S3_BUCKET", "name of the S3 bucket", "", func(c *Config) *string { return &c.S3Bucket }},
+	{"s3-access-key", "TVP_S3_ACCESS_KEY", "access key ID of the S3 bucket", "", func(c *Config) *string { return &c.S3AccessKey }},
+	{"s3-secret-key", "TVP_S3_SECRET_KEY", "secret access key of the S3 bucket", "", func(c *Config) *string { return &c.S3SecretKey }},
+}
+
+// registerFlags adds the config flags to fs. The returned function resolves
+// the final config once fs is parsed.
+func registerFlags(fs *flag.FlagSet) func() (*Config, error) {
+	var flagConfig Config
+	for _, s := range settings {
+		fs.StringVar(s.value(&flagConfig), s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	configPath := fs.String("config", os.Getenv("TVP_CONFIG"), "path of a JSON config file (env TVP_CONFIG)")
+
+	return func() (*Config, error) {
+		var config Config
+		if *configPath != "" {
+			data, err := os.ReadFile(*configPath)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(data, &config); err != nil {
+				return nil, fmt.Errorf("invalid config file %s: %w", *configPath, err)
+			}
+		}
+
+		for _, s := range settings {
+			v := s.value(&config)
+			if f := *s.value(&flagConfig); f != "" {
+				*v = f
+			} else if env := os.Getenv(s.env); env != "" {
+				*v = env
+			} else if *v == "" {
+				*v = s.def
+			}
+		}
+
+		return &config, nil
+	}
+}
+
+// stageLimits parses the pipeline stage limits.
+func (c *Config) stageLimits() (server.StageLimits, error) {
+	var limits server.StageLimits
+	for _, l := range []struct {
+		name  string
+		value string
+		limit *int
+	}{
+		{"resolve", c.LimitResolve, &limits.Resolve},
+		{"download", c.LimitDownload, &limits.Download},
+		{"validate", c.LimitValidate, &limits.Validate},
+		{"process", c.LimitProcess, &limits.Process},
+		{"store", c.LimitStore, &limits.Store},
+	} {
+		n, err := strconv.Atoi(l.value)
+		if err != nil || n <= 0 {
+			return limits, fmt.Errorf("invalid %s limit %q", l.name, l.value)
+		}
+		*l.limit = n
+	}
+
+	return limits, nil
+}
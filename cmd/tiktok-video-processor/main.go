@@ -0,0 +1,448 @@
+// Command tiktok-video-processor tracks TikTok accounts and fetches and
+// processes their videos.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/tikwmapi"
+)
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `usage: tiktok-video-processor [flags] <command> [args]
+
+commands:
+  serve                          run the daily updates, job queue and management API
+  user add <username>...         track users
+  user rm <username>...          stop tracking users
+  user ls                        list tracked users
+  sync [user]                    update all users, or one user by ID or username
+  fetch <aweme>                  fetch and store a video
+  render [flags] <aweme>         render a video with a comment overlay
+  db export [flags]              export users, awemes and statistics
+  db import [file]               import a JSON Lines export
+  db backup [-o file]            write a snapshot of the database
+  db restore <file>              replace the database with a snapshot
+
+flags:
+`
+
+// errUsage is returned for invalid command lines.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	fs := flag.NewFlagSet("tiktok-video-processor", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	loadConfig := registerFlags(fs)
+
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(exitError)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = run(ctx, config, fs.Args())
+	stop()
+
+	switch {
+	case err == nil:
+		os.Exit(exitOK)
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "error: %s\n\n", err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	default:
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(exitError)
+	}
+}
+
+func run(ctx context.Context, config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing command", errUsage)
+	}
+
+	s := server.New(config.DBPath, config.OutPath, config.FetcherKey, config.ScraperKey)
+	s.DB.BackendName = config.DBBackend
+	s.Addr = config.Addr
+	s.BackupDir = config.BackupDir
+
+	var err error
+	if s.FullSyncInterval, err = time.ParseDuration(config.FullSyncInterval); err != nil {
+		return fmt.Errorf("invalid full sync interval: %w", err)
+	}
+	if s.BackupInterval, err = time.ParseDuration(config.BackupInterval); err != nil {
+		return fmt.Errorf("invalid backup interval: %w", err)
+	}
+	if s.BackupKeep, err = strconv.Atoi(config.BackupKeep); err != nil {
+		return fmt.Errorf("invalid backup keep: %w", err)
+	}
+	if s.Limits, err = config.stageLimits(); err != nil {
+		return err
+	}
+	if config.S3Endpoint != "" {
+		err := s.UseS3(storer.S3Config{
+			Endpoint:  config.S3Endpoint,
+			Region:    config.S3Region,
+			Bucket:    config.S3Bucket,
+			AccessKey: config.S3AccessKey,
+			SecretKey: config.S3SecretKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if config.TikWMKey != "" {
+		s.Provider = tiktok.NewFailover(s.Provider, tikwmapi.New(config.TikWMKey))
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "serve" {
+		if len(args) != 0 {
+			return fmt.Errorf("%w: serve takes no arguments", errUsage)
+		}
+		return s.Run()
+	}
+
+	// Restoring replaces the database, so it must not be open
+	if cmd == "db" && len(args) > 0 && args[0] == "restore" {
+		return runRestore(config, args[1:])
+	}
+
+	if err := s.DB.Open(); err != nil {
+		return err
+	}
+	defer s.DB.Close()
+
+	switch cmd {
+	case "user":
+		return runUser(ctx, s, args)
+	case "sync":
+		return runSync(ctx, s, args)
+	case "fetch":
+		return runFetch(ctx, s, args)
+	case "render":
+		return runRender(ctx, s, args)
+	case "db":
+		return runDB(ctx, s, args)
+	}
+
+	return fmt.Errorf("%w: unknown command %q", errUsage, cmd)
+}
+
+func runUser(ctx context.Context, s *server.Server, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing user command", errUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) < 2 {
+			return fmt.Errorf("%w: user add needs a username", errUsage)
+		}
+		for _, username := range args[1:] {
+			if err := s.AddUsername(ctx, strings.TrimPrefix(username, "@")); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "rm":
+		if len(args) < 2 {
+			return fmt.Errorf("%w: user rm needs a username", errUsage)
+		}
+		for _, username := range args[1:] {
+			if err := s.RemoveUsername(ctx, strings.TrimPrefix(username, "@")); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "ls":
+		ids, err := userIDs(s)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			user, err := s.DB.GetUser(id)
+			switch {
+			case err == db.ErrNotFound:
+				fmt.Printf("%s\n", id)
+			case err != nil:
+				return err
+			default:
+				fmt.Printf("%s\t@%s\t%d followers\t%d videos\n", id, user.UniqueID, user.FollowerCount, user.AwemeCount)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: unknown user command %q", errUsage, args[0])
+}
+
+func runSync(ctx context.Context, s *server.Server, args []string) error {
+	switch len(args) {
+	case 0:
+		return s.UpdateAllOnce(ctx)
+	case 1:
+		userID, err := resolveUserID(ctx, s, args[0])
+		if err != nil {
+			return err
+		}
+		return s.Update(ctx, userID)
+	}
+
+	return fmt.Errorf("%w: sync takes at most one user", errUsage)
+}
+
+func runFetch(ctx context.Context, s *server.Server, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: fetch needs one aweme ID", errUsage)
+	}
+
+	a, err := findAweme(s, args[0])
+	if err != nil {
+		return err
+	}
+
+	path, err := s.FetchVideo(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(path)
+	return nil
+}
+
+func runRender(ctx context.Context, s *server.Server, args []string) error {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	commentUser := fs.String("comment-user", "", "username shown on the comment")
+	commentText := fs.String("comment-text", "", "text of the comment")
+	avatar := fs.String("avatar", "", "path of the comment's avatar image")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+
+	if fs.NArg() != 1 || *commentUser == "" || *commentText == "" {
+		return fmt.Errorf("%w: render needs --comment-user, --comment-text and one aweme ID", errUsage)
+	}
+
+	a, err := findAweme(s, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	path, err := s.GenerateCommentedVideo(ctx, a, *commentUser, *commentText, *avatar)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(path)
+	return nil
+}
+
+func runDB(ctx context.Context, s *server.Server, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: missing db command", errUsage)
+	}
+
+	switch args[0] {
+	case "export":
+		return runExport(ctx, s, args[1:])
+	case "import":
+		return runImport(s, args[1:])
+	case "backup":
+		return runBackup(s, args[1:])
+	}
+
+	return fmt.Errorf("%w: unknown db command %q", errUsage, args[0])
+}
+
+func runExport(ctx context.Context, s *server.Server, args []string) error {
+	fs := flag.NewFlagSet("db export", flag.ContinueOnError)
+	outPath := fs.String("o", "", "output file, stdout if empty")
+	format := fs.String("format", "jsonl", "output format, jsonl or csv")
+	table := fs.String("table", db.RecordAweme, "records to write as csv: user, aweme, stats or tombstone")
+	users := fs.String("users", "", "comma separated users to export, by ID or username, all if empty")
+	from := fs.String("from", "", "only awemes created at or after this date, YYYY-MM-DD or RFC 3339")
+	to := fs.String("to", "", "only awemes created before this date, YYYY-MM-DD or RFC 3339")
+	hashtag := fs.String("hashtag", "", "only awemes tagged with this hashtag")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+
+	filter := db.ExportFilter{Hashtag: *hashtag}
+
+	var err error
+	if filter.From, err = parseDate(*from); err != nil {
+		return fmt.Errorf("%w: -from: %s", errUsage, err)
+	}
+	if filter.To, err = parseDate(*to); err != nil {
+		return fmt.Errorf("%w: -to: %s", errUsage, err)
+	}
+
+	if *users != "" {
+		for _, user := range strings.Split(*users, ",") {
+			id, err := resolveUserID(ctx, s, strings.TrimSpace(user))
+			if err != nil {
+				return err
+			}
+			filter.UserIDs = append(filter.UserIDs, id)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	switch *format {
+	case "jsonl":
+		return s.DB.ExportJSONLines(out, filter)
+	case "csv":
+		return s.DB.ExportCSV(out, *table, filter)
+	}
+
+	return fmt.Errorf("%w: unknown format %q", errUsage, *format)
+}
+
+func runImport(s *server.Server, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("%w: db import takes at most one file", errUsage)
+	}
+
+	var in io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	n, err := s.DB.ImportJSONLines(bufio.NewReader(in))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d records\n", n)
+	return nil
+}
+
+func runBackup(s *server.Server, args []string) error {
+	fs := flag.NewFlagSet("db backup", flag.ContinueOnError)
+	outPath := fs.String("o", "", "snapshot file, in the backup directory if empty")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+
+	if *outPath == "" {
+		if s.BackupDir == "" {
+			return fmt.Errorf("%w: db backup needs -o or a backup directory", errUsage)
+		}
+		if err := os.MkdirAll(s.BackupDir, os.ModePerm); err != nil {
+			return err
+		}
+
+		path, err := s.BackupOnce()
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+		return nil
+	}
+
+	if err := s.DB.BackupFile(*outPath); err != nil {
+		return err
+	}
+
+	fmt.Println(*outPath)
+	return nil
+}
+
+func runRestore(config *Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: db restore needs a snapshot file", errUsage)
+	}
+
+	if err := db.Restore(args[0], config.DBPath, config.DBBackend); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "restored %s, the previous database is at %s.pre-restore\n", args[0], config.DBPath)
+	return nil
+}
+
+// parseDate parses a date as YYYY-MM-DD, in UTC, or RFC 3339. The empty
+// string is the zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func userIDs(s *server.Server) ([]string, error) {
+	ids, err := s.DB.GetUserIDList()
+	if err == db.ErrNotFound {
+		return nil, nil
+	}
+	return ids, err
+}
+
+// resolveUserID accepts either a numeric user ID or a username.
+func resolveUserID(ctx context.Context, s *server.Server, user string) (string, error) {
+	if strings.Trim(user, "0123456789") == "" {
+		return user, nil
+	}
+
+	return s.Provider.FetchUserIdContext(ctx, strings.TrimPrefix(user, "@"))
+}
+
+// findAweme looks the aweme up in the database.
+func findAweme(s *server.Server, awemeID string) (*tiktok.Aweme, error) {
+	a, err := s.DB.GetAweme(awemeID)
+	if err == db.ErrNotFound {
+		return nil, fmt.Errorf("aweme %s not found", awemeID)
+	}
+
+	return a, err
+}
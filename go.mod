@@ -5,7 +5,9 @@ go 1.20
 require (
 	github.com/bjornpagen/goplay v0.0.0-20230406203647-8f5e2a9ce600
 	github.com/rs/zerolog v1.29.0
+	go.etcd.io/bbolt v1.3.7
 	go.uber.org/ratelimit v0.2.0
+	golang.org/x/image v0.18.0
 	wellquite.org/golmdb v0.0.0-20221218163858-4bf6dfb536d2
 )
 
@@ -16,5 +18,6 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.18 // indirect
 	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 	wellquite.org/actors v0.0.0-20220718102711-d11619d86e33 // indirect
 )
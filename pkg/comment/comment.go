@@ -26,6 +26,10 @@ func NewCommentData(username, comment, profileimagepath string) *CommentData {
 	}
 }
 
+// CommentBuilder renders comments on tokcomment.com in a headless Chrome.
+//
+// Deprecated: it breaks whenever the site changes and cannot run offline.
+// Use Render instead.
 type CommentBuilder struct {
 	c *chrome.Browser
 }
@@ -0,0 +1,338 @@
+package comment
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+// Layout of the bubble in pixels at scale 1
+const (
+	padding      = 10.0
+	radius       = 10.0
+	avatarSize   = 36.0
+	avatarGap    = 8.0
+	headerSize   = 13.0
+	commentSize  = 15.0
+	lineSpacing  = 1.3
+	maxTextWidth = 240.0
+	tailOffset   = 14.0
+	tailWidth    = 10.0
+	tailHeight   = 8.0
+)
+
+var (
+	bubbleColor      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	headerColor      = color.RGBA{0x8a, 0x8b, 0x91, 0xff}
+	commentColor     = color.RGBA{0x16, 0x18, 0x23, 0xff}
+	placeholderColor = color.RGBA{0xd9, 0xd9, 0xd9, 0xff}
+)
+
+var (
+	fontsOnce   sync.Once
+	regularFont *opentype.Font
+	boldFont    *opentype.Font
+	fontsErr    error
+)
+
+func loadFonts() error {
+	fontsOnce.Do(func() {
+		if regularFont, fontsErr = opentype.Parse(goregular.TTF); fontsErr != nil {
+			return
+		}
+		boldFont, fontsErr = opentype.Parse(gobold.TTF)
+	})
+	return fontsErr
+}
+
+// Render draws the "Reply to X's comment" bubble TikTok shows above a reply,
+// with the avatar at ImagePath cropped to a circle, at scale times its
+// natural size. The background is transparent. The embedded Go fonts have
+// no emoji, so characters they lack are left out.
+func Render(cd *CommentData, scale float64) (*image.RGBA, error) {
+	if scale <= 0 || math.IsInf(scale, 0) || math.IsNaN(scale) {
+		return nil, fmt.Errorf("invalid scale %v", scale)
+	}
+	if err := loadFonts(); err != nil {
+		return nil, err
+	}
+
+	headerFace, err := newFace(regularFont, headerSize*scale)
+	if err != nil {
+		return nil, err
+	}
+	defer headerFace.Close()
+
+	commentFace, err := newFace(boldFont, commentSize*scale)
+	if err != nil {
+		return nil, err
+	}
+	defer commentFace.Close()
+
+	textWidth := maxTextWidth * scale
+	header := wrap(headerFace, fmt.Sprintf("Reply to %s's comment", cd.Username), textWidth)
+	comment := wrap(commentFace, cd.Comment, textWidth)
+
+	// The bubble is as wide as its longest line
+	width := 0.0
+	for _, line := range header {
+		width = math.Max(width, measure(headerFace, line))
+	}
+	for _, line := range comment {
+		width = math.Max(width, measure(commentFace, line))
+	}
+
+	headerHeight := lineSpacing * headerSize * scale
+	commentHeight := lineSpacing * commentSize * scale
+	textHeight := float64(len(header))*headerHeight + float64(len(comment))*commentHeight
+	contentHeight := math.Max(textHeight, avatarSize*scale)
+
+	bubbleWidth := 2*padding*scale + avatarSize*scale + avatarGap*scale + width
+	bubbleHeight := 2*padding*scale + contentHeight
+
+	bounds := image.Rect(0, 0, int(math.Ceil(bubbleWidth)), int(math.Ceil(bubbleHeight+tailHeight*scale)))
+	img := image.NewRGBA(bounds)
+
+	// Bubble, with a tail at the bottom left pointing at the reply
+	r := radius * scale
+	tailX := tailOffset * scale
+	bubble := func(x, y float64) bool {
+		return inRoundedRect(x, y, 0, 0, bubbleWidth, bubbleHeight, r) ||
+			inTriangle(x, y, tailX, bubbleHeight-1, tailX+tailWidth*scale, bubbleHeight-1, tailX, bubbleHeight+tailHeight*scale)
+	}
+	draw.DrawMask(img, bounds, image.NewUniform(bubbleColor), image.Point{}, &mask{shape: bubble, bounds: bounds}, image.Point{}, draw.Over)
+
+	// Avatar, centered vertically
+	size := avatarSize * scale
+	ax := padding * scale
+	ay := padding*scale + (contentHeight-size)/2
+	if err := drawAvatar(img, cd.ImagePath, ax, ay, size); err != nil {
+		return nil, err
+	}
+
+	// Text, centered vertically next to the avatar
+	x := padding*scale + size + avatarGap*scale
+	y := padding*scale + (contentHeight-textHeight)/2
+	y = drawLines(img, headerFace, headerColor, header, x, y, headerHeight)
+	drawLines(img, commentFace, commentColor, comment, x, y, commentHeight)
+
+	return img, nil
+}
+
+// RenderPNG renders the bubble like Render and writes it to w as a PNG.
+func RenderPNG(w io.Writer, cd *CommentData, scale float64) error {
+	img, err := Render(cd, scale)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+func newFace(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+func measure(face font.Face, s string) float64 {
+	return float64(font.MeasureString(face, s)) / 64
+}
+
+// wrap breaks text into lines no wider than width, at spaces if possible.
+// Line breaks in the text are kept.
+func wrap(face font.Face, text string, width float64) []string {
+	text = dropMissing(face, text)
+
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			// Words that do not fit on a line of their own are broken
+			for measure(face, word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				n := fit(face, word, width)
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+
+			if line == "" {
+				line = word
+			} else if measure(face, line+" "+word) <= width {
+				line += " " + word
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// fit returns the length of the longest prefix of s no wider than width,
+// but at least one rune.
+func fit(face font.Face, s string, width float64) int {
+	n := 0
+	for i, r := range s {
+		end := i + len(string(r))
+		if n > 0 && measure(face, s[:end]) > width {
+			break
+		}
+		n = end
+	}
+	return n
+}
+
+// dropMissing removes the characters face has no glyph for, which would be
+// drawn as boxes.
+func dropMissing(face font.Face, s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return r
+		}
+		if _, ok := face.GlyphAdvance(r); !ok {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// drawLines draws lines of text from y down and returns the y below them.
+func drawLines(img draw.Image, face font.Face, c color.Color, lines []string, x, y, lineHeight float64) float64 {
+	metrics := face.Metrics()
+	ascent := float64(metrics.Ascent) / 64
+	height := float64(metrics.Height) / 64
+
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+	}
+	for _, line := range lines {
+		baseline := y + (lineHeight-height)/2 + ascent
+		d.Dot = fixed.Point26_6{X: fixed.Int26_6(x * 64), Y: fixed.Int26_6(baseline * 64)}
+		d.DrawString(line)
+		y += lineHeight
+	}
+
+	return y
+}
+
+// drawAvatar draws the image at path cropped to a circle of the given
+// diameter, or a gray circle if there is no image.
+func drawAvatar(img draw.Image, path string, x, y, size float64) error {
+	cx, cy, r := x+size/2, y+size/2, size/2
+	circle := func(px, py float64) bool {
+		return (px-cx)*(px-cx)+(py-cy)*(py-cy) <= r*r
+	}
+	rect := image.Rect(int(math.Floor(x)), int(math.Floor(y)), int(math.Ceil(x+size)), int(math.Ceil(y+size)))
+	m := &mask{shape: circle, bounds: rect}
+
+	if path == "" {
+		draw.DrawMask(img, rect, image.NewUniform(placeholderColor), image.Point{}, m, rect.Min, draw.Over)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	avatar, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode avatar: %w", err)
+	}
+
+	// Crop the middle square, then scale it to the circle
+	b := avatar.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+
+	scaled := image.NewRGBA(rect)
+	xdraw.CatmullRom.Scale(scaled, rect, avatar, crop, xdraw.Src, nil)
+
+	draw.DrawMask(img, rect, scaled, rect.Min, m, rect.Min, draw.Over)
+	return nil
+}
+
+// mask is an antialiased alpha mask of a shape, given by whether a point is
+// inside it.
+type mask struct {
+	shape  func(x, y float64) bool
+	bounds image.Rectangle
+}
+
+func (m *mask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m *mask) Bounds() image.Rectangle {
+	return m.bounds
+}
+
+// At samples the pixel on a 4x4 grid.
+func (m *mask) At(x, y int) color.Color {
+	const n = 4
+
+	inside := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if m.shape(float64(x)+(float64(i)+0.5)/n, float64(y)+(float64(j)+0.5)/n) {
+				inside++
+			}
+		}
+	}
+
+	return color.Alpha{A: uint8(inside * 0xff / (n * n))}
+}
+
+func inRoundedRect(x, y, x0, y0, x1, y1, r float64) bool {
+	if x < x0 || x > x1 || y < y0 || y > y1 {
+		return false
+	}
+
+	// Only the corners are rounded
+	cx := math.Max(x0+r, math.Min(x, x1-r))
+	cy := math.Max(y0+r, math.Min(y, y1-r))
+	return (x-cx)*(x-cx)+(y-cy)*(y-cy) <= r*r
+}
+
+func inTriangle(x, y, x0, y0, x1, y1, x2, y2 float64) bool {
+	side := func(ax, ay, bx, by float64) float64 {
+		return (x-bx)*(ay-by) - (ax-bx)*(y-by)
+	}
+
+	d0 := side(x0, y0, x1, y1)
+	d1 := side(x1, y1, x2, y2)
+	d2 := side(x2, y2, x0, y0)
+
+	negative := d0 < 0 || d1 < 0 || d2 < 0
+	positive := d0 > 0 || d1 > 0 || d2 > 0
+	return !(negative && positive)
+}
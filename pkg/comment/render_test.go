@@ -0,0 +1,211 @@
+package comment
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// writeAvatar writes a width x height avatar with a different color in each
+// quarter, so the crop and circle show in the golden images.
+func writeAvatar(t *testing.T, width, height int) string {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{0x20, 0x20, 0x20, 0xff}
+			if x >= width/2 {
+				c.R = 0xe0
+			}
+			if y >= height/2 {
+				c.B = 0xe0
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "avatar.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRenderGolden(t *testing.T) {
+	square := writeAvatar(t, 64, 64)
+	wide := writeAvatar(t, 120, 40)
+
+	tests := []struct {
+		name  string
+		data  CommentData
+		scale float64
+	}{
+		{"short", CommentData{"fakeuser", "first!", square}, 2},
+		{"wrapped", CommentData{"fakeuser", "this is the kind of comment that goes on and on until it needs a few lines to fit in the bubble", square}, 2},
+		{"long-word", CommentData{"fakeuser", "wait " + strings.Repeat("aaaaaaaaaa", 8) + " what", square}, 2},
+		{"no-avatar", CommentData{"fakeuser", "first!", ""}, 2},
+		{"wide-avatar", CommentData{"fakeuser", "first!", wide}, 2},
+		{"scale-1", CommentData{"fakeuser", "first!", square}, 1},
+		{"scale-3", CommentData{"fakeuser", "first!", square}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Render(&tt.data, tt.scale)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".png")
+			if *update {
+				writeGolden(t, golden, got)
+				return
+			}
+
+			f, err := os.Open(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("got a %v image, want %v; run the tests with -update if the change is intended", got.Bounds().Size(), want.Bounds().Size())
+			}
+			if n := diffPixels(got, want); n > 0 {
+				t.Errorf("%d pixels differ from %s; run the tests with -update if the change is intended", n, golden)
+			}
+		})
+	}
+}
+
+func writeGolden(t *testing.T, path string, img image.Image) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// diffPixels returns how many pixels of a and b differ by more than a small
+// tolerance in any channel, which leaves room for floating point differences
+// between platforms.
+func diffPixels(a, b image.Image) int {
+	const tolerance = 8 << 8
+
+	diff := func(x, y uint32) bool {
+		if x > y {
+			return x-y > tolerance
+		}
+		return y-x > tolerance
+	}
+
+	n := 0
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r0, g0, b0, a0 := a.At(x, y).RGBA()
+			r1, g1, b1, a1 := b.At(x, y).RGBA()
+			if diff(r0, r1) || diff(g0, g1) || diff(b0, b1) || diff(a0, a1) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestRenderScale(t *testing.T) {
+	cd := &CommentData{Username: "fakeuser", Comment: "first!"}
+
+	one, err := Render(cd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	three, err := Render(cd, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sizes are rounded up at each scale, and glyph advances are hinted
+	for _, d := range []struct{ one, three int }{
+		{one.Bounds().Dx(), three.Bounds().Dx()},
+		{one.Bounds().Dy(), three.Bounds().Dy()},
+	} {
+		if d.three < 3*d.one-6 || d.three > 3*d.one+6 {
+			t.Errorf("got %v at scale 3, want about three times %v", three.Bounds().Size(), one.Bounds().Size())
+		}
+	}
+
+	for _, scale := range []float64{0, -1} {
+		if _, err := Render(cd, scale); err == nil {
+			t.Errorf("rendered at scale %v", scale)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if err := loadFonts(); err != nil {
+		t.Fatal(err)
+	}
+	face, err := newFace(boldFont, commentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer face.Close()
+
+	long := strings.Repeat("aaaaaaaaaa", 8)
+	tests := []struct {
+		text  string
+		lines int
+	}{
+		{"first!", 1},
+		{"one\ntwo", 2},
+		{"wait " + long + " what", 0},
+		{"no emoji here \U0001F389", 1},
+	}
+
+	for _, tt := range tests {
+		lines := wrap(face, tt.text, maxTextWidth)
+		if tt.lines > 0 && len(lines) != tt.lines {
+			t.Errorf("wrapped %q into %q, want %d lines", tt.text, lines, tt.lines)
+		}
+		for _, line := range lines {
+			if w := measure(face, line); w > maxTextWidth {
+				t.Errorf("wrapped %q into line %q of width %v, over %v", tt.text, line, w, maxTextWidth)
+			}
+			if strings.ContainsRune(line, '\U0001F389') {
+				t.Errorf("kept a character the font lacks in %q", line)
+			}
+		}
+		if got := strings.Join(lines, ""); strings.ReplaceAll(got, " ", "") != strings.ReplaceAll(strings.ReplaceAll(dropMissing(face, tt.text), " ", ""), "\n", "") {
+			t.Errorf("wrapping %q lost text: %q", tt.text, lines)
+		}
+	}
+}
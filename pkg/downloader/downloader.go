@@ -1,43 +1,314 @@
 package downloader
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	// ErrContentType is returned when the response is not a video, e.g. an
+	// HTML error page served with status 200, or does not say what it is.
+	ErrContentType = errors.New("unexpected content type")
+	// ErrIncomplete is returned when the body is shorter or longer than its
+	// Content-Length. An incomplete download is resumed by the next call.
+	ErrIncomplete = errors.New("incomplete download")
+)
+
+// StatusError is returned for responses with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %s", e.Status)
+}
+
+// Result describes a completed download.
+type Result struct {
+	Size int64
+	// SHA256 is the hex SHA-256 of the content, computed while it streamed
+	SHA256 string
+}
+
 // Client represents a video downloader
 type Client struct {
 	HttpClient *http.Client
+	// Progress, if set, is called as the download progresses with the bytes
+	// downloaded so far, including resumed ones, and the total size, or -1
+	// if the server does not tell.
+	Progress func(downloaded, total int64)
 }
 
+// New returns a client that gives up on servers that take more than 10s to
+// connect or respond. The body itself may take as long as the context
+// allows.
 func New() *Client {
 	return &Client{
 		HttpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 10 * time.Second,
+			},
 		},
 	}
 }
 
 // DownloadVideo downloads a video from the given URL and saves it locally
-func (v *Client) DownloadVideo(url, filename string) error {
-	resp, err := http.Get(url)
+func (v *Client) DownloadVideo(url, filename string) (*Result, error) {
+	return v.DownloadVideoContext(context.Background(), url, filename)
+}
+
+// DownloadVideoContext is like DownloadVideo, but aborts the download when ctx
+// is done. The video is written to filename + ".part", which is renamed to
+// filename once it is complete, so filename never holds a partial video. A
+// part left by an interrupted download is resumed with a Range request, and
+// only started over if the server sends the whole video or the part does not
+// match its size.
+func (v *Client) DownloadVideoContext(ctx context.Context, url, filename string) (*Result, error) {
+	partName := filename + ".part"
+
+	part, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer part.Close()
+
+	// Hash what an earlier attempt downloaded, the rest is hashed as it
+	// streams in
+	h := sha256.New()
+	offset, err := io.Copy(h, part)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.get(ctx, url, offset)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	out, err := os.Create(filename)
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The part holds the whole video if it is as long as it, otherwise
+		// it is not a prefix of it, so start over
+		if size, ok := unsatisfiedRangeSize(resp.Header.Get("Content-Range")); ok && size == offset {
+			if v.Progress != nil {
+				v.Progress(offset, offset)
+			}
+			return finishPart(part, partName, filename, offset, h)
+		}
+
+		resp.Body.Close()
+		if resp, err = v.get(ctx, url, 0); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+	}
+
+	// The part is only dropped for a response with the video, so a resumed
+	// download that fails, e.g. with a 503, is resumed again by the next call
+	if err := checkResponse(resp); err != nil {
+		if offset == 0 {
+			part.Close()
+			os.Remove(partName)
+		}
+		return nil, err
+	}
+
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// The server sent the whole video, so start over
+		offset = 0
+		h.Reset()
+		if err := part.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := part.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	size, err := v.copy(part, resp, h, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishPart(part, partName, filename, size, h)
+}
+
+// finishPart syncs a complete part and renames it to filename.
+func finishPart(part *os.File, partName, filename string, size int64, h hash.Hash) (*Result, error) {
+	if err := part.Sync(); err != nil {
+		return nil, err
+	}
+	if err := part.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(partName, filename); err != nil {
+		return nil, err
+	}
+
+	return &Result{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// DownloadToContext streams a video from the given URL into w, without a
+// file in between. It cannot be resumed.
+func (v *Client) DownloadToContext(ctx context.Context, url string, w io.Writer) (*Result, error) {
+	resp, err := v.get(ctx, url, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	size, err := v.copy(w, resp, h, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// get requests the video from offset on.
+func (v *Client) get(ctx context.Context, url string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	client := v.HttpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(req)
+}
+
+// checkResponse makes sure the response holds a video.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		return fmt.Errorf("%w: none given", ErrContentType)
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w %q", ErrContentType, contentType)
+	}
+	if !strings.HasPrefix(mediaType, "video/") && mediaType != "application/octet-stream" && mediaType != "binary/octet-stream" {
+		return fmt.Errorf("%w %q", ErrContentType, mediaType)
 	}
 
 	return nil
 }
+
+// copy writes the body to w and h and returns the size of the video, offset
+// included. It fails with ErrIncomplete if the body does not match its
+// Content-Length.
+func (v *Client) copy(w io.Writer, resp *http.Response, h hash.Hash, offset int64) (int64, error) {
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, err
+		}
+		if start != offset {
+			return 0, fmt.Errorf("server resumed at byte %d instead of %d", start, offset)
+		}
+		if size >= 0 {
+			total = size
+		}
+	}
+
+	pw := &progressWriter{downloaded: offset, total: total, progress: v.Progress}
+	n, err := io.Copy(io.MultiWriter(w, h, pw), resp.Body)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("%w: connection closed after %d bytes", ErrIncomplete, n)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return 0, fmt.Errorf("%w: got %d of %d bytes", ErrIncomplete, n, resp.ContentLength)
+	}
+
+	return offset + n, nil
+}
+
+// parseContentRange parses "bytes start-end/size" and returns start and
+// size, or -1 if the size is "*".
+func parseContentRange(s string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	rng, sizeStr, ok2 := strings.Cut(spec, "/")
+	startStr, _, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+
+	if sizeStr == "*" {
+		return start, -1, nil
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+
+	return start, size, nil
+}
+
+// unsatisfiedRangeSize parses the "bytes */size" Content-Range of a 416
+// response and returns the size.
+func unsatisfiedRangeSize(s string) (int64, bool) {
+	sizeStr, ok := strings.CutPrefix(s, "bytes */")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	return size, err == nil
+}
+
+type progressWriter struct {
+	downloaded, total int64
+	progress          func(downloaded, total int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.downloaded += int64(len(p))
+	if pw.progress != nil {
+		pw.progress(pw.downloaded, pw.total)
+	}
+	return len(p), nil
+}
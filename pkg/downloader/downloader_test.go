@@ -0,0 +1,355 @@
+package downloader_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/downloader"
+)
+
+var video = func() []byte {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}()
+
+func videoSHA256() string {
+	sum := sha256.Sum256(video)
+	return hex.EncodeToString(sum[:])
+}
+
+// serveVideo serves the video with Range support, like a CDN.
+func serveVideo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(video))
+}
+
+// newTestServer starts a server with handler and returns the URL and the
+// Range headers of the requests it got.
+func newTestServer(t *testing.T, handler http.HandlerFunc) (string, *[]string) {
+	t.Helper()
+
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		handler(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts.URL, &ranges
+}
+
+func checkVideo(t *testing.T, filename string, result *downloader.Result) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, video) {
+		t.Errorf("downloaded %d bytes that differ from the %d served", len(data), len(video))
+	}
+	if result.Size != int64(len(video)) {
+		t.Errorf("got size %d, want %d", result.Size, len(video))
+	}
+	if result.SHA256 != videoSHA256() {
+		t.Errorf("got SHA-256 %s, want %s", result.SHA256, videoSHA256())
+	}
+	if _, err := os.Stat(filename + ".part"); !os.IsNotExist(err) {
+		t.Errorf("part was left behind: %v", err)
+	}
+}
+
+func TestDownloadVideo(t *testing.T) {
+	url, ranges := newTestServer(t, serveVideo)
+	filename := filepath.Join(t.TempDir(), "video.mp4")
+
+	type call struct{ downloaded, total int64 }
+	var calls []call
+
+	client := downloader.New()
+	client.Progress = func(downloaded, total int64) {
+		calls = append(calls, call{downloaded, total})
+	}
+
+	result, err := client.DownloadVideo(url, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVideo(t, filename, result)
+
+	if len(*ranges) != 1 || (*ranges)[0] != "" {
+		t.Errorf("got Range headers %q, want one request without", *ranges)
+	}
+
+	if len(calls) == 0 {
+		t.Fatal("progress was not reported")
+	}
+	var last int64
+	for _, c := range calls {
+		if c.total != int64(len(video)) {
+			t.Errorf("got progress total %d, want %d", c.total, len(video))
+		}
+		if c.downloaded <= last {
+			t.Errorf("progress went from %d to %d bytes", last, c.downloaded)
+		}
+		last = c.downloaded
+	}
+	if last != int64(len(video)) {
+		t.Errorf("progress ended at %d bytes, want %d", last, len(video))
+	}
+}
+
+func TestDownloadVideoErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		check   func(err error) bool
+	}{
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+			},
+			check: func(err error) bool {
+				var statusErr *downloader.StatusError
+				return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusForbidden
+			},
+		},
+		{
+			name: "no content type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// A nil value keeps the server from sniffing one
+				w.Header()["Content-Type"] = nil
+				w.Write(video)
+			},
+			check: func(err error) bool {
+				return errors.Is(err, downloader.ErrContentType)
+			},
+		},
+		{
+			name: "html",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte("<html>blocked</html>"))
+			},
+			check: func(err error) bool {
+				return errors.Is(err, downloader.ErrContentType)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, _ := newTestServer(t, tt.handler)
+			filename := filepath.Join(t.TempDir(), "video.mp4")
+
+			_, err := downloader.New().DownloadVideo(url, filename)
+			if !tt.check(err) {
+				t.Fatalf("got error %v", err)
+			}
+
+			for _, name := range []string{filename, filename + ".part"} {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("%s exists after a failed download: %v", filepath.Base(name), err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadVideoShortBody(t *testing.T) {
+	short := true
+	url, ranges := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if !short {
+			serveVideo(w, r)
+			return
+		}
+
+		// The connection breaks halfway through the body
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(video)))
+		w.Write(video[:len(video)/2])
+	})
+	filename := filepath.Join(t.TempDir(), "video.mp4")
+	client := downloader.New()
+
+	if _, err := client.DownloadVideo(url, filename); !errors.Is(err, downloader.ErrIncomplete) {
+		t.Fatalf("got error %v, want ErrIncomplete", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("incomplete video was renamed into place: %v", err)
+	}
+	part, err := os.ReadFile(filename + ".part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(part) != len(video)/2 {
+		t.Fatalf("kept %d bytes, want %d", len(part), len(video)/2)
+	}
+
+	short = false
+	result, err := client.DownloadVideo(url, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVideo(t, filename, result)
+
+	if want := "bytes=" + strconv.Itoa(len(video)/2) + "-"; (*ranges)[1] != want {
+		t.Errorf("resumed with Range %q, want %q", (*ranges)[1], want)
+	}
+}
+
+func TestDownloadVideoResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		part    []byte
+		handler http.HandlerFunc
+		// ranges are the Range headers the server should get
+		ranges []string
+		// minFirst is the least the first progress report may be
+		minFirst int64
+	}{
+		{
+			name:     "partial content",
+			part:     video[:1000],
+			handler:  serveVideo,
+			ranges:   []string{"bytes=1000-"},
+			minFirst: 1001,
+		},
+		{
+			name: "whole content",
+			part: video[:1000],
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				r.Header.Del("Range")
+				serveVideo(w, r)
+			},
+			ranges:   []string{"bytes=1000-"},
+			minFirst: 1,
+		},
+		{
+			name:     "range not satisfiable",
+			part:     append(append([]byte(nil), video...), "garbage"...),
+			handler:  serveVideo,
+			ranges:   []string{"bytes=" + strconv.Itoa(len(video)+7) + "-", ""},
+			minFirst: 1,
+		},
+		{
+			// The part already holds the whole video
+			name:     "complete part",
+			part:     video,
+			handler:  serveVideo,
+			ranges:   []string{"bytes=" + strconv.Itoa(len(video)) + "-"},
+			minFirst: int64(len(video)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, ranges := newTestServer(t, tt.handler)
+			filename := filepath.Join(t.TempDir(), "video.mp4")
+			if err := os.WriteFile(filename+".part", tt.part, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			first := int64(-1)
+			client := downloader.New()
+			client.Progress = func(downloaded, total int64) {
+				if first < 0 {
+					first = downloaded
+				}
+				if total != int64(len(video)) {
+					t.Errorf("got progress total %d, want %d", total, len(video))
+				}
+			}
+
+			result, err := client.DownloadVideoContext(context.Background(), url, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkVideo(t, filename, result)
+
+			if len(*ranges) != len(tt.ranges) {
+				t.Fatalf("got Range headers %q, want %q", *ranges, tt.ranges)
+			}
+			for i := range tt.ranges {
+				if (*ranges)[i] != tt.ranges[i] {
+					t.Errorf("got Range headers %q, want %q", *ranges, tt.ranges)
+				}
+			}
+
+			// Progress counts resumed bytes, and starts over with the video
+			if first < tt.minFirst || first > int64(len(video)) {
+				t.Errorf("progress started at %d bytes, want at least %d", first, tt.minFirst)
+			}
+		})
+	}
+}
+
+func TestDownloadVideoResumeAfterError(t *testing.T) {
+	unavailable := true
+	url, ranges := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if unavailable {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		serveVideo(w, r)
+	})
+	filename := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(filename+".part", video[:1000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := downloader.New()
+
+	_, err := client.DownloadVideo(url, filename)
+	var statusErr *downloader.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got error %v, want status 503", err)
+	}
+	part, err := os.ReadFile(filename + ".part")
+	if err != nil {
+		t.Fatalf("part was removed by a failed resume: %v", err)
+	}
+	if !bytes.Equal(part, video[:1000]) {
+		t.Fatalf("part holds %d bytes after a failed resume, want the 1000 downloaded", len(part))
+	}
+
+	unavailable = false
+	result, err := client.DownloadVideo(url, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVideo(t, filename, result)
+
+	if want := []string{"bytes=1000-", "bytes=1000-"}; len(*ranges) != 2 || (*ranges)[0] != want[0] || (*ranges)[1] != want[1] {
+		t.Errorf("got Range headers %q, want %q", *ranges, want)
+	}
+}
+
+func TestDownloadToContext(t *testing.T) {
+	url, _ := newTestServer(t, serveVideo)
+
+	var buf bytes.Buffer
+	result, err := downloader.New().DownloadToContext(context.Background(), url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), video) {
+		t.Errorf("wrote %d bytes that differ from the %d served", buf.Len(), len(video))
+	}
+	if result.Size != int64(len(video)) || result.SHA256 != videoSHA256() {
+		t.Errorf("got %+v, want size %d and SHA-256 %s", result, len(video), videoSHA256())
+	}
+}
@@ -1,15 +1,16 @@
 package metadata
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
+	"path/filepath"
 	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe"
 )
 
 type Metadata struct {
@@ -57,97 +58,64 @@ Rotation                        : 0
 */
 
 func NewMetadata(videoPath string) (*Metadata, error) {
-	rand.Seed(time.Now().UnixNano())
+	return NewMetadataContext(context.Background(), videoPath)
+}
 
+// NewMetadataContext is like NewMetadata, but kills ffprobe when ctx is done
+func NewMetadataContext(ctx context.Context, videoPath string) (*Metadata, error) {
 	// Get the creation time of the video file
 	videoInfo, err := os.Stat(videoPath)
 	if err != nil {
 		fmt.Println("Error getting file information:", err)
 		return nil, err
 	}
-	creationTime := videoInfo.ModTime()
-
-	// Convert the creation time to the correct format
-	time := ConvertTimeToExifTime(creationTime)
-
-	// Generate a random video ID
-	videoID := fmt.Sprintf("%X-%X-%X-%X-%X", rand.Int31(), rand.Int31(), rand.Int31(), rand.Int31(), rand.Int31())
 
 	// Run ffprobe to get metadata
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", videoPath)
-	output, err := cmd.Output()
+	probeOutput, err := probe.Probe(ctx, videoPath)
 	if err != nil {
 		fmt.Println("Error running ffprobe:", err)
 		return nil, err
 	}
 
-	var probeOutput map[string]interface{}
-	err = json.Unmarshal(output, &probeOutput)
-	if err != nil {
-		fmt.Println("Error unmarshalling ffprobe output:", err)
-		return nil, err
-	}
+	return NewMetadataFromProbe(probeOutput, videoInfo.ModTime())
+}
 
-	streams, ok := probeOutput["streams"].([]interface{})
-	if !ok {
-		fmt.Println("Error: cannot assert probeOutput[\"streams\"] to []interface{}")
-		return nil, errors.New("invalid ffprobe output")
-	}
-	var videoStream, audioStream map[string]interface{}
-	for _, stream := range streams {
-		streamMap, ok := stream.(map[string]interface{})
-		if !ok {
-			fmt.Println("Error: cannot assert stream to map[string]interface{}")
-			return nil, errors.New("invalid ffprobe output")
-		}
-		if streamMap["codec_type"].(string) == "video" {
-			videoStream = streamMap
-		} else if streamMap["codec_type"].(string) == "audio" {
-			audioStream = streamMap
-		}
+// NewMetadataFromProbe is like NewMetadata, but takes what ffprobe reported
+// about the video and when it was created.
+func NewMetadataFromProbe(probeOutput *probe.Result, creationTime time.Time) (*Metadata, error) {
+	rand.Seed(time.Now().UnixNano())
+
+	// Convert the creation time to the correct format
+	time := ConvertTimeToExifTime(creationTime)
+
+	// Generate a random video ID
+	videoID := fmt.Sprintf("%X-%X-%X-%X-%X", rand.Int31(), rand.Int31(), rand.Int31(), rand.Int31(), rand.Int31())
+
+	videoStream := probeOutput.VideoStream()
+	if videoStream == nil {
+		return nil, errors.New("no video stream")
 	}
 
 	// Extract metadata
-	imageWidth := int64(videoStream["width"].(float64))
-	imageHeight := int64(videoStream["height"].(float64))
-	displayAspectRatio := videoStream["display_aspect_ratio"].(string)
-	split := strings.Split(displayAspectRatio, ":")
-	numerator, err := strconv.Atoi(split[0])
+	imageWidth := int64(videoStream.Width)
+	imageHeight := int64(videoStream.Height)
+	aspectRatio, err := videoStream.AspectRatio()
 	if err != nil {
-		fmt.Println("Error converting numerator:", err)
-		return nil, err
-	}
-	denominator, err := strconv.Atoi(split[1])
-	if err != nil {
-		fmt.Println("Error converting denominator:", err)
+		fmt.Println("Error getting aspect ratio:", err)
 		return nil, err
 	}
 
 	// Calculate x and y resolution based on the display aspect ratio and the given image width and height
-	aspectRatio := float64(numerator) / float64(denominator)
-	xResolution := int64(float64(imageHeight) * aspectRatio)
+	xResolution := int64(float64(imageHeight) * aspectRatio.Float())
 	yResolution := imageHeight
 
-	frameRate := videoStream["avg_frame_rate"].(string)
-	split = strings.Split(frameRate, "/")
-	numerator, err = strconv.Atoi(split[0])
-	if err != nil {
-		fmt.Println("Error converting numerator:", err)
-		return nil, err
-	}
-	denominator, err = strconv.Atoi(split[1])
-	if err != nil {
-		fmt.Println("Error converting denominator:", err)
-		return nil, err
-	}
-	videoFrameRate := float64(numerator) / float64(denominator)
+	videoFrameRate := videoStream.AvgFrameRate.Float()
 
-	audioBitsPerSample := int64(audioStream["bits_per_sample"].(float64))
-	audioSampleRateStr := audioStream["sample_rate"].(string)
-	audioSampleRate, err := strconv.ParseInt(audioSampleRateStr, 10, 64)
-	if err != nil {
-		fmt.Println("Error converting audioSampleRate:", err)
-		return nil, err
+	// Videos without audio keep the audio fields zero
+	var audioBitsPerSample, audioSampleRate int64
+	if audioStream := probeOutput.AudioStream(); audioStream != nil {
+		audioBitsPerSample = int64(audioStream.BitsPerSample)
+		audioSampleRate = int64(audioStream.SampleRate)
 	}
 
 	// Return the metadata
@@ -180,25 +148,31 @@ func ConvertTimeToExifTime(t time.Time) string {
 }
 
 func WriteMetadataToFile(metadata *Metadata, path string) error {
-	tmp := ".__temp_data.mp4"
+	return WriteMetadataToFileContext(context.Background(), metadata, path)
+}
+
+// WriteMetadataToFileContext is like WriteMetadataToFile, but kills exiftool
+// when ctx is done
+func WriteMetadataToFileContext(ctx context.Context, metadata *Metadata, path string) error {
+	tmp := tempPath(path)
 	defer os.Remove(tmp)
 
 	// Copy the video to a temporary file
-	copyCmd := exec.Command("cp", path, tmp)
+	copyCmd := exec.CommandContext(ctx, "cp", path, tmp)
 	err := copyCmd.Run()
 	if err != nil {
 		return fmt.Errorf("error copying video to temporary file: %w", err)
 	}
 
 	// Remove existing metadata, in place
-	removeMetadataCmd := exec.Command("exiftool", "-all=", tmp)
+	removeMetadataCmd := exec.CommandContext(ctx, "exiftool", "-all=", tmp)
 	err = removeMetadataCmd.Run()
 	if err != nil {
 		return fmt.Errorf("error removing metadata: %w", err)
 	}
 
 	// Add new metadata to the video, in place
-	addMetadataCmd := exec.Command("exiftool",
+	addMetadataCmd := exec.CommandContext(ctx, "exiftool",
 		"-overwrite_original",
 		fmt.Sprintf("-TrackCreateDate=%s", metadata.TrackCreateDate),
 		fmt.Sprintf("-TrackModifyDate=%s", metadata.TrackModifyDate),
@@ -235,12 +209,18 @@ func WriteMetadataToFile(metadata *Metadata, path string) error {
 }
 
 func GenerateMetadataAndWriteToFile(path string) error {
-	metadata, err := NewMetadata(path)
+	return GenerateMetadataAndWriteToFileContext(context.Background(), path)
+}
+
+// GenerateMetadataAndWriteToFileContext is like GenerateMetadataAndWriteToFile,
+// but kills ffprobe and exiftool when ctx is done
+func GenerateMetadataAndWriteToFileContext(ctx context.Context, path string) error {
+	metadata, err := NewMetadataContext(ctx, path)
 	if err != nil {
 		return fmt.Errorf("error getting metadata: %w", err)
 	}
 
-	err = WriteMetadataToFile(metadata, path)
+	err = WriteMetadataToFileContext(ctx, metadata, path)
 	if err != nil {
 		return fmt.Errorf("error writing metadata to file: %w", err)
 	}
@@ -249,14 +229,20 @@ func GenerateMetadataAndWriteToFile(path string) error {
 }
 
 func ReencodeVideo(path string) error {
+	return ReencodeVideoContext(context.Background(), path)
+}
+
+// ReencodeVideoContext is like ReencodeVideo, but kills ffmpeg when ctx is
+// done
+func ReencodeVideoContext(ctx context.Context, path string) error {
 	// ffmpeg -i input.mp4 -c:v libx265 -vtag hvc1 -c:a aac -crf 0 -b:v 16M -maxrate 0 -bufsize 16M output.mp4
 
 	// Create a temporary file
-	tmp := ".__temp_data.mp4"
+	tmp := tempPath(path)
 	defer os.Remove(tmp)
 
 	// Reencode the video
-	reencodeCmd := exec.Command("ffmpeg",
+	reencodeCmd := exec.CommandContext(ctx, "ffmpeg",
 		"-i", path,
 		"-c:v", "libx265",
 		"-vtag", "hvc1",
@@ -272,7 +258,7 @@ func ReencodeVideo(path string) error {
 	}
 
 	// Copy the video to the original file
-	copyCmd := exec.Command("cp", tmp, path)
+	copyCmd := exec.CommandContext(ctx, "cp", tmp, path)
 	err = copyCmd.Run()
 	if err != nil {
 		return fmt.Errorf("error copying video to original file: %w", err)
@@ -280,3 +266,10 @@ func ReencodeVideo(path string) error {
 
 	return nil
 }
+
+// tempPath returns a temporary file next to path, so videos processed at the
+// same time do not share one. It keeps the extension, which exiftool and
+// ffmpeg go by.
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), ".__temp_data-"+filepath.Base(path))
+}
@@ -0,0 +1,67 @@
+package metadata_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/metadata"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe/fakeprobe"
+)
+
+func TestNewMetadataFromProbe(t *testing.T) {
+	created := time.Date(2023, 2, 26, 4, 41, 35, 0, time.UTC)
+
+	tests := []struct {
+		fixture       string
+		width, height int64
+		xResolution   int64
+		frameRate     float64
+		audioRate     int64
+		wantErr       bool
+	}{
+		{fixture: "tiktok", width: 1080, height: 1920, xResolution: 1080, frameRate: 30, audioRate: 44100},
+		// Without audio, the audio fields stay zero
+		{fixture: "noaudio", width: 720, height: 1280, xResolution: 720, frameRate: 30000.0 / 1001},
+		// Without a display aspect ratio, it is derived from the dimensions
+		{fixture: "nodar", width: 576, height: 1024, xResolution: 576, frameRate: 25, audioRate: 48000},
+		{fixture: "audioonly", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			r, err := fakeprobe.Load(tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := metadata.NewMetadataFromProbe(r, created)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got metadata of a file without a video stream")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.ImageWidth != tt.width || m.ImageHeight != tt.height {
+				t.Errorf("got %dx%d, want %dx%d", m.ImageWidth, m.ImageHeight, tt.width, tt.height)
+			}
+			if m.XResolution != tt.xResolution || m.YResolution != tt.height {
+				t.Errorf("got resolution %dx%d, want %dx%d", m.XResolution, m.YResolution, tt.xResolution, tt.height)
+			}
+			if m.VideoFrameRate != tt.frameRate {
+				t.Errorf("got frame rate %v, want %v", m.VideoFrameRate, tt.frameRate)
+			}
+			if m.AudioSampleRate != tt.audioRate || m.AudioBitsPerSample != 0 {
+				t.Errorf("got audio at %d Hz with %d bits, want %d Hz", m.AudioSampleRate, m.AudioBitsPerSample, tt.audioRate)
+			}
+
+			want := "2023:02:26 04:41:35.00+00:00"
+			if m.TrackCreateDate != want || m.MediaModifyDate != want {
+				t.Errorf("got dates %q and %q, want %q", m.TrackCreateDate, m.MediaModifyDate, want)
+			}
+		})
+	}
+}
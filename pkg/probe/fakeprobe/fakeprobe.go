@@ -0,0 +1,125 @@
+// Package fakeprobe holds ffprobe output recorded from real files, so the
+// code that reads it can run without ffprobe or the videos.
+//
+// Fixtures are laid out as:
+//
+//	tiktok.json     H.264 video with AAC audio, as TikTok serves them
+//	noaudio.json    video without an audio stream
+//	nodar.json      HEVC video without a display_aspect_ratio
+//	audioonly.json  MP3 without a video stream, with "N/A" duration and bit rate
+//
+// Tests of code that runs ffprobe can have the test binary stand in for it,
+// by calling Main from TestMain and Use in the tests.
+package fakeprobe
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// Fixtures returns the recorded ffprobe output.
+func Fixtures() fs.FS {
+	sub, err := fs.Sub(fixtures, "fixtures")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Names returns the names of the fixtures, without the .json extension.
+func Names() []string {
+	entries, err := fs.ReadDir(Fixtures(), ".")
+	if err != nil {
+		panic(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Raw returns the recorded ffprobe output of the named fixture.
+func Raw(name string) ([]byte, error) {
+	return fs.ReadFile(Fixtures(), path.Clean(name)+".json")
+}
+
+// Load parses the named fixture as probe.Probe would have.
+func Load(name string) (*probe.Result, error) {
+	data, err := Raw(name)
+	if err != nil {
+		return nil, err
+	}
+	return probe.Parse(data)
+}
+
+const (
+	// envFake is set for the test binary when it runs as ffprobe
+	envFake = "FAKEPROBE"
+	// envOutput is what the fake ffprobe prints
+	envOutput = "FAKEPROBE_OUTPUT"
+	// envError makes the fake ffprobe fail with it as its last log line
+	envError = "FAKEPROBE_ERROR"
+)
+
+// Main makes the test binary stand in for ffprobe. Call it first thing in
+// TestMain. When probe.Probe runs the test binary, Main prints what Use set
+// and exits instead of running the tests.
+func Main() {
+	if os.Getenv(envFake) == "" {
+		os.Setenv(envFake, "1")
+		probe.Command = os.Args[0]
+		return
+	}
+
+	if message := os.Getenv(envError); message != "" {
+		fmt.Fprintln(os.Stderr, message)
+		os.Exit(1)
+	}
+	output := os.Getenv(envOutput)
+	if output == "" {
+		fmt.Fprintln(os.Stderr, "fakeprobe: no output set, call fakeprobe.Use")
+		os.Exit(1)
+	}
+	fmt.Print(output)
+	os.Exit(0)
+}
+
+// Use makes ffprobe print the named fixture for the rest of the test.
+func Use(t testing.TB, name string) {
+	t.Helper()
+
+	data, err := Raw(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseOutput(t, data)
+}
+
+// UseOutput makes ffprobe print output for the rest of the test.
+func UseOutput(t testing.TB, output []byte) {
+	t.Setenv(envOutput, string(output))
+	t.Setenv(envError, "")
+}
+
+// Fail makes ffprobe fail for the rest of the test, logging message as if
+// it could not read the file.
+func Fail(t testing.TB, message string) {
+	t.Setenv(envError, message)
+}
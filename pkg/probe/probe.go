@@ -0,0 +1,299 @@
+// Package probe runs ffprobe and parses its JSON output into typed structs.
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command is the ffprobe executable Probe runs.
+var Command = "ffprobe"
+
+// Result is what ffprobe reports with -show_format -show_streams.
+type Result struct {
+	Streams []Stream `json:"streams"`
+	Format  Format   `json:"format"`
+}
+
+// Stream is a video, audio or data stream of a file. Fields that do not
+// apply to the stream's type are zero.
+type Stream struct {
+	Index         int    `json:"index"`
+	CodecName     string `json:"codec_name"`
+	CodecLongName string `json:"codec_long_name"`
+	CodecType     string `json:"codec_type"`
+	CodecTag      string `json:"codec_tag_string"`
+	Profile       string `json:"profile"`
+
+	// Video
+	Width              int      `json:"width"`
+	Height             int      `json:"height"`
+	PixFmt             string   `json:"pix_fmt"`
+	SampleAspectRatio  Rational `json:"sample_aspect_ratio"`
+	DisplayAspectRatio Rational `json:"display_aspect_ratio"`
+	RFrameRate         Rational `json:"r_frame_rate"`
+	AvgFrameRate       Rational `json:"avg_frame_rate"`
+
+	// Audio
+	SampleRate    Int    `json:"sample_rate"`
+	Channels      int    `json:"channels"`
+	ChannelLayout string `json:"channel_layout"`
+	BitsPerSample int    `json:"bits_per_sample"`
+
+	TimeBase    Rational       `json:"time_base"`
+	Duration    Duration       `json:"duration"`
+	BitRate     Int            `json:"bit_rate"`
+	NbFrames    Int            `json:"nb_frames"`
+	Disposition map[string]int `json:"disposition"`
+	Tags        Tags           `json:"tags"`
+}
+
+// Format describes the container of a file.
+type Format struct {
+	Filename       string   `json:"filename"`
+	NbStreams      int      `json:"nb_streams"`
+	FormatName     string   `json:"format_name"`
+	FormatLongName string   `json:"format_long_name"`
+	StartTime      Duration `json:"start_time"`
+	Duration       Duration `json:"duration"`
+	Size           Int      `json:"size"`
+	BitRate        Int      `json:"bit_rate"`
+	ProbeScore     int      `json:"probe_score"`
+	Tags           Tags     `json:"tags"`
+}
+
+// Tags are the metadata tags of a stream or format.
+type Tags map[string]string
+
+// Error is returned when ffprobe cannot read a file. Message is the last line
+// ffprobe logged, which says what is wrong with it.
+type Error struct {
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ffprobe: %s", e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Probe runs ffprobe on the file at path. It fails with an *Error if ffprobe
+// cannot read the file.
+func Probe(ctx context.Context, path string) (*Result, error) {
+	cmd := exec.CommandContext(ctx, Command, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return nil, &Error{Message: lastLine(stderr.String(), err), Err: err}
+		}
+		return nil, err
+	}
+
+	return Parse(output)
+}
+
+// Parse parses the JSON output of ffprobe.
+func Parse(data []byte) (*Result, error) {
+	var r Result
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+	return &r, nil
+}
+
+// Stream returns the first stream of the given codec type, or nil if there
+// is none.
+func (r *Result) Stream(codecType string) *Stream {
+	for i := range r.Streams {
+		if r.Streams[i].CodecType == codecType {
+			return &r.Streams[i]
+		}
+	}
+	return nil
+}
+
+// VideoStream returns the first video stream, or nil if there is none.
+func (r *Result) VideoStream() *Stream {
+	return r.Stream("video")
+}
+
+// AudioStream returns the first audio stream, or nil if there is none.
+func (r *Result) AudioStream() *Stream {
+	return r.Stream("audio")
+}
+
+// AspectRatio returns the display aspect ratio of a video stream. If ffprobe
+// does not report one, it is derived from the dimensions and the sample
+// aspect ratio.
+func (s *Stream) AspectRatio() (Rational, error) {
+	if !s.DisplayAspectRatio.IsZero() {
+		return s.DisplayAspectRatio, nil
+	}
+	if s.Width <= 0 || s.Height <= 0 {
+		return Rational{}, fmt.Errorf("stream %d has no dimensions", s.Index)
+	}
+
+	r := Rational{Num: int64(s.Width), Den: int64(s.Height)}
+	if !s.SampleAspectRatio.IsZero() {
+		r.Num *= s.SampleAspectRatio.Num
+		r.Den *= s.SampleAspectRatio.Den
+	}
+	return r, nil
+}
+
+// Rational is a fraction such as a frame rate of "30000/1001" or an aspect
+// ratio of "9:16". ffprobe reports unknown ratios as "0/0" or "N/A", which
+// parse to the zero Rational.
+type Rational struct {
+	Num int64
+	Den int64
+}
+
+// ParseRational parses a fraction separated by "/" or ":".
+func ParseRational(s string) (Rational, error) {
+	if s == "" || s == "N/A" {
+		return Rational{}, nil
+	}
+
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		num, den, ok = strings.Cut(s, ":")
+	}
+	if !ok {
+		return Rational{}, fmt.Errorf("invalid rational %q", s)
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return Rational{}, fmt.Errorf("invalid rational %q", s)
+	}
+	d, err := strconv.ParseInt(den, 10, 64)
+	if err != nil {
+		return Rational{}, fmt.Errorf("invalid rational %q", s)
+	}
+
+	if d == 0 {
+		return Rational{}, nil
+	}
+
+	return Rational{Num: n, Den: d}, nil
+}
+
+// IsZero reports whether the ratio is unknown or zero.
+func (r Rational) IsZero() bool {
+	return r.Num == 0 || r.Den == 0
+}
+
+// Float returns the value of the fraction, or 0 if it is unknown.
+func (r Rational) Float() float64 {
+	if r.Den == 0 {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+func (r Rational) String() string {
+	return fmt.Sprintf("%d/%d", r.Num, r.Den)
+}
+
+func (r *Rational) UnmarshalJSON(data []byte) error {
+	s, err := unquote(data)
+	if err != nil {
+		return err
+	}
+
+	*r, err = ParseRational(s)
+	return err
+}
+
+// Duration is a time reported by ffprobe in seconds, such as "15.023311".
+// "N/A" parses to zero.
+type Duration time.Duration
+
+// Duration returns d as a time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s, err := unquote(data)
+	if err != nil {
+		return err
+	}
+	if s == "" || s == "N/A" {
+		*d = 0
+		return nil
+	}
+
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// Int is an integer that ffprobe reports as a string, such as a bit rate of
+// "1245013". "N/A" parses to zero.
+type Int int64
+
+func (i *Int) UnmarshalJSON(data []byte) error {
+	s, err := unquote(data)
+	if err != nil {
+		return err
+	}
+	if s == "" || s == "N/A" {
+		*i = 0
+		return nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+
+	*i = Int(n)
+	return nil
+}
+
+// unquote returns a JSON string or number as a string.
+func unquote(data []byte) (string, error) {
+	if string(data) == "null" {
+		return "", nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		return s, err
+	}
+	return string(data), nil
+}
+
+// lastLine returns the last line ffprobe logged, or err if it logged nothing.
+func lastLine(stderr string, err error) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return err.Error()
+}
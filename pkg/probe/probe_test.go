@@ -0,0 +1,227 @@
+package probe_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe/fakeprobe"
+)
+
+func TestMain(m *testing.M) {
+	fakeprobe.Main()
+	os.Exit(m.Run())
+}
+
+func TestFixtures(t *testing.T) {
+	type video struct {
+		codec         string
+		width, height int
+		aspectRatio   probe.Rational
+		frameRate     probe.Rational
+	}
+	type audio struct {
+		codec      string
+		sampleRate probe.Int
+		channels   int
+	}
+
+	tests := []struct {
+		name     string
+		streams  int
+		duration time.Duration
+		size     probe.Int
+		bitRate  probe.Int
+		video    *video
+		audio    *audio
+	}{
+		{
+			name:     "audioonly",
+			streams:  1,
+			duration: 0,
+			size:     480836,
+			bitRate:  0,
+			audio:    &audio{"mp3", 44100, 2},
+		},
+		{
+			name:     "noaudio",
+			streams:  1,
+			duration: 9109100 * time.Microsecond,
+			size:     1126432,
+			bitRate:  989291,
+			video: &video{
+				codec: "h264", width: 720, height: 1280,
+				aspectRatio: probe.Rational{Num: 9, Den: 16},
+				frameRate:   probe.Rational{Num: 30000, Den: 1001},
+			},
+		},
+		{
+			// The aspect ratio is derived from the dimensions
+			name:     "nodar",
+			streams:  2,
+			duration: 21 * time.Second,
+			size:     1218344,
+			bitRate:  464131,
+			video: &video{
+				codec: "hevc", width: 576, height: 1024,
+				aspectRatio: probe.Rational{Num: 576, Den: 1024},
+				frameRate:   probe.Rational{Num: 25, Den: 1},
+			},
+			audio: &audio{"aac", 48000, 1},
+		},
+		{
+			name:     "tiktok",
+			streams:  2,
+			duration: 15023311 * time.Microsecond,
+			size:     2587241,
+			bitRate:  1377707,
+			video: &video{
+				codec: "h264", width: 1080, height: 1920,
+				aspectRatio: probe.Rational{Num: 9, Den: 16},
+				frameRate:   probe.Rational{Num: 30, Den: 1},
+			},
+			audio: &audio{"aac", 44100, 2},
+		},
+	}
+
+	names := fakeprobe.Names()
+	if len(names) != len(tests) {
+		t.Errorf("got fixtures %v, want a test for each", names)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := fakeprobe.Load(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(r.Streams) != tt.streams || r.Format.NbStreams != tt.streams {
+				t.Errorf("got %d streams, format says %d, want %d", len(r.Streams), r.Format.NbStreams, tt.streams)
+			}
+			if d := r.Format.Duration.Duration(); d != tt.duration {
+				t.Errorf("got duration %s, want %s", d, tt.duration)
+			}
+			if r.Format.Size != tt.size || r.Format.BitRate != tt.bitRate {
+				t.Errorf("got size %d and bit rate %d, want %d and %d", r.Format.Size, r.Format.BitRate, tt.size, tt.bitRate)
+			}
+
+			v := r.VideoStream()
+			switch {
+			case tt.video == nil && v != nil:
+				t.Errorf("got video stream %d, want none", v.Index)
+			case tt.video != nil && v == nil:
+				t.Error("got no video stream")
+			case tt.video != nil:
+				if v.CodecName != tt.video.codec || v.Width != tt.video.width || v.Height != tt.video.height {
+					t.Errorf("got %s video of %dx%d, want %s of %dx%d", v.CodecName, v.Width, v.Height, tt.video.codec, tt.video.width, tt.video.height)
+				}
+				ratio, err := v.AspectRatio()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ratio != tt.video.aspectRatio {
+					t.Errorf("got aspect ratio %s, want %s", ratio, tt.video.aspectRatio)
+				}
+				if v.AvgFrameRate != tt.video.frameRate || v.RFrameRate != tt.video.frameRate {
+					t.Errorf("got frame rates %s and %s, want %s", v.AvgFrameRate, v.RFrameRate, tt.video.frameRate)
+				}
+			}
+
+			a := r.AudioStream()
+			switch {
+			case tt.audio == nil && a != nil:
+				t.Errorf("got audio stream %d, want none", a.Index)
+			case tt.audio != nil && a == nil:
+				t.Error("got no audio stream")
+			case tt.audio != nil:
+				if a.CodecName != tt.audio.codec || a.SampleRate != tt.audio.sampleRate || a.Channels != tt.audio.channels {
+					t.Errorf("got %s audio at %d Hz with %d channels, want %s at %d Hz with %d", a.CodecName, a.SampleRate, a.Channels, tt.audio.codec, tt.audio.sampleRate, tt.audio.channels)
+				}
+				// Audio streams report "0/0" frame rates
+				if !a.AvgFrameRate.IsZero() || a.AvgFrameRate.Float() != 0 {
+					t.Errorf("got audio frame rate %s, want zero", a.AvgFrameRate)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRational(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    probe.Rational
+		wantErr bool
+	}{
+		{s: "30000/1001", want: probe.Rational{Num: 30000, Den: 1001}},
+		{s: "9:16", want: probe.Rational{Num: 9, Den: 16}},
+		{s: "0/0"},
+		{s: "1/0"},
+		{s: "N/A"},
+		{s: ""},
+		{s: "30", wantErr: true},
+		{s: "a/b", wantErr: true},
+		{s: "1/b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := probe.ParseRational(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRational(%q) error %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRational(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalNumbers(t *testing.T) {
+	var v struct {
+		Duration probe.Duration `json:"duration"`
+		BitRate  probe.Int      `json:"bit_rate"`
+		Size     probe.Int      `json:"size"`
+		Start    probe.Duration `json:"start_time"`
+	}
+
+	data := `{"duration": "N/A", "bit_rate": 128000, "size": null, "start_time": "0.023220"}`
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Duration != 0 || v.BitRate != 128000 || v.Size != 0 || v.Start.Duration() != 23220*time.Microsecond {
+		t.Errorf("got %+v", v)
+	}
+
+	for _, data := range []string{`{"duration": "NaN"}`, `{"duration": "soon"}`, `{"bit_rate": "1.5"}`} {
+		if err := json.Unmarshal([]byte(data), &v); err == nil {
+			t.Errorf("parsed %s", data)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+
+	fakeprobe.Use(t, "tiktok")
+	r, err := probe.Probe(ctx, "video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := r.VideoStream(); v == nil || v.Width != 1080 {
+		t.Errorf("got video stream %+v, want the tiktok fixture's", v)
+	}
+
+	fakeprobe.Fail(t, "video.mp4: Invalid data found when processing input")
+	_, err = probe.Probe(ctx, "video.mp4")
+	var probeErr *probe.Error
+	if !errors.As(err, &probeErr) {
+		t.Fatalf("got error %v, want a *probe.Error", err)
+	}
+	if probeErr.Message != "video.mp4: Invalid data found when processing input" {
+		t.Errorf("got message %q, want ffprobe's last log line", probeErr.Message)
+	}
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+)
+
+// The management API serves JSON on these routes:
+//
+//	GET    /users                 list tracked users
+//	POST   /users                 track a user, body {"username": "..."}
+//	DELETE /users/{username}      stop tracking a user
+//	POST   /users/{id}/sync       run a full update of a user
+//	GET    /users/{id}/awemes     list a user's awemes
+//	GET    /awemes/{id}/stats     get an aweme's statistics series and metrics
+//	GET    /awemes/removed        list awemes removed since ?since=, RFC 3339
+//	POST   /jobs                  queue a render job, body is a renderRequest
+//	GET    /jobs/{id}             get the status of a job
+
+type userResponse struct {
+	ID   string       `json:"id"`
+	User *tiktok.User `json:"user,omitempty"`
+}
+
+type addUserRequest struct {
+	Username string `json:"username"`
+}
+
+type renderRequest struct {
+	UserID          string `json:"user_id"`
+	AwemeID         string `json:"aweme_id"`
+	CommentUsername string `json:"comment_username"`
+	CommentText     string `json:"comment_text"`
+	ImagePath       string `json:"image_path"`
+}
+
+type jobResponse struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	UserID      string    `json:"user_id"`
+	AwemeID     string    `json:"aweme_id"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	Result      string    `json:"result,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+type statsSnapshot struct {
+	Time         time.Time `json:"time"`
+	PlayCount    int       `json:"play_count"`
+	DiggCount    int       `json:"digg_count"`
+	CommentCount int       `json:"comment_count"`
+	ShareCount   int       `json:"share_count"`
+}
+
+type statsResponse struct {
+	AwemeID        string          `json:"aweme_id"`
+	Series         []statsSnapshot `json:"series"`
+	ViewsPerHour24 float64         `json:"views_per_hour_24h"`
+	ViewsPerHour72 float64         `json:"views_per_hour_72h"`
+	LikesPerView   float64         `json:"likes_per_view"`
+}
+
+type tombstoneResponse struct {
+	AwemeID   string    `json:"aweme_id"`
+	UserID    string    `json:"user_id"`
+	Reason    string    `json:"reason"`
+	RemovedAt time.Time `json:"removed_at"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func newJobResponse(job *db.Job) *jobResponse {
+	return &jobResponse{
+		ID:          job.ID,
+		Kind:        string(job.Kind),
+		UserID:      job.UserID,
+		AwemeID:     job.AwemeID,
+		State:       job.State.String(),
+		Attempts:    job.Attempts,
+		LastError:   job.LastError,
+		Result:      job.Result,
+		CreatedAt:   job.CreatedAt,
+		UpdatedAt:   job.UpdatedAt,
+		NextAttempt: job.NextAttempt,
+	}
+}
+
+// errBadRequest marks errors caused by the request rather than the server.
+var errBadRequest = errors.New("bad request")
+
+// Handler returns the management API. The database must be open.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", s.handleUsers)
+	mux.HandleFunc("/users/", s.handleUser)
+	mux.HandleFunc("/awemes/", s.handleAweme)
+	mux.HandleFunc("/jobs", s.handleJobs)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	return mux
+}
+
+// ListenAndServe serves the management API on s.Addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    s.Addr,
+		Handler: s.Handler(),
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("serving management API on %s", s.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ids, err := s.DB.GetUserIDList()
+		if err != nil && err != db.ErrNotFound {
+			writeError(w, err)
+			return
+		}
+
+		users := make([]userResponse, 0, len(ids))
+		for _, id := range ids {
+			user, err := s.DB.GetUser(id)
+			if err != nil && err != db.ErrNotFound {
+				writeError(w, err)
+				return
+			}
+			users = append(users, userResponse{ID: id, User: user})
+		}
+
+		writeJSON(w, http.StatusOK, users)
+	case http.MethodPost:
+		var req addUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+			writeError(w, errBadRequest)
+			return
+		}
+
+		if err := s.AddUsername(r.Context(), req.Username); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, req)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, http.MethodDelete)
+			return
+		}
+
+		if err := s.RemoveUsername(r.Context(), parts[0]); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "sync":
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+
+		if err := s.FullUpdate(r.Context(), parts[0]); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		user, err := s.DB.GetUser(parts[0])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, userResponse{ID: parts[0], User: user})
+	case len(parts) == 2 && parts[1] == "awemes":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+
+		awemes, err := s.DB.GetAwemeList(parts[0])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, awemes)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleAweme(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/awemes/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "removed":
+		s.handleRemoved(w, r)
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "stats":
+		s.handleStats(w, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleRemoved(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: invalid since: %s", errBadRequest, err))
+			return
+		}
+	}
+
+	tombstones, err := s.DB.RemovedSince(since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res := make([]tombstoneResponse, 0, len(tombstones))
+	for _, t := range tombstones {
+		res = append(res, tombstoneResponse{
+			AwemeID:   t.AwemeID,
+			UserID:    t.UserID,
+			Reason:    string(t.Reason),
+			RemovedAt: time.Unix(t.RemovedAt, 0).UTC(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, awemeID string) {
+
+	a, err := s.DB.GetAweme(awemeID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	series, err := s.DB.GetStatsSeries(a.AwemeID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	metrics := db.ComputeMetrics(a.CreateTime, series)
+	res := statsResponse{
+		AwemeID:        a.AwemeID,
+		Series:         make([]statsSnapshot, 0, len(series)),
+		ViewsPerHour24: metrics.ViewsPerHour24,
+		ViewsPerHour72: metrics.ViewsPerHour72,
+		LikesPerView:   metrics.LikesPerView,
+	}
+	for _, snapshot := range series {
+		res.Series = append(res.Series, statsSnapshot{
+			Time:         time.Unix(snapshot.Time, 0).UTC(),
+			PlayCount:    snapshot.PlayCount,
+			DiggCount:    snapshot.DiggCount,
+			CommentCount: snapshot.CommentCount,
+			ShareCount:   snapshot.ShareCount,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req renderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" || req.AwemeID == "" {
+		writeError(w, errBadRequest)
+		return
+	}
+
+	a, err := s.DB.GetAweme(req.AwemeID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := s.EnqueueRender(req.UserID, a, req.CommentUsername, req.CommentText, req.ImagePath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, newJobResponse(job))
+}
+
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	job, err := s.DB.GetJob(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newJobResponse(job))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case err == db.ErrNotFound, errors.Is(err, apierror.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errBadRequest):
+		status = http.StatusBadRequest
+	}
+
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/faketiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/scraperapi"
+	"go.uber.org/ratelimit"
+)
+
+const (
+	fakeUsername = "fakeuser"
+	fakeUserID   = "6800000000000000001"
+)
+
+// newTestServer returns a server with a bolt database in a temporary
+// directory, talking to a fake of the TikTok APIs. Comments and results are
+// kept in memory.
+func newTestServer(t *testing.T) (*Server, *faketiktok.Server) {
+	t.Helper()
+
+	fake := faketiktok.New(faketiktok.Fixtures())
+	t.Cleanup(fake.Close)
+
+	dir := t.TempDir()
+	s := New(filepath.Join(dir, "db"), filepath.Join(dir, "out"), "fetcher-key", "scraper-key")
+	s.DB.BackendName = "bolt"
+	s.CommentStorage = storer.NewMemStorer()
+	s.ResultStorage = storer.NewMemStorer()
+
+	scraper := s.Provider.(*scraperapi.Scraper)
+	scraper.RateLimit = ratelimit.NewUnlimited()
+	s.Fetcher.RateLimit = ratelimit.NewUnlimited()
+	if err := fake.Configure(scraper, s.Fetcher); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DB.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.DB.Close)
+
+	return s, fake
+}
+
+// request sends a request to the API and decodes the JSON response into v,
+// unless v is nil. It fails the test if the status is not the expected one.
+func request(t *testing.T, h http.Handler, method, path string, body interface{}, status int, v interface{}) {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reqBody.WriteString(b)
+	default:
+		if err := json.NewEncoder(&reqBody).Encode(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, &reqBody))
+
+	if rec.Code != status {
+		t.Fatalf("%s %s: got status %d, want %d: %s", method, path, rec.Code, status, rec.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: invalid response %q: %s", method, path, rec.Body, err)
+		}
+	}
+}
+
+func TestAPIUsers(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	var users []userResponse
+	request(t, h, "GET", "/users", nil, http.StatusOK, &users)
+	if len(users) != 0 {
+		t.Fatalf("got %d users, want none", len(users))
+	}
+
+	request(t, h, "POST", "/users", addUserRequest{Username: fakeUsername}, http.StatusCreated, nil)
+
+	request(t, h, "GET", "/users", nil, http.StatusOK, &users)
+	if len(users) != 1 || users[0].ID != fakeUserID {
+		t.Fatalf("got users %+v, want %s", users, fakeUserID)
+	}
+
+	// Adding a user again keeps one entry
+	request(t, h, "POST", "/users", addUserRequest{Username: fakeUsername}, http.StatusCreated, nil)
+	request(t, h, "GET", "/users", nil, http.StatusOK, &users)
+	if len(users) != 1 {
+		t.Fatalf("got %d users after adding twice, want 1", len(users))
+	}
+
+	request(t, h, "DELETE", "/users/"+fakeUsername, nil, http.StatusNoContent, nil)
+	request(t, h, "GET", "/users", nil, http.StatusOK, &users)
+	if len(users) != 0 {
+		t.Fatalf("got %d users after removing, want none", len(users))
+	}
+}
+
+func TestAPIUsersErrors(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	request(t, h, "POST", "/users", "not json", http.StatusBadRequest, nil)
+	request(t, h, "POST", "/users", addUserRequest{}, http.StatusBadRequest, nil)
+	request(t, h, "POST", "/users", addUserRequest{Username: "nosuchuser"}, http.StatusNotFound, nil)
+	request(t, h, "DELETE", "/users/nosuchuser", nil, http.StatusNotFound, nil)
+	request(t, h, "PUT", "/users", nil, http.StatusMethodNotAllowed, nil)
+	request(t, h, "GET", "/users/"+fakeUsername, nil, http.StatusMethodNotAllowed, nil)
+	request(t, h, "GET", "/users/"+fakeUserID+"/sync", nil, http.StatusMethodNotAllowed, nil)
+	request(t, h, "GET", "/users/"+fakeUserID+"/unknown", nil, http.StatusNotFound, nil)
+}
+
+func TestAPISyncAndAwemes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	request(t, h, "GET", "/users/"+fakeUserID+"/awemes", nil, http.StatusNotFound, nil)
+
+	var user userResponse
+	request(t, h, "POST", "/users/"+fakeUserID+"/sync", nil, http.StatusOK, &user)
+	if user.ID != fakeUserID || user.User == nil || user.User.UniqueID != fakeUsername {
+		t.Fatalf("got user %+v, want @%s", user, fakeUsername)
+	}
+
+	var awemes []tiktok.Aweme
+	request(t, h, "GET", "/users/"+fakeUserID+"/awemes", nil, http.StatusOK, &awemes)
+	if len(awemes) != 5 {
+		t.Fatalf("got %d awemes, want 5", len(awemes))
+	}
+
+	var stats statsResponse
+	request(t, h, "GET", "/awemes/"+awemes[0].AwemeID+"/stats", nil, http.StatusOK, &stats)
+	if stats.AwemeID != awemes[0].AwemeID || len(stats.Series) != 1 {
+		t.Fatalf("got stats %+v, want one snapshot of %s", stats, awemes[0].AwemeID)
+	}
+
+	var removed []tombstoneResponse
+	request(t, h, "GET", "/awemes/removed", nil, http.StatusOK, &removed)
+	if len(removed) != 0 {
+		t.Fatalf("got %d removed awemes, want none", len(removed))
+	}
+
+	request(t, h, "POST", "/users/nosuchid/sync", nil, http.StatusNotFound, nil)
+	request(t, h, "GET", "/awemes/nosuchid/stats", nil, http.StatusNotFound, nil)
+	request(t, h, "GET", "/awemes/removed?since=yesterday", nil, http.StatusBadRequest, nil)
+	request(t, h, "POST", "/awemes/removed", nil, http.StatusMethodNotAllowed, nil)
+	request(t, h, "GET", "/awemes/"+awemes[0].AwemeID, nil, http.StatusNotFound, nil)
+}
+
+func TestAPIJobs(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	request(t, h, "POST", "/users/"+fakeUserID+"/sync", nil, http.StatusOK, nil)
+
+	awemeID := "7220000000000000005"
+	var job jobResponse
+	request(t, h, "POST", "/jobs", renderRequest{
+		UserID:          fakeUserID,
+		AwemeID:         awemeID,
+		CommentUsername: "someone",
+		CommentText:     "first",
+	}, http.StatusAccepted, &job)
+	if job.ID == "" || job.Kind != string(db.JobRender) || job.AwemeID != awemeID || job.State != db.JobPending.String() {
+		t.Fatalf("got job %+v, want a pending render of %s", job, awemeID)
+	}
+
+	var status jobResponse
+	request(t, h, "GET", "/jobs/"+job.ID, nil, http.StatusOK, &status)
+	if status.ID != job.ID || status.State != db.JobPending.String() {
+		t.Fatalf("got job %+v, want pending %s", status, job.ID)
+	}
+
+	request(t, h, "POST", "/jobs", "{", http.StatusBadRequest, nil)
+	request(t, h, "POST", "/jobs", renderRequest{UserID: fakeUserID}, http.StatusBadRequest, nil)
+	request(t, h, "POST", "/jobs", renderRequest{UserID: fakeUserID, AwemeID: "nosuchid"}, http.StatusNotFound, nil)
+	request(t, h, "GET", "/jobs", nil, http.StatusMethodNotAllowed, nil)
+	request(t, h, "GET", "/jobs/nosuchid", nil, http.StatusNotFound, nil)
+	request(t, h, "GET", "/jobs/", nil, http.StatusNotFound, nil)
+	request(t, h, "DELETE", "/jobs/"+job.ID, nil, http.StatusMethodNotAllowed, nil)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultBackupKeep is how many scheduled backups are kept if BackupKeep is 0.
+const DefaultBackupKeep = 7
+
+const backupPattern = "tiktok-*.snap"
+
+// RunBackups writes a database snapshot to BackupDir every BackupInterval
+// until ctx is done, keeping the newest BackupKeep snapshots.
+func (s *Server) RunBackups(ctx context.Context) error {
+	if err := os.MkdirAll(s.BackupDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(s.BackupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		path, err := s.BackupOnce()
+		if err != nil {
+			// A failed backup is retried on the next tick
+			log.Printf("backup failed: %s", err)
+			continue
+		}
+		log.Printf("backed up the database to %s", path)
+	}
+}
+
+// BackupOnce writes a database snapshot to BackupDir, removes the snapshots
+// past the retention and returns the path of the new snapshot.
+func (s *Server) BackupOnce() (string, error) {
+	name := "tiktok-" + time.Now().UTC().Format("20060102T150405Z") + ".snap"
+	path := filepath.Join(s.BackupDir, name)
+
+	if err := s.DB.BackupFile(path); err != nil {
+		return "", err
+	}
+
+	return path, s.pruneBackups()
+}
+
+func (s *Server) pruneBackups() error {
+	keep := s.BackupKeep
+	if keep <= 0 {
+		keep = DefaultBackupKeep
+	}
+
+	// The timestamps in the names sort in time order
+	paths, err := filepath.Glob(filepath.Join(s.BackupDir, backupPattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+)
+
+func TestRunBackups(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.BackupDir = filepath.Join(t.TempDir(), "backups")
+	s.BackupInterval = 10 * time.Millisecond
+	s.BackupKeep = 2
+
+	// Snapshots from an earlier run, older than any written now
+	if err := os.MkdirAll(s.BackupDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := []string{"tiktok-20230101T000000Z.snap", "tiktok-20230102T000000Z.snap", "tiktok-20230103T000000Z.snap"}
+	for _, name := range old {
+		if err := os.WriteFile(filepath.Join(s.BackupDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files that are not scheduled snapshots are left alone
+	other := filepath.Join(s.BackupDir, "manual.snap")
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.RunBackups(ctx) }()
+
+	// Wait until a new snapshot has pushed out all the old ones
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(s.BackupDir, old[len(old)-1])); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("old snapshots were not pruned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.BackupDir, backupPattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != s.BackupKeep {
+		t.Fatalf("kept snapshots %v, want %d", paths, s.BackupKeep)
+	}
+	for _, path := range paths {
+		if _, err := db.VerifySnapshot(path); err != nil {
+			t.Errorf("kept an invalid snapshot %s: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("pruned a file that is not a scheduled snapshot: %v", err)
+	}
+}
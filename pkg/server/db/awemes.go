@@ -0,0 +1,304 @@
+package db
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// Awemes are stored one record per aweme, keyed by AwemeID, with these
+// indexes pointing back at the ID:
+//
+//	aweme_by_author  {userID} 0x00 {create_time, 8 bytes big endian} {awemeID}
+//	aweme_by_hashtag {lowercased hashtag} 0x00 {awemeID}
+//	aweme_by_music   {music ID} 0x00 {awemeID}
+//
+// Databases written before the indexes existed keep one gob-encoded list per
+// user in legacyAwemeDb, which migrateAwemeLists moves.
+
+// awemeRecord is the stored form of an aweme. UserID is the tracked user the
+// aweme was synced for, which the author index is keyed by. LastSeen is when
+// the aweme was last stored from a feed, in Unix seconds.
+type awemeRecord struct {
+	UserID   string
+	Aweme    tiktok.Aweme
+	LastSeen int64
+}
+
+// Hashtags returns the lowercased hashtags of an aweme, from both its
+// challenge list and its description, without duplicates.
+func Hashtags(a *tiktok.Aweme) []string {
+	var tags []string
+	seen := make(map[string]bool)
+
+	add := func(tag string) {
+		tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+		if tag == "" || seen[tag] {
+			return
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	for _, cha := range a.ChaList {
+		add(cha.ChaName)
+	}
+	for _, extra := range a.TextExtra {
+		add(extra.HashtagName)
+	}
+
+	return tags
+}
+
+// prefixKey returns prefix followed by the 0x00 separator.
+func prefixKey(prefix string) []byte {
+	return append([]byte(prefix), 0)
+}
+
+// prefixEnd returns the first key after every key starting with prefixKey.
+func prefixEnd(prefix string) []byte {
+	return append([]byte(prefix), 1)
+}
+
+// timeKey returns the prefix key followed by t, 8 bytes big endian, so keys
+// with the same prefix sort by time.
+func timeKey(prefix string, t int64) []byte {
+	return binary.BigEndian.AppendUint64(prefixKey(prefix), uint64(t))
+}
+
+func musicPrefix(musicID int64) string {
+	return strconv.FormatInt(musicID, 10)
+}
+
+// indexKeys returns the keys of every index entry of a record.
+func (r *awemeRecord) indexKeys() map[string][][]byte {
+	id := r.Aweme.AwemeID
+	keys := map[string][][]byte{
+		awemeAuthorIdx: {append(timeKey(r.UserID, r.Aweme.CreateTime), id...)},
+	}
+
+	for _, tag := range Hashtags(&r.Aweme) {
+		keys[awemeHashtagIdx] = append(keys[awemeHashtagIdx], append(prefixKey(tag), id...))
+	}
+
+	if r.Aweme.Music.ID != 0 {
+		keys[awemeMusicIdx] = [][]byte{append(prefixKey(musicPrefix(r.Aweme.Music.ID)), id...)}
+	}
+
+	return keys
+}
+
+func decodeAwemeRecord(value []byte) (*awemeRecord, error) {
+	record := &awemeRecord{}
+	if err := decodeRecord(value, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func getAwemeRecord(txn Txn, awemeID string) (*awemeRecord, error) {
+	value, err := txn.Get(awemeDb, []byte(awemeID))
+	if err != nil {
+		return nil, err
+	}
+	return decodeAwemeRecord(value)
+}
+
+// putAweme stores an aweme seen at at and updates the indexes, removing the
+// entries of the copy it replaces. An aweme whose status restricts it is
+// tombstoned, and one that is available again loses its tombstone. It
+// returns the tombstone it adds, if any.
+func putAweme(txn WriteTxn, userID string, a *tiktok.Aweme, at int64) (*Tombstone, error) {
+	if err := putAwemeRecord(txn, userID, a, at); err != nil {
+		return nil, err
+	}
+
+	reason := restriction(a)
+	if reason == "" {
+		return nil, deleteTombstone(txn, a.AwemeID)
+	}
+
+	t := &Tombstone{AwemeID: a.AwemeID, UserID: userID, Reason: reason, RemovedAt: at}
+	added, err := putTombstone(txn, t)
+	if err != nil || !added {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// putAwemeRecord stores an aweme seen at and updates the indexes, removing
+// the entries of the copy it replaces. Its tombstone is left as it is.
+func putAwemeRecord(txn WriteTxn, userID string, a *tiktok.Aweme, at int64) error {
+	key := []byte(a.AwemeID)
+
+	if err := deleteAweme(txn, a.AwemeID); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	record := &awemeRecord{UserID: userID, Aweme: *a, LastSeen: at}
+
+	value, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Put(awemeDb, key, value); err != nil {
+		return err
+	}
+
+	for index, keys := range record.indexKeys() {
+		for _, k := range keys {
+			if err := txn.Put(index, k, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteAweme removes an aweme and its index entries. It returns
+// ErrNotFound if the aweme is not stored.
+func deleteAweme(txn WriteTxn, awemeID string) error {
+	value, err := txn.Get(awemeDb, []byte(awemeID))
+	if err != nil {
+		return err
+	}
+
+	old, err := decodeAwemeRecord(value)
+	if err != nil {
+		return err
+	}
+
+	for index, keys := range old.indexKeys() {
+		for _, k := range keys {
+			if err := txn.Delete(index, k); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+	}
+
+	return txn.Delete(awemeDb, []byte(awemeID))
+}
+
+// scanIndex returns the awemes an index points at in [start, end), in key
+// order.
+func (db *TikTokDB) scanIndex(index string, start, end []byte) ([]tiktok.Aweme, error) {
+	var awemes []tiktok.Aweme
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		return txn.Scan(index, start, end, func(_, id []byte) error {
+			record, err := getAwemeRecord(txn, string(id))
+			if err != nil {
+				return err
+			}
+			awemes = append(awemes, record.Aweme)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return awemes, nil
+}
+
+// GetAweme returns a single aweme by its ID.
+func (db *TikTokDB) GetAweme(awemeID string) (*tiktok.Aweme, error) {
+	var aweme *tiktok.Aweme
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		record, err := getAwemeRecord(txn, awemeID)
+		if err != nil {
+			return err
+		}
+
+		aweme = &record.Aweme
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return aweme, nil
+}
+
+// GetAwemeList returns the user's awemes, newest first. It returns
+// ErrNotFound if none are stored.
+func (db *TikTokDB) GetAwemeList(userID string) ([]tiktok.Aweme, error) {
+	awemeList, err := db.scanIndex(awemeAuthorIdx, prefixKey(userID), prefixEnd(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(awemeList) == 0 {
+		return nil, ErrNotFound
+	}
+
+	for i, j := 0, len(awemeList)-1; i < j; i, j = i+1, j-1 {
+		awemeList[i], awemeList[j] = awemeList[j], awemeList[i]
+	}
+
+	return awemeList, nil
+}
+
+// PutAwemes stores the user's awemes as seen in the feed at at, replacing
+// stored copies with the same ID and leaving the user's other awemes alone.
+// It returns the tombstones of awemes it found newly deleted or restricted.
+func (db *TikTokDB) PutAwemes(at time.Time, userID string, awemes []tiktok.Aweme) ([]Tombstone, error) {
+	var added []Tombstone
+
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		for i := range awemes {
+			t, err := putAweme(txn, userID, &awemes[i], at.Unix())
+			if err != nil {
+				return err
+			}
+			if t != nil {
+				added = append(added, *t)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// AwemesByAuthor returns the user's awemes created in [from, to), oldest
+// first.
+func (db *TikTokDB) AwemesByAuthor(userID string, from, to int64) ([]tiktok.Aweme, error) {
+	return db.scanIndex(awemeAuthorIdx, timeKey(userID, from), timeKey(userID, to))
+}
+
+// AwemesByHashtag returns the awemes tagged with hashtag, in any case and
+// with or without the leading '#', ordered by ID.
+func (db *TikTokDB) AwemesByHashtag(hashtag string) ([]tiktok.Aweme, error) {
+	tag := strings.ToLower(strings.TrimPrefix(hashtag, "#"))
+	return db.scanIndex(awemeHashtagIdx, prefixKey(tag), prefixEnd(tag))
+}
+
+// AwemesByMusic returns the awemes using the music, ordered by ID.
+func (db *TikTokDB) AwemesByMusic(musicID int64) ([]tiktok.Aweme, error) {
+	prefix := musicPrefix(musicID)
+	return db.scanIndex(awemeMusicIdx, prefixKey(prefix), prefixEnd(prefix))
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNotFound is returned when a key or record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Backend is a transactional key-value store with named buckets of keys
+// kept in byte order. TikTokDB stores everything through it.
+type Backend interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(txn Txn) error) error
+	// Update runs fn in a read-write transaction, which is committed if fn
+	// returns nil and rolled back otherwise.
+	Update(fn func(txn WriteTxn) error) error
+	Close() error
+}
+
+// Txn reads from a backend. Slices it returns are only valid until the
+// transaction ends.
+type Txn interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(bucket string, key []byte) ([]byte, error)
+	// Scan calls fn with every key and value in [start, end), in key order,
+	// until fn returns an error. A nil start scans from the first key and a
+	// nil end to the last. The slices are only valid until fn returns.
+	Scan(bucket string, start, end []byte, fn func(key, value []byte) error) error
+}
+
+// WriteTxn reads from and writes to a backend. Buckets must not be changed
+// while they are scanned.
+type WriteTxn interface {
+	Txn
+	// CreateBucket creates a bucket unless it exists.
+	CreateBucket(bucket string) error
+	Put(bucket string, key, value []byte) error
+	// Delete removes key, if it exists.
+	Delete(bucket string, key []byte) error
+}
+
+// backends are the backends compiled in, by name.
+var backends = map[string]func(path string) (Backend, error){
+	"bolt": openBolt,
+}
+
+// Backends returns the names of the backends compiled in.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultBackend is LMDB when it is compiled in, which needs cgo, and bolt
+// otherwise.
+func DefaultBackend() string {
+	if _, ok := backends["lmdb"]; ok {
+		return "lmdb"
+	}
+	return "bolt"
+}
+
+// OpenBackend opens the named backend at path, creating it if needed.
+func OpenBackend(name, path string) (Backend, error) {
+	open, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database backend %q, available are %v", name, Backends())
+	}
+	return open(path)
+}
+
+// errStop stops a scan early.
+var errStop = errors.New("stop scan")
+
+// first returns a copy of the first key and value of a bucket at or after
+// start, or ErrNotFound.
+func first(txn Txn, bucket string, start []byte) ([]byte, []byte, error) {
+	var key, value []byte
+	err := txn.Scan(bucket, start, nil, func(k, v []byte) error {
+		key = append([]byte(nil), k...)
+		value = append([]byte(nil), v...)
+		return errStop
+	})
+	if err == errStop {
+		return key, value, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, ErrNotFound
+}
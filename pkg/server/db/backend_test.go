@@ -0,0 +1,63 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db/dbtest"
+)
+
+// testBackend runs the conformance suite on the named backend, then checks
+// that what it commits survives reopening.
+func testBackend(t *testing.T, name string) {
+	dbtest.Run(t, func(t *testing.T) db.Backend {
+		b, err := db.OpenBackend(name, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		return b
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		path := t.TempDir()
+
+		b, err := db.OpenBackend(name, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.Update(func(txn db.WriteTxn) error {
+			if err := txn.CreateBucket("reopen"); err != nil {
+				return err
+			}
+			return txn.Put("reopen", []byte("key"), []byte("value"))
+		})
+		b.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err = db.OpenBackend(name, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		var value string
+		err = b.View(func(txn db.Txn) error {
+			v, err := txn.Get("reopen", []byte("key"))
+			value = string(v)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value" {
+			t.Errorf("got %q after reopening, want %q", value, "value")
+		}
+	})
+}
+
+func TestBoltBackend(t *testing.T) {
+	testBackend(t, "bolt")
+}
@@ -0,0 +1,354 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// A snapshot is a logical copy of every sub-database, taken in one read
+// transaction so it is consistent while the server keeps writing. Only live
+// entries are copied, so it is as compact as the data. The format is:
+//
+//	magic           "TVPSNAP1"
+//	schema version  uvarint
+//	per database    name length uvarint, name,
+//	                then per entry key length uvarint, key, value length
+//	                uvarint, value, ended by a key length of 0
+//	end             a name length of 0
+//	checksum        SHA-256 of everything before it
+//
+// Keys cannot be empty, so the zero lengths are unambiguous.
+
+var snapshotMagic = []byte("TVPSNAP1")
+
+// ErrInvalidSnapshot is returned for snapshots that are truncated, corrupt
+// or not snapshots at all.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Backup writes a snapshot of the database to w.
+func (db *TikTokDB) Backup(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	h := sha256.New()
+	out := io.MultiWriter(bw, h)
+
+	writeBytes := func(b []byte) error {
+		if _, err := out.Write(binary.AppendUvarint(nil, uint64(len(b)))); err != nil {
+			return err
+		}
+		_, err := out.Write(b)
+		return err
+	}
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		version, err := getSchemaVersion(txn)
+		if err != nil {
+			return err
+		}
+
+		if _, err := out.Write(snapshotMagic); err != nil {
+			return err
+		}
+		if _, err := out.Write(binary.AppendUvarint(nil, uint64(version))); err != nil {
+			return err
+		}
+
+		for _, name := range databases {
+			if err := writeBytes([]byte(name)); err != nil {
+				return err
+			}
+
+			err := txn.Scan(name, nil, nil, func(key, value []byte) error {
+				if err := writeBytes(key); err != nil {
+					return err
+				}
+				return writeBytes(value)
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := writeBytes(nil); err != nil {
+				return err
+			}
+		}
+
+		return writeBytes(nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// BackupFile writes a snapshot of the database to path. The file only
+// appears once the snapshot is complete.
+func (db *TikTokDB) BackupFile(path string) error {
+	tmpPath := path + ".tmp"
+
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := db.Backup(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// snapshotReader reads the body of a snapshot file, without the checksum,
+// and hashes what it reads.
+type snapshotReader struct {
+	f    *os.File
+	r    *bufio.Reader
+	h    hash.Hash
+	size int64
+}
+
+func openSnapshot(path string) (*snapshotReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := info.Size() - sha256.Size
+	if size < int64(len(snapshotMagic)) {
+		f.Close()
+		return nil, fmt.Errorf("%w: too short", ErrInvalidSnapshot)
+	}
+
+	h := sha256.New()
+	return &snapshotReader{
+		f:    f,
+		r:    bufio.NewReader(io.TeeReader(io.LimitReader(f, size), h)),
+		h:    h,
+		size: size,
+	}, nil
+}
+
+func (s *snapshotReader) Close() error {
+	return s.f.Close()
+}
+
+func (s *snapshotReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+
+	// A corrupt length must not allocate more than the file could hold
+	if n > uint64(s.size) {
+		return nil, fmt.Errorf("%w: length %d past the end", ErrInvalidSnapshot, n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+	return b, nil
+}
+
+// checksum reads the rest of the body and compares its checksum with the one
+// the file ends with.
+func (s *snapshotReader) checksum() error {
+	if _, err := io.Copy(io.Discard, s.r); err != nil {
+		return err
+	}
+
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(s.f, sum); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, s.h.Sum(nil)) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	return nil
+}
+
+// readHeader reads the magic and returns the schema version.
+func (s *snapshotReader) readHeader() (int, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(s.r, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return 0, fmt.Errorf("%w: not a snapshot", ErrInvalidSnapshot)
+	}
+
+	version, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSnapshot, err)
+	}
+
+	return int(version), nil
+}
+
+// VerifySnapshot checks the checksum of a snapshot file and that its schema
+// version is supported, and returns the version.
+func VerifySnapshot(path string) (int, error) {
+	s, err := openSnapshot(path)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	version, err := s.readHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.checksum(); err != nil {
+		return 0, err
+	}
+
+	if version > SchemaVersion() {
+		return 0, fmt.Errorf("snapshot schema version %d is newer than the supported version %d", version, SchemaVersion())
+	}
+
+	return version, nil
+}
+
+// loadSnapshot puts every entry of a snapshot file into the databases. It
+// fails if the checksum does not match, after putting the entries, so the
+// caller must roll back txn on error.
+func loadSnapshot(txn WriteTxn, path string) error {
+	s, err := openSnapshot(path)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if _, err := s.readHeader(); err != nil {
+		return err
+	}
+
+	known := make(map[string]bool, len(databases))
+	for _, name := range databases {
+		known[name] = true
+	}
+
+	for {
+		name, err := s.readBytes()
+		if err != nil {
+			return err
+		}
+		if len(name) == 0 {
+			return s.checksum()
+		}
+		if !known[string(name)] {
+			return fmt.Errorf("%w: unknown database %q", ErrInvalidSnapshot, name)
+		}
+
+		for {
+			key, err := s.readBytes()
+			if err != nil {
+				return err
+			}
+			if len(key) == 0 {
+				break
+			}
+
+			value, err := s.readBytes()
+			if err != nil {
+				return err
+			}
+
+			if err := txn.Put(string(name), key, value); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Restore replaces the database at path with a snapshot file, stored in the
+// named backend. The snapshot is verified and loaded into a new database next
+// to path, and migrated if it is older, before it is swapped in. The replaced
+// database is kept at path + ".pre-restore". The database must not be open.
+// Snapshots do not depend on the backend, so restoring into another backend
+// converts a database. An empty backend keeps the backend of the database at
+// path, or is DefaultBackend if there is none.
+func Restore(snapshotPath, path, backend string) error {
+	if _, err := VerifySnapshot(snapshotPath); err != nil {
+		return err
+	}
+
+	if backend == "" {
+		backend = detectBackend(path)
+	}
+	if backend == "" {
+		backend = DefaultBackend()
+	}
+
+	restorePath := path + ".restore"
+	if err := os.RemoveAll(restorePath); err != nil {
+		return err
+	}
+
+	restored, err := OpenBackend(backend, restorePath)
+	if err != nil {
+		return err
+	}
+
+	err = restored.Update(func(txn WriteTxn) error {
+		if err := createDatabases(txn); err != nil {
+			return err
+		}
+
+		if err := loadSnapshot(txn, snapshotPath); err != nil {
+			return err
+		}
+
+		return migrate(txn)
+	})
+	restored.Close()
+	if err != nil {
+		os.RemoveAll(restorePath)
+		return err
+	}
+
+	oldPath := path + ".pre-restore"
+	if err := os.RemoveAll(oldPath); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, oldPath); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Rename(restorePath, path)
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// writeTestSnapshot fills a new database and writes a snapshot of it.
+func writeTestSnapshot(t *testing.T) (*TikTokDB, string) {
+	t.Helper()
+
+	db := openTestDB(t)
+	if err := db.SetUserIDList([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetUser("1", &tiktok.User{UID: "1", UniqueID: "someone", FollowerCount: 10}); err != nil {
+		t.Fatal(err)
+	}
+	awemes := []tiktok.Aweme{
+		{AwemeID: "10", CreateTime: 1680000000, Desc: "#food"},
+		{AwemeID: "11", CreateTime: 1680000100, Music: tiktok.Music{ID: 7}},
+	}
+	awemes[0].TextExtra = []tiktok.TextExtra{{Start: 0, End: 5, HashtagName: "food", Type: 1}}
+	if _, err := db.PutAwemes(time.Unix(1681000000, 0), "1", awemes); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "db.snap")
+	if err := db.BackupFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was left behind: %v", err)
+	}
+
+	return db, path
+}
+
+func TestBackupRestore(t *testing.T) {
+	src, snapshot := writeTestSnapshot(t)
+
+	version, err := VerifySnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Errorf("got schema version %d, want %d", version, SchemaVersion())
+	}
+
+	path := filepath.Join(t.TempDir(), "db")
+	if err := Restore(snapshot, path, "bolt"); err != nil {
+		t.Fatal(err)
+	}
+	dst := New(path)
+	if err := dst.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Every entry of every database is carried over
+	for _, name := range databases {
+		want := dumpDatabase(t, src, name)
+		if got := dumpDatabase(t, dst, name); !reflect.DeepEqual(got, want) {
+			t.Errorf("restored %s holds %d entries, want the %d backed up", name, len(got), len(want))
+		}
+	}
+
+	user, err := dst.GetUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UniqueID != "someone" || user.FollowerCount != 10 {
+		t.Errorf("got user %+v", user)
+	}
+	tagged, err := dst.AwemesByHashtag("food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 1 || tagged[0].AwemeID != "10" {
+		t.Errorf("got %v tagged #food, want aweme 10", tagged)
+	}
+}
+
+// dumpDatabase returns every entry of the named database.
+func dumpDatabase(t *testing.T, db *TikTokDB, name string) map[string]string {
+	t.Helper()
+
+	entries := make(map[string]string)
+	err := db.Backend.View(func(txn Txn) error {
+		return txn.Scan(name, nil, nil, func(key, value []byte) error {
+			entries[string(key)] = string(value)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	_, snapshot := writeTestSnapshot(t)
+
+	data, err := os.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0x01
+	if err := os.WriteFile(snapshot, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VerifySnapshot(snapshot); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("verified a snapshot with a flipped byte: %v", err)
+	}
+
+	// Loading checks the checksum too, and leaves nothing behind
+	db := openTestDB(t)
+	err = db.Backend.Update(func(txn WriteTxn) error {
+		return loadSnapshot(txn, snapshot)
+	})
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loaded a snapshot with a flipped byte: %v", err)
+	}
+	if ids, err := db.GetUserIDList(); err != ErrNotFound {
+		t.Errorf("got user IDs %v and error %v after the failed load, want none", ids, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "db")
+	if err := Restore(snapshot, path, "bolt"); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("restored a snapshot with a flipped byte: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("failed restore created the database: %v", err)
+	}
+}
+
+func TestSnapshotHugeLength(t *testing.T) {
+	// A database name claiming to be 1 EiB long, with a valid checksum
+	body := append([]byte(nil), snapshotMagic...)
+	body = binary.AppendUvarint(body, uint64(SchemaVersion()))
+	body = binary.AppendUvarint(body, 1<<60)
+	body = append(body, "users"...)
+	sum := sha256.Sum256(body)
+
+	snapshot := filepath.Join(t.TempDir(), "huge.snap")
+	if err := os.WriteFile(snapshot, append(body, sum[:]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t)
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		return loadSnapshot(txn, snapshot)
+	})
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("got error %v, want ErrInvalidSnapshot", err)
+	}
+}
+
+func TestVerifySnapshotNotASnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"short":     []byte("TVPSNAP1"),
+		"not-magic": bytes.Repeat([]byte{'x'}, 64),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifySnapshot(path); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("%s: got error %v, want ErrInvalidSnapshot", name, err)
+		}
+	}
+}
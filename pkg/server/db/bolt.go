@@ -0,0 +1,121 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltFile is the name of the bolt database in the database directory.
+const boltFile = "bolt.db"
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+// openBolt opens a bolt database in the directory path. It is pure Go, so
+// it is available in builds without cgo.
+func openBolt(path string) (Backend, error) {
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(filepath.Join(path, boltFile), 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) View(fn func(txn Txn) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx})
+	})
+}
+
+func (b *boltBackend) Update(fn func(txn WriteTxn) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTxn{tx})
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+type boltTxn struct {
+	tx *bolt.Tx
+}
+
+func (t boltTxn) bucket(name string) (*bolt.Bucket, error) {
+	b := t.tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, fmt.Errorf("bucket %q does not exist", name)
+	}
+	return b, nil
+}
+
+func (t boltTxn) Get(bucket string, key []byte) ([]byte, error) {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	value := b.Get(key)
+	if value == nil {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (t boltTxn) Scan(bucket string, start, end []byte, fn func(key, value []byte) error) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+
+	c := b.Cursor()
+
+	var key, value []byte
+	if len(start) == 0 {
+		key, value = c.First()
+	} else {
+		key, value = c.Seek(start)
+	}
+	for ; key != nil; key, value = c.Next() {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return nil
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t boltTxn) CreateBucket(bucket string) error {
+	_, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	return err
+}
+
+func (t boltTxn) Put(bucket string, key, value []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (t boltTxn) Delete(bucket string, key []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
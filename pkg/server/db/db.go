@@ -1,109 +1,170 @@
 package db
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 
-	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/scraperapi"
-	"github.com/rs/zerolog"
-	lmdb "wellquite.org/golmdb"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
 )
 
 const (
-	userIdsDb = "user_ids"
-	usersDb   = "users"
-	awemeDb   = "awemes"
+	metaDb           = "meta"
+	userIdsDb        = "user_ids"
+	usersDb          = "users"
+	legacyAwemeDb    = "awemes"
+	awemeDb          = "aweme_records"
+	awemeAuthorIdx   = "aweme_by_author"
+	awemeHashtagIdx  = "aweme_by_hashtag"
+	awemeMusicIdx    = "aweme_by_music"
+	statsDb          = "aweme_stats"
+	tombstoneDb      = "tombstones"
+	tombstoneTimeIdx = "tombstone_by_time"
+	userHistoryDb    = "user_history"
+	syncDb           = "sync_state"
+	jobsDb           = "jobs"
+	jobQueue         = "job_queue"
 )
 
-const (
-	numDBs = uint(3)
-)
+// databases are all the sub-databases, in the order backups hold them.
+var databases = []string{
+	metaDb,
+	userIdsDb,
+	usersDb,
+	legacyAwemeDb,
+	awemeDb,
+	awemeAuthorIdx,
+	awemeHashtagIdx,
+	awemeMusicIdx,
+	statsDb,
+	tombstoneDb,
+	tombstoneTimeIdx,
+	userHistoryDb,
+	syncDb,
+	jobsDb,
+	jobQueue,
+}
+
+// SyncState tracks how far a user's feed has been synced. HighWaterMark is
+// the create time of the newest non-pinned aweme seen so far. FullSyncCursor
+// is the feed cursor an interrupted full sync resumes from, or 0, and
+// FullSyncStart when that full sync started. LastFullSync is when the last
+// full sync completed.
+type SyncState struct {
+	HighWaterMark  int64
+	NewestAwemeID  string
+	LastSync       int64
+	FullSyncCursor int64
+	FullSyncStart  int64
+	LastFullSync   int64
+}
 
 type TikTokDB struct {
-	Lmdb *lmdb.LMDBClient
-	wg   sync.WaitGroup
-	path string
+	Backend Backend
+	// BackendName is the backend Open uses. If empty, it is the backend of
+	// the existing database at path, or DefaultBackend for a new one.
+	BackendName string
+	wg          sync.WaitGroup
+	path        string
 }
 
 func New(path string) *TikTokDB {
 	db := &TikTokDB{
-		Lmdb: nil,
-		wg:   sync.WaitGroup{},
-		path: path,
+		Backend: nil,
+		wg:      sync.WaitGroup{},
+		path:    path,
 	}
 	return db
 }
 
+// Open opens the database at path, creating and migrating the sub-databases
+// as needed. If Backend is already set, it is used instead.
 func (db *TikTokDB) Open() error {
-	logger := zerolog.Nop()
-	mode := os.FileMode(0644)
-	numReaders := uint(8)
+	if db.Backend == nil {
+		if err := db.openBackend(); err != nil {
+			return err
+		}
+	}
 
-	// check if directory exists, if not create it
-	if _, err := os.Stat(db.path); os.IsNotExist(err) {
-		err = os.MkdirAll(db.path, os.ModePerm)
-		if err != nil {
+	return db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		if err := createDatabases(txn); err != nil {
 			return err
 		}
+
+		return migrate(txn)
+	})
+}
+
+func (db *TikTokDB) openBackend() error {
+	existing := detectBackend(db.path)
+	if db.BackendName == "" {
+		db.BackendName = existing
+	}
+	if db.BackendName == "" {
+		db.BackendName = DefaultBackend()
+	}
+	if existing != "" && existing != db.BackendName {
+		return fmt.Errorf("database at %s uses the %s backend, not %s", db.path, existing, db.BackendName)
 	}
 
-	client, err := lmdb.NewLMDB(logger, db.path, mode, numReaders, numDBs, lmdb.EnvironmentFlag(0), 1)
+	backend, err := OpenBackend(db.BackendName, db.path)
 	if err != nil {
 		return err
 	}
-	db.Lmdb = client
+	db.Backend = backend
 
-	return db.Lmdb.Update(func(txn *lmdb.ReadWriteTxn) error {
-		db.wg.Add(1)
-		defer db.wg.Done()
+	return nil
+}
 
-		_, err := txn.DBRef(userIdsDb, lmdb.DatabaseFlag(0x40000))
-		if err != nil {
-			return err
-		}
+// lmdbFile is the name of the LMDB data file. It is known without cgo, to
+// tell LMDB databases apart.
+const lmdbFile = "data.mdb"
 
-		_, err = txn.DBRef(usersDb, lmdb.DatabaseFlag(0x40000))
-		if err != nil {
-			return err
-		}
+// detectBackend returns the backend of the database at path, or "" if there
+// is none.
+func detectBackend(path string) string {
+	if _, err := os.Stat(filepath.Join(path, lmdbFile)); err == nil {
+		return "lmdb"
+	}
+	if _, err := os.Stat(filepath.Join(path, boltFile)); err == nil {
+		return "bolt"
+	}
+	return ""
+}
 
-		_, err = txn.DBRef(awemeDb, lmdb.DatabaseFlag(0x40000))
-		if err != nil {
+// createDatabases creates any of the sub-databases that do not exist yet.
+func createDatabases(txn WriteTxn) error {
+	for _, name := range databases {
+		if err := txn.CreateBucket(name); err != nil {
 			return err
 		}
-
-		return nil
-	})
+	}
+	return nil
 }
 
 func (db *TikTokDB) Close() {
 	db.wg.Wait()
-	db.Lmdb.TerminateSync()
+	db.Backend.Close()
 }
 
-func (db *TikTokDB) GetUser(userID string) (*scraperapi.User, error) {
-	var user *scraperapi.User
+func (db *TikTokDB) GetUser(userID string) (*tiktok.User, error) {
+	var user *tiktok.User
 
-	err := db.Lmdb.View(func(txn *lmdb.ReadOnlyTxn) error {
+	err := db.Backend.View(func(txn Txn) error {
 		db.wg.Add(1)
 		defer db.wg.Done()
 
-		dbRef, err := txn.DBRef(usersDb, lmdb.DatabaseFlag(0))
+		value, err := txn.Get(usersDb, []byte(userID))
 		if err != nil {
 			return err
 		}
 
-		value, err := txn.Get(dbRef, []byte(userID))
-		if err != nil {
-			return err
-		}
-
-		decoder := gob.NewDecoder(bytes.NewReader(value))
-		user = &scraperapi.User{}
-		err = decoder.Decode(user)
-		return err
+		user = &tiktok.User{}
+		return decodeRecord(value, user)
 	})
 
 	if err != nil {
@@ -113,129 +174,95 @@ func (db *TikTokDB) GetUser(userID string) (*scraperapi.User, error) {
 	return user, nil
 }
 
-func (db *TikTokDB) SetUser(userID string, user *scraperapi.User) error {
-	return db.Lmdb.Update(func(txn *lmdb.ReadWriteTxn) error {
+func (db *TikTokDB) SetUser(userID string, user *tiktok.User) error {
+	return db.Backend.Update(func(txn WriteTxn) error {
 		db.wg.Add(1)
 		defer db.wg.Done()
 
-		dbRef, err := txn.DBRef(usersDb, lmdb.DatabaseFlag(0))
-		if err != nil {
-			return err
-		}
-
 		key := []byte(userID)
 
-		var buf bytes.Buffer
-		encoder := gob.NewEncoder(&buf)
-		err = encoder.Encode(user)
+		value, err := encodeRecord(user)
 		if err != nil {
 			return err
 		}
 
-		return txn.Put(dbRef, key, buf.Bytes(), lmdb.PutFlag(0))
+		return txn.Put(usersDb, key, value)
 	})
 }
 
-func (db *TikTokDB) GetAwemeList(userID string) ([]scraperapi.Aweme, error) {
-	var awemeList []scraperapi.Aweme
+func (db *TikTokDB) GetUserIDList() ([]string, error) {
+	var userIDList []string
 
-	err := db.Lmdb.View(func(txn *lmdb.ReadOnlyTxn) error {
+	err := db.Backend.View(func(txn Txn) error {
 		db.wg.Add(1)
 		defer db.wg.Done()
 
-		dbRef, err := txn.DBRef(awemeDb, lmdb.DatabaseFlag(0))
-		if err != nil {
-			return err
-		}
-
-		value, err := txn.Get(dbRef, []byte(userID))
+		value, err := txn.Get(userIdsDb, []byte(userIdsDb))
 		if err != nil {
 			return err
 		}
 
-		decoder := gob.NewDecoder(bytes.NewReader(value))
-		err = decoder.Decode(&awemeList)
-		return err
+		return decodeRecord(value, &userIDList)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return awemeList, nil
+	return userIDList, nil
 }
 
-func (db *TikTokDB) SetAwemeList(userID string, awemeList []scraperapi.Aweme) error {
-	return db.Lmdb.Update(func(txn *lmdb.ReadWriteTxn) error {
+func (db *TikTokDB) SetUserIDList(userIDList []string) error {
+	return db.Backend.Update(func(txn WriteTxn) error {
 		db.wg.Add(1)
 		defer db.wg.Done()
 
-		dbRef, err := txn.DBRef(awemeDb, lmdb.DatabaseFlag(0))
-		if err != nil {
-			return err
-		}
-
-		key := []byte(userID)
+		key := []byte(userIdsDb)
 
-		var buf bytes.Buffer
-		encoder := gob.NewEncoder(&buf)
-		err = encoder.Encode(awemeList)
+		value, err := encodeRecord(userIDList)
 		if err != nil {
 			return err
 		}
 
-		return txn.Put(dbRef, key, buf.Bytes(), lmdb.PutFlag(0))
+		return txn.Put(userIdsDb, key, value)
 	})
 }
 
-func (db *TikTokDB) GetUserIDList() ([]string, error) {
-	var userIDList []string
+func (db *TikTokDB) GetSyncState(userID string) (*SyncState, error) {
+	var state *SyncState
 
-	err := db.Lmdb.View(func(txn *lmdb.ReadOnlyTxn) error {
+	err := db.Backend.View(func(txn Txn) error {
 		db.wg.Add(1)
 		defer db.wg.Done()
 
-		dbRef, err := txn.DBRef(userIdsDb, lmdb.DatabaseFlag(0))
-		if err != nil {
-			return err
-		}
-
-		value, err := txn.Get(dbRef, []byte(userIdsDb))
+		value, err := txn.Get(syncDb, []byte(userID))
 		if err != nil {
 			return err
 		}
 
-		decoder := gob.NewDecoder(bytes.NewReader(value))
-		err = decoder.Decode(&userIDList)
-		return err
+		state = &SyncState{}
+		return decodeRecord(value, state)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return userIDList, nil
+	return state, nil
 }
 
-func (db *TikTokDB) SetUserIDList(userIDList []string) error {
-	return db.Lmdb.Update(func(txn *lmdb.ReadWriteTxn) error {
+func (db *TikTokDB) SetSyncState(userID string, state *SyncState) error {
+	return db.Backend.Update(func(txn WriteTxn) error {
 		db.wg.Add(1)
 		defer db.wg.Done()
 
-		dbRef, err := txn.DBRef(userIdsDb, lmdb.DatabaseFlag(0))
-		if err != nil {
-			return err
-		}
-
-		key := []byte(userIdsDb)
+		key := []byte(userID)
 
-		var buf bytes.Buffer
-		encoder := gob.NewEncoder(&buf)
-		err = encoder.Encode(userIDList)
+		value, err := encodeRecord(state)
 		if err != nil {
 			return err
 		}
 
-		return txn.Put(dbRef, key, buf.Bytes(), lmdb.PutFlag(0))
+		return txn.Put(syncDb, key, value)
 	})
 }
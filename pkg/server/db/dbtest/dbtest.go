@@ -0,0 +1,440 @@
+// Package dbtest is a conformance suite for storage backends. Every backend
+// must pass it, so TikTokDB behaves the same whichever one it runs on.
+//
+// A backend is checked by calling Run from its tests, with a function that
+// opens a new, empty instance of it.
+package dbtest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+const (
+	bucketA = "dbtest_a"
+	bucketB = "dbtest_b"
+)
+
+var errRollback = errors.New("rollback")
+
+// Run checks that the backends newBackend returns behave as the db.Backend
+// interface describes, and that TikTokDB works on top of them. Each subtest
+// calls newBackend for a new, empty backend, which newBackend closes when the
+// subtest is done, for example with t.Cleanup.
+func Run(t *testing.T, newBackend func(t *testing.T) db.Backend) {
+	checks := []struct {
+		name  string
+		check func(*testing.T, db.Backend)
+	}{
+		{"CreateBuckets", testCreateBuckets},
+		{"GetPut", testGetPut},
+		{"Delete", testDelete},
+		{"Scan", testScan},
+		{"ScanStop", testScanStop},
+		{"Buckets", testBuckets},
+		{"Rollback", testRollback},
+		{"ReadOwnWrites", testReadOwnWrites},
+		{"TikTokDB", testTikTokDB},
+	}
+
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			c.check(t, newBackend(t))
+		})
+	}
+}
+
+func createBuckets(t *testing.T, b db.Backend) {
+	t.Helper()
+
+	err := b.Update(func(txn db.WriteTxn) error {
+		if err := txn.CreateBucket(bucketA); err != nil {
+			return err
+		}
+		return txn.CreateBucket(bucketB)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func put(t *testing.T, b db.Backend, bucket string, pairs ...string) {
+	t.Helper()
+
+	err := b.Update(func(txn db.WriteTxn) error {
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if err := txn.Put(bucket, []byte(pairs[i]), []byte(pairs[i+1])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns a copy of the value of key, or db.ErrNotFound.
+func get(b db.Backend, bucket, key string) (string, error) {
+	var value string
+	err := b.View(func(txn db.Txn) error {
+		v, err := txn.Get(bucket, []byte(key))
+		if err != nil {
+			return err
+		}
+		value = string(v)
+		return nil
+	})
+	return value, err
+}
+
+func expectValue(t *testing.T, b db.Backend, bucket, key, want string) {
+	t.Helper()
+
+	got, err := get(b, bucket, key)
+	if err != nil {
+		t.Fatalf("get %q: %v", key, err)
+	}
+	if got != want {
+		t.Errorf("get %q = %q, want %q", key, got, want)
+	}
+}
+
+func expectNotFound(t *testing.T, b db.Backend, bucket, key string) {
+	t.Helper()
+
+	got, err := get(b, bucket, key)
+	if err == nil {
+		t.Errorf("get %q = %q, want db.ErrNotFound", key, got)
+	} else if err != db.ErrNotFound {
+		t.Errorf("get %q: %v, want db.ErrNotFound", key, err)
+	}
+}
+
+// scan returns copies of the keys in [start, end).
+func scan(t *testing.T, b db.Backend, bucket string, start, end []byte) []string {
+	t.Helper()
+
+	var keys []string
+	err := b.View(func(txn db.Txn) error {
+		return txn.Scan(bucket, start, end, func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func equalKeys(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testCreateBuckets(t *testing.T, b db.Backend) {
+	// Creating existing buckets is not an error
+	createBuckets(t, b)
+	createBuckets(t, b)
+
+	put(t, b, bucketA, "key", "value")
+	createBuckets(t, b)
+	expectValue(t, b, bucketA, "key", "value")
+}
+
+func testGetPut(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+	expectNotFound(t, b, bucketA, "missing")
+
+	binaryKey := string([]byte{0x00, 0xff, 0x00})
+	put(t, b, bucketA, "key", "value", binaryKey, "binary")
+	expectValue(t, b, bucketA, "key", "value")
+	expectValue(t, b, bucketA, binaryKey, "binary")
+
+	put(t, b, bucketA, "key", "replaced")
+	expectValue(t, b, bucketA, "key", "replaced")
+}
+
+func testDelete(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+	put(t, b, bucketA, "doomed", "value")
+
+	err := b.Update(func(txn db.WriteTxn) error {
+		if err := txn.Delete(bucketA, []byte("doomed")); err != nil {
+			return err
+		}
+		// deleting a missing key is not an error
+		return txn.Delete(bucketA, []byte("doomed"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectNotFound(t, b, bucketA, "doomed")
+}
+
+func testScan(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+	// put out of order, with keys that are prefixes of each other
+	put(t, b, bucketB, "b", "2", "a", "1", "c\x00", "4", "c", "3", "d", "5")
+
+	ranges := []struct {
+		start, end []byte
+		want       []string
+	}{
+		{nil, nil, []string{"a", "b", "c", "c\x00", "d"}},
+		{[]byte("b"), nil, []string{"b", "c", "c\x00", "d"}},
+		{nil, []byte("c"), []string{"a", "b"}},
+		{[]byte("bb"), []byte("c\x01"), []string{"c", "c\x00"}},
+		{[]byte("c\x00"), []byte("c\x00"), nil},
+		{[]byte("e"), nil, nil},
+	}
+
+	for _, r := range ranges {
+		if keys := scan(t, b, bucketB, r.start, r.end); !equalKeys(keys, r.want) {
+			t.Errorf("[%q, %q): keys %q, want %q", r.start, r.end, keys, r.want)
+		}
+	}
+
+	err := b.View(func(txn db.Txn) error {
+		return txn.Scan(bucketB, []byte("c"), []byte("d"), func(key, value []byte) error {
+			want := map[string]string{"c": "3", "c\x00": "4"}[string(key)]
+			if string(value) != want {
+				t.Errorf("value of %q = %q, want %q", key, value, want)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testScanStop(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+	put(t, b, bucketB, "a", "1", "b", "2", "c", "3")
+
+	stop := errors.New("stop")
+
+	var keys []string
+	err := b.View(func(txn db.Txn) error {
+		return txn.Scan(bucketB, nil, nil, func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			if len(keys) == 2 {
+				return stop
+			}
+			return nil
+		})
+	})
+	if err != stop {
+		t.Errorf("scan returned %v, want the error of fn", err)
+	}
+
+	if want := []string{"a", "b"}; !equalKeys(keys, want) {
+		t.Errorf("keys %q, want %q", keys, want)
+	}
+}
+
+func testBuckets(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+	put(t, b, bucketA, "shared", "a")
+	put(t, b, bucketB, "shared", "b")
+
+	expectValue(t, b, bucketA, "shared", "a")
+	expectValue(t, b, bucketB, "shared", "b")
+
+	if keys := scan(t, b, bucketA, nil, nil); !equalKeys(keys, []string{"shared"}) {
+		t.Errorf("keys %q, want only %q", keys, "shared")
+	}
+}
+
+func testRollback(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+	put(t, b, bucketA, "key", "value")
+
+	err := b.Update(func(txn db.WriteTxn) error {
+		if err := txn.Put(bucketA, []byte("rolled back"), []byte("value")); err != nil {
+			return err
+		}
+		if err := txn.Delete(bucketA, []byte("key")); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Errorf("update returned %v, want the error of fn", err)
+	}
+
+	expectNotFound(t, b, bucketA, "rolled back")
+	expectValue(t, b, bucketA, "key", "value")
+}
+
+func testReadOwnWrites(t *testing.T, b db.Backend) {
+	createBuckets(t, b)
+
+	err := b.Update(func(txn db.WriteTxn) error {
+		if err := txn.Put(bucketA, []byte("own"), []byte("write")); err != nil {
+			return err
+		}
+
+		value, err := txn.Get(bucketA, []byte("own"))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, []byte("write")) {
+			t.Errorf("get %q = %q, want %q", "own", value, "write")
+		}
+
+		var found bool
+		err = txn.Scan(bucketA, []byte("own"), nil, func(key, _ []byte) error {
+			found = string(key) == "own"
+			return errRollback
+		})
+		if err != errRollback {
+			return err
+		}
+		if !found {
+			t.Errorf("scan does not see %q", "own")
+		}
+
+		return txn.Delete(bucketA, []byte("own"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectNotFound(t, b, bucketA, "own")
+}
+
+// testTikTokDB opens a TikTokDB on the backend and checks its records and
+// indexes. The backend is closed by newBackend, not by TikTokDB.Close.
+func testTikTokDB(t *testing.T, b db.Backend) {
+	tdb := db.New("")
+	tdb.Backend = b
+	if err := tdb.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	const userID = "1"
+	if err := tdb.SetUserIDList([]string{userID, "2"}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := tdb.GetUserIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalKeys(ids, []string{userID, "2"}) {
+		t.Errorf("got user IDs %v, want [1 2]", ids)
+	}
+
+	start := time.Unix(1680000000, 0)
+	if _, err := tdb.RecordUser(start, userID, &tiktok.User{UID: userID, UniqueID: "someone"}); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := tdb.RecordUser(start.Add(time.Hour), userID, &tiktok.User{UID: userID, UniqueID: "someoneelse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Field != "UniqueID" {
+		t.Errorf("got changes %v, want the new UniqueID", changes)
+	}
+	user, err := tdb.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UniqueID != "someoneelse" {
+		t.Errorf("got user @%s, want @someoneelse", user.UniqueID)
+	}
+	history, err := tdb.UserHistory(userID, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].User.UniqueID != "someone" {
+		t.Errorf("got history %v, want only @someone", history)
+	}
+
+	awemes := []tiktok.Aweme{
+		{AwemeID: "10", CreateTime: 1670000000, Music: tiktok.Music{ID: 7}},
+		{AwemeID: "11", CreateTime: 1670000100, Desc: "#food"},
+		{AwemeID: "12", CreateTime: 1670000200, Music: tiktok.Music{ID: 7}},
+	}
+	awemes[1].TextExtra = []tiktok.TextExtra{{Start: 0, End: 5, HashtagName: "food", Type: 1}}
+	awemes[2].Statistics.PlayCount = 100
+	if _, err := tdb.PutAwemes(start, userID, awemes); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := tdb.GetAwemeList(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(awemes) {
+		t.Errorf("got %d awemes, want %d", len(list), len(awemes))
+	}
+	expectAwemes(t, "by author", func() ([]tiktok.Aweme, error) {
+		return tdb.AwemesByAuthor(userID, 1670000100, 1670000200)
+	}, "11")
+	expectAwemes(t, "by hashtag", func() ([]tiktok.Aweme, error) {
+		return tdb.AwemesByHashtag("food")
+	}, "11")
+	expectAwemes(t, "by music", func() ([]tiktok.Aweme, error) {
+		return tdb.AwemesByMusic(7)
+	}, "10", "12")
+
+	if err := tdb.AppendStats(start.Add(time.Hour), awemes); err != nil {
+		t.Fatal(err)
+	}
+	series, err := tdb.GetStatsSeries("12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || series[0].PlayCount != 100 {
+		t.Errorf("got stats %v, want a snapshot of 100 plays", series)
+	}
+
+	job := &db.Job{ID: "fetch-10", Kind: db.JobFetch, AwemeID: "10", NextAttempt: start}
+	if err := tdb.PutJob(job); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := tdb.ClaimJob(start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != job.ID || claimed.State != db.JobRunning {
+		t.Errorf("claimed job %s in state %s, want running %s", claimed.ID, claimed.State, job.ID)
+	}
+	if _, err := tdb.ClaimJob(start.Add(time.Minute)); err != db.ErrNotFound {
+		t.Errorf("got error %v claiming from an empty queue, want db.ErrNotFound", err)
+	}
+}
+
+func expectAwemes(t *testing.T, name string, query func() ([]tiktok.Aweme, error), want ...string) {
+	t.Helper()
+
+	awemes, err := query()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	var got []string
+	for _, a := range awemes {
+		got = append(got, a.AwemeID)
+	}
+	if !equalKeys(got, want) {
+		t.Errorf("%s: got awemes %v, want %v", name, got, want)
+	}
+}
@@ -0,0 +1,384 @@
+package db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// Exports are written in one read transaction, so they are a consistent view
+// of the database. The JSON Lines format holds one ExportRecord per line and
+// can be imported again. The CSV format flattens one kind of record into a
+// table, for spreadsheets.
+
+const (
+	RecordUser      = "user"
+	RecordAweme     = "aweme"
+	RecordStats     = "stats"
+	RecordTombstone = "tombstone"
+)
+
+// ExportRecord is a line of a JSON Lines export. Type tells which of User,
+// Aweme, Stats and Tombstone is set.
+type ExportRecord struct {
+	Type      string         `json:"type"`
+	UserID    string         `json:"user_id"`
+	AwemeID   string         `json:"aweme_id,omitempty"`
+	LastSeen  int64          `json:"last_seen,omitempty"`
+	User      *tiktok.User   `json:"user,omitempty"`
+	Aweme     *tiktok.Aweme  `json:"aweme,omitempty"`
+	Stats     *StatsSnapshot `json:"stats,omitempty"`
+	Tombstone *Tombstone     `json:"tombstone,omitempty"`
+}
+
+// ExportFilter selects what to export. Zero fields do not filter.
+type ExportFilter struct {
+	// UserIDs are the users to export, all tracked users if empty.
+	UserIDs []string
+	// From and To bound the create time of awemes to [From, To).
+	From, To time.Time
+	// Hashtag only exports awemes tagged with it.
+	Hashtag string
+}
+
+func (f *ExportFilter) match(a *tiktok.Aweme) bool {
+	if f.Hashtag == "" {
+		return true
+	}
+
+	tag := strings.ToLower(strings.TrimPrefix(f.Hashtag, "#"))
+	for _, t := range Hashtags(a) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func getUserIDList(txn Txn) ([]string, error) {
+	value, err := txn.Get(userIdsDb, []byte(userIdsDb))
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDList []string
+	err = decodeRecord(value, &userIDList)
+	return userIDList, err
+}
+
+// Export calls fn with every record the filter selects: each user, followed by
+// the user's awemes oldest first, each followed by its tombstone, if it has
+// one, and its statistics snapshots.
+func (db *TikTokDB) Export(filter ExportFilter, fn func(*ExportRecord) error) error {
+	return db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		userIDs := filter.UserIDs
+		if len(userIDs) == 0 {
+			var err error
+			userIDs, err = getUserIDList(txn)
+			if err != nil {
+				return err
+			}
+		}
+
+		start, end := prefixKey, prefixEnd
+		if !filter.From.IsZero() {
+			start = func(userID string) []byte { return timeKey(userID, filter.From.Unix()) }
+		}
+		if !filter.To.IsZero() {
+			end = func(userID string) []byte { return timeKey(userID, filter.To.Unix()) }
+		}
+
+		for _, userID := range userIDs {
+			value, err := txn.Get(usersDb, []byte(userID))
+			if err == nil {
+				user := &tiktok.User{}
+				if err := decodeRecord(value, user); err != nil {
+					return err
+				}
+				if err := fn(&ExportRecord{Type: RecordUser, UserID: userID, User: user}); err != nil {
+					return err
+				}
+			} else if err != ErrNotFound {
+				return err
+			}
+
+			var records []*awemeRecord
+
+			err = txn.Scan(awemeAuthorIdx, start(userID), end(userID), func(_, id []byte) error {
+				record, err := getAwemeRecord(txn, string(id))
+				if err != nil {
+					return err
+				}
+				if filter.match(&record.Aweme) {
+					records = append(records, record)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				a := &record.Aweme
+				err := fn(&ExportRecord{Type: RecordAweme, UserID: userID, AwemeID: a.AwemeID, LastSeen: record.LastSeen, Aweme: a})
+				if err != nil {
+					return err
+				}
+
+				t, err := getTombstone(txn, a.AwemeID)
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+				if t != nil {
+					if err := fn(&ExportRecord{Type: RecordTombstone, UserID: userID, AwemeID: a.AwemeID, Tombstone: t}); err != nil {
+						return err
+					}
+				}
+
+				err = txn.Scan(statsDb, prefixKey(a.AwemeID), prefixEnd(a.AwemeID), func(_, value []byte) error {
+					snapshot := &StatsSnapshot{}
+					if err := decodeRecord(value, snapshot); err != nil {
+						return err
+					}
+					return fn(&ExportRecord{Type: RecordStats, UserID: userID, AwemeID: a.AwemeID, Stats: snapshot})
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// ExportJSONLines writes the records the filter selects as JSON Lines.
+func (db *TikTokDB) ExportJSONLines(w io.Writer, filter ExportFilter) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	err := db.Export(filter, func(record *ExportRecord) error {
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+var csvHeaders = map[string][]string{
+	RecordUser: {
+		"user_id", "unique_id", "nickname", "follower_count", "following_count",
+		"total_favorited", "aweme_count",
+	},
+	RecordAweme: {
+		"user_id", "aweme_id", "create_time", "desc", "hashtags", "music_id",
+		"music_title", "duration_ms", "play_count", "digg_count",
+		"comment_count", "share_count", "share_url",
+	},
+	RecordStats: {
+		"user_id", "aweme_id", "time", "play_count", "digg_count",
+		"comment_count", "share_count",
+	},
+	RecordTombstone: {
+		"user_id", "aweme_id", "reason", "removed_at",
+	},
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+func csvRow(record *ExportRecord) []string {
+	itoa := strconv.Itoa
+
+	switch record.Type {
+	case RecordUser:
+		u := record.User
+		return []string{
+			record.UserID, u.UniqueID, u.Nickname, itoa(u.FollowerCount), itoa(u.FollowingCount),
+			itoa(u.TotalFavorited), itoa(u.AwemeCount),
+		}
+	case RecordAweme:
+		a := record.Aweme
+		return []string{
+			record.UserID, a.AwemeID, formatTime(a.CreateTime), a.Desc, strings.Join(Hashtags(a), " "),
+			strconv.FormatInt(a.Music.ID, 10), a.Music.Title, itoa(a.Video.Duration),
+			itoa(a.Statistics.PlayCount), itoa(a.Statistics.DiggCount),
+			itoa(a.Statistics.CommentCount), itoa(a.Statistics.ShareCount), a.ShareURL,
+		}
+	case RecordTombstone:
+		t := record.Tombstone
+		return []string{record.UserID, record.AwemeID, string(t.Reason), formatTime(t.RemovedAt)}
+	default:
+		s := record.Stats
+		return []string{
+			record.UserID, record.AwemeID, formatTime(s.Time), itoa(s.PlayCount), itoa(s.DiggCount),
+			itoa(s.CommentCount), itoa(s.ShareCount),
+		}
+	}
+}
+
+// ExportCSV writes the records of one type, RecordUser, RecordAweme,
+// RecordStats or RecordTombstone, that the filter selects as CSV with a
+// header row.
+func (db *TikTokDB) ExportCSV(w io.Writer, recordType string, filter ExportFilter) error {
+	header, ok := csvHeaders[recordType]
+	if !ok {
+		return fmt.Errorf("unknown record type %q", recordType)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	err := db.Export(filter, func(record *ExportRecord) error {
+		if record.Type != recordType {
+			return nil
+		}
+		return cw.Write(csvRow(record))
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ImportJSONLines imports a JSON Lines export and returns how many records it
+// read. Records replace stored ones with the same key, and imported users are
+// tracked, so importing the same export again changes nothing. Awemes only
+// get the tombstones the export holds, not ones derived from their status.
+func (db *TikTokDB) ImportJSONLines(r io.Reader) (int, error) {
+	var records []*ExportRecord
+
+	dec := json.NewDecoder(r)
+	for {
+		record := &ExportRecord{}
+		err := dec.Decode(record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+
+		if err := record.validate(); err != nil {
+			return 0, fmt.Errorf("record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		return importRecords(txn, records)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
+
+func (r *ExportRecord) validate() error {
+	if r.UserID == "" {
+		return fmt.Errorf("%s record without user_id", r.Type)
+	}
+
+	switch r.Type {
+	case RecordUser:
+		if r.User == nil {
+			return fmt.Errorf("user record without user")
+		}
+	case RecordAweme:
+		if r.Aweme == nil || r.Aweme.AwemeID == "" {
+			return fmt.Errorf("aweme record without aweme")
+		}
+	case RecordStats:
+		if r.Stats == nil || r.AwemeID == "" {
+			return fmt.Errorf("stats record without stats or aweme_id")
+		}
+	case RecordTombstone:
+		if r.Tombstone == nil || r.Tombstone.AwemeID == "" {
+			return fmt.Errorf("tombstone record without tombstone")
+		}
+	default:
+		return fmt.Errorf("unknown record type %q", r.Type)
+	}
+
+	return nil
+}
+
+func importRecords(txn WriteTxn, records []*ExportRecord) error {
+	userIDs, err := getUserIDList(txn)
+	if err != nil {
+		return err
+	}
+	tracked := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		tracked[id] = true
+	}
+
+	for _, record := range records {
+		if !tracked[record.UserID] {
+			tracked[record.UserID] = true
+			userIDs = append(userIDs, record.UserID)
+		}
+
+		switch record.Type {
+		case RecordUser:
+			value, err := encodeRecord(record.User)
+			if err != nil {
+				return err
+			}
+			if err := txn.Put(usersDb, []byte(record.UserID), value); err != nil {
+				return err
+			}
+		case RecordAweme:
+			if err := putAwemeRecord(txn, record.UserID, record.Aweme, record.LastSeen); err != nil {
+				return err
+			}
+		case RecordStats:
+			value, err := encodeRecord(record.Stats)
+			if err != nil {
+				return err
+			}
+			key := timeKey(record.AwemeID, record.Stats.Time)
+			if err := txn.Put(statsDb, key, value); err != nil {
+				return err
+			}
+		case RecordTombstone:
+			if err := deleteTombstone(txn, record.Tombstone.AwemeID); err != nil {
+				return err
+			}
+			if _, err := putTombstone(txn, record.Tombstone); err != nil {
+				return err
+			}
+		}
+	}
+
+	value, err := encodeRecord(userIDs)
+	if err != nil {
+		return err
+	}
+
+	return txn.Put(userIdsDb, []byte(userIdsDb), value)
+}
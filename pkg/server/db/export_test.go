@@ -0,0 +1,121 @@
+package db
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// openTestDB opens a new bolt database in a temporary directory.
+func openTestDB(t *testing.T) *TikTokDB {
+	t.Helper()
+
+	db := New(filepath.Join(t.TempDir(), "db"))
+	db.BackendName = "bolt"
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func TestExportImportTombstones(t *testing.T) {
+	const userID = "1"
+
+	src := openTestDB(t)
+	if err := src.SetUserIDList([]string{userID}); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := time.Unix(1681000000, 0)
+	awemes := []tiktok.Aweme{
+		{AwemeID: "10", CreateTime: 1680000000},
+		{AwemeID: "11", CreateTime: 1680000100},
+		{AwemeID: "12", CreateTime: 1680000200},
+	}
+	awemes[1].Status.IsDelete = true
+	if _, err := src.PutAwemes(seen, userID, awemes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aweme 10 is available but missing from the feed, aweme 11 deleted
+	if _, err := src.PutAwemes(seen.Add(time.Hour), userID, awemes[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.MarkMissing(seen.Add(2*time.Hour), userID, seen.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]*Tombstone)
+	for _, id := range []string{"10", "11"} {
+		ts, err := src.GetTombstone(id)
+		if err != nil {
+			t.Fatalf("aweme %s: %v", id, err)
+		}
+		want[id] = ts
+	}
+
+	var export bytes.Buffer
+	if err := src.ExportJSONLines(&export, ExportFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(export.String(), `"type":"tombstone"`); n != 2 {
+		t.Fatalf("export holds %d tombstones, want 2:\n%s", n, export.String())
+	}
+
+	dst := openTestDB(t)
+	for i := 0; i < 2; i++ {
+		if _, err := dst.ImportJSONLines(bytes.NewReader(export.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+
+		for id, w := range want {
+			got, err := dst.GetTombstone(id)
+			if err != nil {
+				t.Fatalf("import %d: aweme %s lost its tombstone: %v", i+1, id, err)
+			}
+			if *got != *w {
+				t.Errorf("import %d: got tombstone %+v, want %+v", i+1, got, w)
+			}
+		}
+		if _, err := dst.GetTombstone("12"); err != ErrNotFound {
+			t.Errorf("import %d: aweme 12 got a tombstone: %v", i+1, err)
+		}
+	}
+
+	removed, err := dst.RemovedSince(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("got %d removed awemes after importing twice, want 2", len(removed))
+	}
+}
+
+func TestExportCSVTombstones(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.SetUserIDList([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := tiktok.Aweme{AwemeID: "10", CreateTime: 1680000000}
+	a.Status.PrivateStatus = 1
+	if _, err := db.PutAwemes(time.Unix(1681000000, 0), "1", []tiktok.Aweme{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := db.ExportCSV(&out, RecordTombstone, ExportFilter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "user_id,aweme_id,reason,removed_at\n1,10,private,2023-04-09T00:26:40Z\n"
+	if out.String() != want {
+		t.Errorf("got CSV\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// User snapshots are keyed {userID} 0x00 {unix time, 8 bytes big endian}.
+
+// UserSnapshot is the profile of a user at a point in time.
+type UserSnapshot struct {
+	Time int64
+	User tiktok.User
+}
+
+// UserChange is a profile field that changed between two snapshots.
+type UserChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// DiffUsers returns the tracked profile fields that differ between old and
+// new: FollowerCount, TotalFavorited, AwemeCount, Nickname, UniqueID and
+// Avatar.
+func DiffUsers(old, new *tiktok.User) []UserChange {
+	fields := []struct {
+		name     string
+		old, new string
+	}{
+		{"FollowerCount", strconv.Itoa(old.FollowerCount), strconv.Itoa(new.FollowerCount)},
+		{"TotalFavorited", strconv.Itoa(old.TotalFavorited), strconv.Itoa(new.TotalFavorited)},
+		{"AwemeCount", strconv.Itoa(old.AwemeCount), strconv.Itoa(new.AwemeCount)},
+		{"Nickname", old.Nickname, new.Nickname},
+		{"UniqueID", old.UniqueID, new.UniqueID},
+	}
+
+	var changes []UserChange
+	for _, f := range fields {
+		if f.old != f.new {
+			changes = append(changes, UserChange{Field: f.name, Old: f.old, New: f.new})
+		}
+	}
+
+	// Avatar URLs are signed and change on every request, so avatars are
+	// compared by URI, which not every API gives
+	oldAvatar, newAvatar := old.AvatarLarger.URI, new.AvatarLarger.URI
+	if oldAvatar != "" && newAvatar != "" && oldAvatar != newAvatar {
+		changes = append(changes, UserChange{Field: "Avatar", Old: oldAvatar, New: newAvatar})
+	}
+
+	return changes
+}
+
+// RecordUser stores the user like SetUser, appends a snapshot taken at to the
+// user's history and returns what changed since the stored user. Nothing has
+// changed the first time a user is recorded.
+func (db *TikTokDB) RecordUser(at time.Time, userID string, user *tiktok.User) ([]UserChange, error) {
+	var changes []UserChange
+
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		key := []byte(userID)
+
+		value, err := txn.Get(usersDb, key)
+		if err == nil {
+			var old tiktok.User
+			if err := decodeRecord(value, &old); err != nil {
+				return err
+			}
+			changes = DiffUsers(&old, user)
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		value, err = encodeRecord(user)
+		if err != nil {
+			return err
+		}
+		if err := txn.Put(usersDb, key, value); err != nil {
+			return err
+		}
+
+		value, err = encodeRecord(&UserSnapshot{Time: at.Unix(), User: *user})
+		if err != nil {
+			return err
+		}
+		return txn.Put(userHistoryDb, timeKey(userID, at.Unix()), value)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// UserHistory returns the snapshots of a user taken in [from, to), oldest
+// first.
+func (db *TikTokDB) UserHistory(userID string, from, to time.Time) ([]UserSnapshot, error) {
+	var history []UserSnapshot
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		start, end := timeKey(userID, from.Unix()), timeKey(userID, to.Unix())
+		return txn.Scan(userHistoryDb, start, end, func(_, value []byte) error {
+			var snapshot UserSnapshot
+			if err := decodeRecord(value, &snapshot); err != nil {
+				return err
+			}
+			history = append(history, snapshot)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+func TestDiffUsers(t *testing.T) {
+	base := tiktok.User{
+		UniqueID:       "someone",
+		Nickname:       "Someone",
+		FollowerCount:  10,
+		TotalFavorited: 100,
+		AwemeCount:     3,
+		AvatarLarger: tiktok.Avatar{
+			URI:     "tos-maliva-avt-0068/abc",
+			URLList: []string{"https://p16-sign-va.tiktokcdn.com/tos-maliva-avt-0068/abc~c5_1080x1080.jpeg?x-expires=1"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		change func(u *tiktok.User)
+		want   []UserChange
+	}{
+		{"unchanged", func(u *tiktok.User) {}, nil},
+		{"counts", func(u *tiktok.User) {
+			u.FollowerCount = 11
+			u.AwemeCount = 4
+		}, []UserChange{{"FollowerCount", "10", "11"}, {"AwemeCount", "3", "4"}}},
+		{"renamed", func(u *tiktok.User) {
+			u.UniqueID = "someoneelse"
+			u.Nickname = "Someone Else"
+		}, []UserChange{{"Nickname", "Someone", "Someone Else"}, {"UniqueID", "someone", "someoneelse"}}},
+		{"avatar", func(u *tiktok.User) {
+			u.AvatarLarger = tiktok.Avatar{URI: "tos-maliva-avt-0068/def"}
+		}, []UserChange{{"Avatar", "tos-maliva-avt-0068/abc", "tos-maliva-avt-0068/def"}}},
+		{"avatar URL signed again", func(u *tiktok.User) {
+			u.AvatarLarger.URLList = []string{"https://p77-sign-va.tiktokcdn.com/tos-maliva-avt-0068/abc~c5_1080x1080.jpeg?x-expires=2"}
+		}, nil},
+		{"avatar without URI", func(u *tiktok.User) {
+			u.AvatarLarger = tiktok.Avatar{URLList: []string{"https://p16-sign-va.tiktokcdn.com/other.jpeg"}}
+		}, nil},
+		// Statistics that are not tracked are not reported
+		{"untracked", func(u *tiktok.User) { u.FollowingCount = 5 }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			new := base
+			tt.change(&new)
+			if got := DiffUsers(&base, &new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got changes %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordUser(t *testing.T) {
+	db := openTestDB(t)
+	start := time.Unix(1680000000, 0)
+	day := 24 * time.Hour
+
+	users := []tiktok.User{
+		{UID: "1", UniqueID: "someone", FollowerCount: 10},
+		{UID: "1", UniqueID: "someone", FollowerCount: 10},
+		{UID: "1", UniqueID: "someoneelse", FollowerCount: 12},
+	}
+	wantChanges := [][]UserChange{
+		nil,
+		nil,
+		{{"FollowerCount", "10", "12"}, {"UniqueID", "someone", "someoneelse"}},
+	}
+
+	for i := range users {
+		changes, err := db.RecordUser(start.Add(time.Duration(i)*day), "1", &users[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(changes, wantChanges[i]) {
+			t.Errorf("record %d: got changes %v, want %v", i, changes, wantChanges[i])
+		}
+	}
+
+	// The latest profile is the stored user
+	user, err := db.GetUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UniqueID != "someoneelse" {
+		t.Errorf("got stored user @%s, want @someoneelse", user.UniqueID)
+	}
+
+	// Another user's history is kept apart
+	if _, err := db.RecordUser(start, "2", &tiktok.User{UID: "2", UniqueID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{"all", time.Unix(0, 0), start.Add(30 * day), []string{"someone", "someone", "someoneelse"}},
+		{"from is inclusive", start.Add(day), start.Add(30 * day), []string{"someone", "someoneelse"}},
+		{"to is exclusive", start, start.Add(2 * day), []string{"someone", "someone"}},
+		{"empty", start.Add(3 * day), start.Add(30 * day), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history, err := db.UserHistory("1", tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for i, snapshot := range history {
+				got = append(got, snapshot.User.UniqueID)
+				if i > 0 && snapshot.Time <= history[i-1].Time {
+					t.Errorf("snapshot at %d follows one at %d", snapshot.Time, history[i-1].Time)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got history %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
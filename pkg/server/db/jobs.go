@@ -0,0 +1,248 @@
+package db
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+type JobKind string
+
+const (
+	JobFetch  JobKind = "fetch"
+	JobRender JobKind = "render"
+)
+
+type JobState int
+
+const (
+	JobPending JobState = iota
+	JobRunning
+	JobDone
+	JobFailed
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobPending:
+		return "pending"
+	case JobRunning:
+		return "running"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Job is a unit of video work. Pending jobs are indexed in the job queue by
+// NextAttempt, so they are picked up in order and survive restarts.
+type Job struct {
+	ID       string
+	Kind     JobKind
+	UserID   string
+	AwemeID  string
+	ShareURL string
+
+	// Only set for render jobs
+	CommentUsername string
+	CommentText     string
+	ImagePath       string
+
+	State     JobState
+	Attempts  int
+	LastError string
+	Result    string
+
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	NextAttempt time.Time
+}
+
+// queueKey orders pending jobs by their next attempt, then by ID.
+func queueKey(job *Job) []byte {
+	key := make([]byte, 8, 8+len(job.ID))
+	binary.BigEndian.PutUint64(key, uint64(job.NextAttempt.UnixNano()))
+	return append(key, job.ID...)
+}
+
+func decodeJob(value []byte) (*Job, error) {
+	job := &Job{}
+	if err := decodeRecord(value, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (db *TikTokDB) GetJob(id string) (*Job, error) {
+	var job *Job
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		value, err := txn.Get(jobsDb, []byte(id))
+		if err != nil {
+			return err
+		}
+
+		job, err = decodeJob(value)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// PutJob stores the job and keeps its job queue entry in sync with its state.
+func (db *TikTokDB) PutJob(job *Job) error {
+	return db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		return putJob(txn, job)
+	})
+}
+
+func putJob(txn WriteTxn, job *Job) error {
+	key := []byte(job.ID)
+
+	// Drop the queue entry of the previous version of the job
+	value, err := txn.Get(jobsDb, key)
+	if err == nil {
+		old, err := decodeJob(value)
+		if err != nil {
+			return err
+		}
+		if old.State == JobPending {
+			if err := txn.Delete(jobQueue, queueKey(old)); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	value, err = encodeRecord(job)
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Put(jobsDb, key, value); err != nil {
+		return err
+	}
+
+	if job.State == JobPending {
+		return txn.Put(jobQueue, queueKey(job), key)
+	}
+
+	return nil
+}
+
+// ClaimJob marks the first pending job that is due at now as running and
+// returns it. It returns ErrNotFound if no job is due.
+func (db *TikTokDB) ClaimJob(now time.Time) (*Job, error) {
+	var job *Job
+
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		key, id, err := first(txn, jobQueue, nil)
+		if err != nil {
+			return err
+		}
+
+		if int64(binary.BigEndian.Uint64(key[:8])) > now.UnixNano() {
+			return ErrNotFound
+		}
+
+		value, err := txn.Get(jobsDb, id)
+		if err != nil {
+			return err
+		}
+
+		job, err = decodeJob(value)
+		if err != nil {
+			return err
+		}
+
+		job.State = JobRunning
+		job.Attempts++
+		job.UpdatedAt = now
+
+		return putJob(txn, job)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// NextJobTime returns when the earliest pending job is due, or ErrNotFound
+// if there are no pending jobs.
+func (db *TikTokDB) NextJobTime() (time.Time, error) {
+	var next time.Time
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		key, _, err := first(txn, jobQueue, nil)
+		if err != nil {
+			return err
+		}
+
+		next = time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+		return nil
+	})
+
+	return next, err
+}
+
+// RequeueRunningJobs puts jobs that were left running, e.g. by a crash, back
+// into the queue. The interrupted attempt is not counted.
+func (db *TikTokDB) RequeueRunningJobs(now time.Time) (int, error) {
+	requeued := 0
+
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		var running []*Job
+
+		err := txn.Scan(jobsDb, nil, nil, func(_, value []byte) error {
+			job, err := decodeJob(value)
+			if err != nil {
+				return err
+			}
+			if job.State == JobRunning {
+				running = append(running, job)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, job := range running {
+			job.State = JobPending
+			job.Attempts--
+			job.UpdatedAt = now
+			job.NextAttempt = now
+			if err := putJob(txn, job); err != nil {
+				return err
+			}
+		}
+
+		requeued = len(running)
+		return nil
+	})
+
+	return requeued, err
+}
@@ -0,0 +1,177 @@
+//go:build cgo
+
+package db
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/rs/zerolog"
+	lmdb "wellquite.org/golmdb"
+)
+
+func init() {
+	backends["lmdb"] = openLMDB
+}
+
+type lmdbBackend struct {
+	client *lmdb.LMDBClient
+}
+
+// openLMDB opens an LMDB environment in the directory path. LMDB is a C
+// library, so it needs cgo.
+func openLMDB(path string) (Backend, error) {
+	logger := zerolog.Nop()
+	mode := os.FileMode(0644)
+	numReaders := uint(8)
+
+	// check if directory exists, if not create it
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(path, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := lmdb.NewLMDB(logger, path, mode, numReaders, uint(len(databases)), lmdb.EnvironmentFlag(0), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lmdbBackend{client: client}, nil
+}
+
+func (b *lmdbBackend) View(fn func(txn Txn) error) error {
+	return b.client.View(func(txn *lmdb.ReadOnlyTxn) error {
+		return fn(&lmdbTxn{
+			txn: txn,
+			newCursor: func(dbRef lmdb.DBRef) (lmdbCursor, error) {
+				c, err := txn.NewCursor(dbRef)
+				if err != nil {
+					return nil, err
+				}
+				return c, nil
+			},
+		})
+	})
+}
+
+func (b *lmdbBackend) Update(fn func(txn WriteTxn) error) error {
+	return b.client.Update(func(txn *lmdb.ReadWriteTxn) error {
+		return fn(&lmdbWriteTxn{
+			lmdbTxn: lmdbTxn{
+				txn: txn,
+				newCursor: func(dbRef lmdb.DBRef) (lmdbCursor, error) {
+					c, err := txn.NewCursor(dbRef)
+					if err != nil {
+						return nil, err
+					}
+					return c, nil
+				},
+			},
+			rw: txn,
+		})
+	})
+}
+
+func (b *lmdbBackend) Close() error {
+	b.client.TerminateSync()
+	return nil
+}
+
+// lmdbReader is implemented by both read-only and read-write transactions.
+type lmdbReader interface {
+	DBRef(name string, flags lmdb.DatabaseFlag) (lmdb.DBRef, error)
+	Get(dbRef lmdb.DBRef, key []byte) ([]byte, error)
+}
+
+// lmdbCursor is implemented by both read-only and read-write cursors.
+type lmdbCursor interface {
+	First() ([]byte, []byte, error)
+	SeekGreaterThanOrEqualKey(key []byte) ([]byte, []byte, error)
+	Next() ([]byte, []byte, error)
+	Close()
+}
+
+type lmdbTxn struct {
+	txn       lmdbReader
+	newCursor func(dbRef lmdb.DBRef) (lmdbCursor, error)
+}
+
+func (t *lmdbTxn) Get(bucket string, key []byte) ([]byte, error) {
+	dbRef, err := t.txn.DBRef(bucket, lmdb.DatabaseFlag(0))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := t.txn.Get(dbRef, key)
+	if err == lmdb.NotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (t *lmdbTxn) Scan(bucket string, start, end []byte, fn func(key, value []byte) error) error {
+	dbRef, err := t.txn.DBRef(bucket, lmdb.DatabaseFlag(0))
+	if err != nil {
+		return err
+	}
+
+	c, err := t.newCursor(dbRef)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// LMDB rejects seeking to an empty key
+	var key, value []byte
+	if len(start) == 0 {
+		key, value, err = c.First()
+	} else {
+		key, value, err = c.SeekGreaterThanOrEqualKey(start)
+	}
+	for ; err == nil; key, value, err = c.Next() {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return nil
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	if err == lmdb.NotFound {
+		return nil
+	}
+	return err
+}
+
+type lmdbWriteTxn struct {
+	lmdbTxn
+	rw *lmdb.ReadWriteTxn
+}
+
+func (t *lmdbWriteTxn) CreateBucket(bucket string) error {
+	_, err := t.rw.DBRef(bucket, lmdb.DatabaseFlag(0x40000))
+	return err
+}
+
+func (t *lmdbWriteTxn) Put(bucket string, key, value []byte) error {
+	dbRef, err := t.rw.DBRef(bucket, lmdb.DatabaseFlag(0))
+	if err != nil {
+		return err
+	}
+	return t.rw.Put(dbRef, key, value, lmdb.PutFlag(0))
+}
+
+func (t *lmdbWriteTxn) Delete(bucket string, key []byte) error {
+	dbRef, err := t.rw.DBRef(bucket, lmdb.DatabaseFlag(0))
+	if err != nil {
+		return err
+	}
+
+	err = t.rw.Delete(dbRef, key, nil)
+	if err == lmdb.NotFound {
+		return nil
+	}
+	return err
+}
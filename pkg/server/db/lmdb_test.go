@@ -0,0 +1,9 @@
+//go:build cgo
+
+package db_test
+
+import "testing"
+
+func TestLMDBBackend(t *testing.T) {
+	testBackend(t, "lmdb")
+}
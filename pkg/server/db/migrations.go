@@ -0,0 +1,273 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/scraperapi"
+)
+
+// schemaVersionKey holds the number of migrations applied to the database, as
+// 8 bytes big endian, in the meta database.
+var schemaVersionKey = []byte("schema_version")
+
+// recordVersion is the version of the encoding of stored values. Changing a
+// stored struct in a way gob cannot decode old values into needs a new
+// version and a migration rewriting the records.
+const recordVersion = 1
+
+// ErrRecordVersion is returned when a stored value was written with an
+// encoding this version does not understand.
+var ErrRecordVersion = errors.New("unsupported record version")
+
+// envelope wraps every stored value with the version of its encoding.
+type envelope struct {
+	Version int
+	Data    []byte
+}
+
+func encodeRecord(v interface{}) ([]byte, error) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(envelope{Version: recordVersion, Data: data.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeRecord(value []byte, v interface{}) error {
+	var env envelope
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&env); err != nil {
+		return err
+	}
+
+	if env.Version != recordVersion {
+		return fmt.Errorf("%w %d", ErrRecordVersion, env.Version)
+	}
+
+	return gob.NewDecoder(bytes.NewReader(env.Data)).Decode(v)
+}
+
+type migration struct {
+	name    string
+	migrate func(txn WriteTxn) error
+}
+
+// migrations are applied in order, each once. The schema version is the
+// number of migrations applied, so migrations must only ever be appended.
+// A migration must not depend on code that later changes, such as the
+// current record encoding.
+var migrations = []migration{
+	{"split aweme lists into per-aweme records", migrateAwemeLists},
+	{"wrap records in versioned envelopes", migrateEnvelopes},
+}
+
+// SchemaVersion is the schema version this version of the package writes.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func getSchemaVersion(txn Txn) (int, error) {
+	value, err := txn.Get(metaDb, schemaVersionKey)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(value) != 8 {
+		return 0, fmt.Errorf("invalid schema version %x", value)
+	}
+
+	return int(binary.BigEndian.Uint64(value)), nil
+}
+
+// migrate brings the database up to the current schema version. Since it
+// runs in the transaction Open creates the databases in, a failed migration
+// leaves the database untouched.
+func migrate(txn WriteTxn) error {
+	version, err := getSchemaVersion(txn)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		log.Printf("migrating database to schema version %d: %s", i+1, migrations[i].name)
+		if err := migrations[i].migrate(txn); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", i+1, migrations[i].name, err)
+		}
+	}
+
+	value := binary.BigEndian.AppendUint64(nil, uint64(len(migrations)))
+	return txn.Put(metaDb, schemaVersionKey, value)
+}
+
+// The migrations below only use these copies of the database names, record
+// types and key builders as they were when each migration was written.
+const (
+	v0UserIdsDb = "user_ids"
+	v0UsersDb   = "users"
+	v0AwemeDb   = "awemes"
+
+	v1AwemeDb         = "aweme_records"
+	v1AwemeAuthorIdx  = "aweme_by_author"
+	v1AwemeHashtagIdx = "aweme_by_hashtag"
+	v1AwemeMusicIdx   = "aweme_by_music"
+	v1SyncDb          = "sync_state"
+	v1JobsDb          = "jobs"
+)
+
+// v1AwemeRecord is the aweme record of schema version 1. Gob matches fields
+// by name, so the aweme itself is carried over as scraperapi.Aweme.
+type v1AwemeRecord struct {
+	UserID string
+	Aweme  scraperapi.Aweme
+}
+
+// v1IndexKeys returns the index entries of a schema version 1 aweme record:
+//
+//	aweme_by_author  {userID} 0x00 {create_time, 8 bytes big endian} {awemeID}
+//	aweme_by_hashtag {lowercased hashtag} 0x00 {awemeID}
+//	aweme_by_music   {music ID} 0x00 {awemeID}
+func v1IndexKeys(r *v1AwemeRecord) map[string][][]byte {
+	id := r.Aweme.AwemeID
+	prefix := func(p string) []byte {
+		return append([]byte(p), 0)
+	}
+
+	author := binary.BigEndian.AppendUint64(prefix(r.UserID), uint64(r.Aweme.CreateTime))
+	keys := map[string][][]byte{
+		v1AwemeAuthorIdx: {append(author, id...)},
+	}
+
+	seen := make(map[string]bool)
+	addTag := func(tag string) {
+		tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+		if tag == "" || seen[tag] {
+			return
+		}
+		seen[tag] = true
+		keys[v1AwemeHashtagIdx] = append(keys[v1AwemeHashtagIdx], append(prefix(tag), id...))
+	}
+	for _, cha := range r.Aweme.ChaList {
+		addTag(cha.ChaName)
+	}
+	for _, extra := range r.Aweme.TextExtra {
+		addTag(extra.HashtagName)
+	}
+
+	if r.Aweme.Music.ID != 0 {
+		music := prefix(strconv.FormatInt(r.Aweme.Music.ID, 10))
+		keys[v1AwemeMusicIdx] = [][]byte{append(music, id...)}
+	}
+
+	return keys
+}
+
+// v2Envelope is the envelope of schema version 2.
+type v2Envelope struct {
+	Version int
+	Data    []byte
+}
+
+// migrateAwemeLists moves the per-user aweme lists of schema version 0 into
+// per-aweme records and indexes. The records are written as plain gob, as
+// they were before envelopes existed.
+func migrateAwemeLists(txn WriteTxn) error {
+	var userIDs []string
+	records := make(map[string]*v1AwemeRecord)
+
+	err := txn.Scan(v0AwemeDb, nil, nil, func(key, value []byte) error {
+		var awemeList []scraperapi.Aweme
+		decoder := gob.NewDecoder(bytes.NewReader(value))
+		if err := decoder.Decode(&awemeList); err != nil {
+			return err
+		}
+
+		userID := string(key)
+		userIDs = append(userIDs, userID)
+		for _, a := range awemeList {
+			records[a.AwemeID] = &v1AwemeRecord{UserID: userID, Aweme: a}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, record := range records {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+			return err
+		}
+
+		if err := txn.Put(v1AwemeDb, []byte(id), buf.Bytes()); err != nil {
+			return err
+		}
+
+		for index, keys := range v1IndexKeys(record) {
+			for _, k := range keys {
+				if err := txn.Put(index, k, []byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, userID := range userIDs {
+		if err := txn.Delete(v0AwemeDb, []byte(userID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateEnvelopes wraps the plain gob values of every record database in
+// version 1 envelopes. Index values are aweme and job IDs and stay as they
+// are.
+func migrateEnvelopes(txn WriteTxn) error {
+	for _, name := range []string{v0UserIdsDb, v0UsersDb, v1AwemeDb, v1SyncDb, v1JobsDb} {
+		var keys, values [][]byte
+
+		err := txn.Scan(name, nil, nil, func(key, value []byte) error {
+			keys = append(keys, append([]byte(nil), key...))
+			values = append(values, append([]byte(nil), value...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			var buf bytes.Buffer
+			err := gob.NewEncoder(&buf).Encode(v2Envelope{Version: 1, Data: values[i]})
+			if err != nil {
+				return err
+			}
+
+			if err := txn.Put(name, key, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
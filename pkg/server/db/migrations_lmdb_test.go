@@ -0,0 +1,57 @@
+//go:build cgo
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/schema-v{N}.lmdb are LMDB environments at schema version N,
+// holding the same records as testdata/schema-v{N}.snap. schema-v0.lmdb only
+// has the user_ids, users and awemes sub-databases, like the environments
+// written before the package had schema versions. Like the snapshots, they
+// are never regenerated.
+func TestMigrateLMDB(t *testing.T) {
+	for version := 0; version <= SchemaVersion(); version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			// Opening writes a lock file, and migrating writes the data
+			path := filepath.Join(t.TempDir(), "db")
+			if err := os.Mkdir(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join("testdata", fmt.Sprintf("schema-v%d.lmdb", version), lmdbFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(path, lmdbFile), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db := New(path)
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if db.BackendName != "lmdb" {
+				t.Fatalf("opened the environment with the %s backend", db.BackendName)
+			}
+			checkSnapshotData(t, db)
+
+			var got int
+			err = db.Backend.View(func(txn Txn) error {
+				got, err = getSchemaVersion(txn)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != SchemaVersion() {
+				t.Errorf("migrated to schema version %d, want %d", got, SchemaVersion())
+			}
+		})
+	}
+}
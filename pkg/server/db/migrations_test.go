@@ -0,0 +1,125 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testdata/schema-v{N}.snap are snapshots of databases at schema version N,
+// holding the fake user @fakeuser and the five awemes of its feed:
+//
+//	v0  the user ID list, the user and its aweme list, as plain gob
+//	v1  the aweme list split into records and indexes, and a sync state
+//	v2  the same data in versioned envelopes, with a stats snapshot
+//
+// They are never regenerated, since they stand for databases older versions
+// of the package wrote.
+const (
+	snapshotUserID   = "6800000000000000001"
+	snapshotUsername = "fakeuser"
+)
+
+func TestMigrateSnapshots(t *testing.T) {
+	for version := 0; version <= SchemaVersion(); version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			snapshot := filepath.Join("testdata", fmt.Sprintf("schema-v%d.snap", version))
+
+			got, err := VerifySnapshot(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != version {
+				t.Fatalf("snapshot has schema version %d, want %d", got, version)
+			}
+
+			path := filepath.Join(t.TempDir(), "db")
+			if err := Restore(snapshot, path, "bolt"); err != nil {
+				t.Fatal(err)
+			}
+
+			db := New(path)
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			checkSnapshotData(t, db)
+		})
+	}
+}
+
+func checkSnapshotData(t *testing.T, db *TikTokDB) {
+	t.Helper()
+
+	ids, err := db.GetUserIDList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != snapshotUserID {
+		t.Errorf("got user IDs %v, want [%s]", ids, snapshotUserID)
+	}
+
+	user, err := db.GetUser(snapshotUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UniqueID != snapshotUsername {
+		t.Errorf("got user @%s, want @%s", user.UniqueID, snapshotUsername)
+	}
+
+	awemes, err := db.GetAwemeList(snapshotUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(awemes) != 5 {
+		t.Errorf("got %d awemes, want 5", len(awemes))
+	}
+
+	a, err := db.GetAweme("7220000000000000005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.CreateTime != 1681200000 || a.Statistics.DiggCount == 0 {
+		t.Errorf("aweme was not carried over intact: %+v", a)
+	}
+
+	byAuthor, err := db.AwemesByAuthor(snapshotUserID, 0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byAuthor) != 5 {
+		t.Errorf("got %d awemes by author, want 5", len(byAuthor))
+	}
+
+	byHashtag, err := db.AwemesByHashtag("food")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byHashtag) != 2 {
+		t.Errorf("got %d awemes tagged #food, want 2", len(byHashtag))
+	}
+
+	byMusic, err := db.AwemesByMusic(7210000000000000105)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byMusic) != 2 {
+		t.Errorf("got %d awemes with music 7210000000000000105, want 2", len(byMusic))
+	}
+
+	// The snapshots of the versions that had sync states hold one
+	state, err := db.GetSyncState(snapshotUserID)
+	if err == nil && state.HighWaterMark != 1681200000 {
+		t.Errorf("got high-water mark %d, want 1681200000", state.HighWaterMark)
+	} else if err != nil && err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// A migrated database takes writes like a new one
+	if _, err := db.PutAwemes(time.Now(), snapshotUserID, awemes[:1]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// Statistics snapshots are keyed {awemeID} 0x00 {unix time, 8 bytes big
+// endian}, so the series of an aweme is a range in time order.
+
+// StatsSnapshot is the engagement of an aweme at a point in time.
+type StatsSnapshot struct {
+	Time         int64 `json:"time"`
+	PlayCount    int   `json:"play_count"`
+	DiggCount    int   `json:"digg_count"`
+	CommentCount int   `json:"comment_count"`
+	ShareCount   int   `json:"share_count"`
+}
+
+// AppendStats records a snapshot of the statistics of every aweme, taken at.
+func (db *TikTokDB) AppendStats(at time.Time, awemes []tiktok.Aweme) error {
+	return db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		for i := range awemes {
+			stats := &awemes[i].Statistics
+			value, err := encodeRecord(&StatsSnapshot{
+				Time:         at.Unix(),
+				PlayCount:    stats.PlayCount,
+				DiggCount:    stats.DiggCount,
+				CommentCount: stats.CommentCount,
+				ShareCount:   stats.ShareCount,
+			})
+			if err != nil {
+				return err
+			}
+
+			key := timeKey(awemes[i].AwemeID, at.Unix())
+			if err := txn.Put(statsDb, key, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// StatsSeries returns the snapshots of an aweme taken in [from, to), oldest
+// first.
+func (db *TikTokDB) StatsSeries(awemeID string, from, to time.Time) ([]StatsSnapshot, error) {
+	var series []StatsSnapshot
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		start, end := timeKey(awemeID, from.Unix()), timeKey(awemeID, to.Unix())
+		return txn.Scan(statsDb, start, end, func(_, value []byte) error {
+			var snapshot StatsSnapshot
+			if err := decodeRecord(value, &snapshot); err != nil {
+				return err
+			}
+			series = append(series, snapshot)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// GetStatsSeries returns every snapshot of an aweme, oldest first.
+func (db *TikTokDB) GetStatsSeries(awemeID string) ([]StatsSnapshot, error) {
+	return db.StatsSeries(awemeID, time.Unix(0, 0), time.Unix(1<<62, 0))
+}
+
+// StatsMetrics are engagement metrics derived from a statistics series.
+type StatsMetrics struct {
+	// ViewsPerHour24 and ViewsPerHour72 are the average views per hour over
+	// the first 24 and 72 hours after the aweme was posted. Until the series
+	// covers that long they are the average so far.
+	ViewsPerHour24 float64
+	ViewsPerHour72 float64
+	// LikesPerView is the likes-to-views ratio of the latest snapshot.
+	LikesPerView float64
+}
+
+// ComputeMetrics derives metrics from the series of an aweme created at
+// createTime, in Unix seconds. The series must be oldest first.
+func ComputeMetrics(createTime int64, series []StatsSnapshot) StatsMetrics {
+	var metrics StatsMetrics
+	if len(series) == 0 {
+		return metrics
+	}
+
+	metrics.ViewsPerHour24 = viewsPerHour(createTime, series, 24*time.Hour)
+	metrics.ViewsPerHour72 = viewsPerHour(createTime, series, 72*time.Hour)
+
+	last := series[len(series)-1]
+	if last.PlayCount > 0 {
+		metrics.LikesPerView = float64(last.DiggCount) / float64(last.PlayCount)
+	}
+
+	return metrics
+}
+
+// viewsPerHour estimates the views at window after createTime by linear
+// interpolation between snapshots, counting from zero views at createTime,
+// and averages them over the window.
+func viewsPerHour(createTime int64, series []StatsSnapshot, window time.Duration) float64 {
+	end := createTime + int64(window/time.Second)
+
+	prevTime, prevViews := createTime, 0.0
+	for _, s := range series {
+		if s.Time <= createTime {
+			prevViews = float64(s.PlayCount)
+			continue
+		}
+
+		if s.Time >= end {
+			frac := float64(end-prevTime) / float64(s.Time-prevTime)
+			views := prevViews + frac*(float64(s.PlayCount)-prevViews)
+			return views / window.Hours()
+		}
+
+		prevTime, prevViews = s.Time, float64(s.PlayCount)
+	}
+
+	// The series ends inside the window
+	if prevTime == createTime {
+		return 0
+	}
+	hours := float64(prevTime-createTime) / 3600
+	return prevViews / hours
+}
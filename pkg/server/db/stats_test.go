@@ -0,0 +1,82 @@
+package db
+
+import (
+	"math"
+	"testing"
+)
+
+func TestComputeMetrics(t *testing.T) {
+	const created = 1680000000
+	const hour = 3600
+
+	tests := []struct {
+		name   string
+		series []StatsSnapshot
+		want   StatsMetrics
+	}{
+		{
+			name: "no snapshots",
+		},
+		{
+			name:   "single snapshot",
+			series: []StatsSnapshot{{Time: created + 2*hour, PlayCount: 200, DiggCount: 50}},
+			want:   StatsMetrics{ViewsPerHour24: 100, ViewsPerHour72: 100, LikesPerView: 0.25},
+		},
+		{
+			// No time has passed since the aweme was posted, so there is no
+			// rate yet rather than a division by zero
+			name:   "zero elapsed time",
+			series: []StatsSnapshot{{Time: created, PlayCount: 10, DiggCount: 1}},
+			want:   StatsMetrics{LikesPerView: 0.1},
+		},
+		{
+			name:   "snapshot before creation",
+			series: []StatsSnapshot{{Time: created - hour, PlayCount: 10}},
+			want:   StatsMetrics{},
+		},
+		{
+			name: "interpolated at the window ends",
+			series: []StatsSnapshot{
+				{Time: created + 12*hour, PlayCount: 1200},
+				{Time: created + 36*hour, PlayCount: 3600},
+				{Time: created + 96*hour, PlayCount: 6000},
+			},
+			// 2400 views at 24 hours, 5040 at 72 hours
+			want: StatsMetrics{ViewsPerHour24: 100, ViewsPerHour72: 70},
+		},
+		{
+			// Play counts can go down when TikTok discounts views, the
+			// estimate follows them down without going negative
+			name: "decreasing play count",
+			series: []StatsSnapshot{
+				{Time: created + 12*hour, PlayCount: 1200},
+				{Time: created + 36*hour, PlayCount: 600, DiggCount: 60},
+			},
+			// 900 views at 24 hours; the series ends before 72 hours
+			want: StatsMetrics{ViewsPerHour24: 37.5, ViewsPerHour72: 600.0 / 36, LikesPerView: 0.1},
+		},
+		{
+			name: "decreasing to zero",
+			series: []StatsSnapshot{
+				{Time: created + 12*hour, PlayCount: 1200},
+				{Time: created + 24*hour, PlayCount: 0, DiggCount: 5},
+			},
+			want: StatsMetrics{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ComputeMetrics(created, tt.series)
+			if !closeTo(got.ViewsPerHour24, tt.want.ViewsPerHour24) ||
+				!closeTo(got.ViewsPerHour72, tt.want.ViewsPerHour72) ||
+				!closeTo(got.LikesPerView, tt.want.LikesPerView) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+)
+
+// Tombstones mark awemes that were removed from TikTok or restricted. The
+// aweme record, and any media already stored for it, are kept. Tombstones
+// are keyed by AwemeID and indexed by {removed_at, 8 bytes big endian}
+// {awemeID} in tombstone_by_time.
+
+type TombstoneReason string
+
+const (
+	// TombstoneMissing marks an aweme a full sync did not see in the feed.
+	TombstoneMissing    TombstoneReason = "missing"
+	TombstoneDeleted    TombstoneReason = "deleted"
+	TombstonePrivate    TombstoneReason = "private"
+	TombstoneProhibited TombstoneReason = "prohibited"
+)
+
+type Tombstone struct {
+	AwemeID string          `json:"aweme_id"`
+	UserID  string          `json:"user_id"`
+	Reason  TombstoneReason `json:"reason"`
+	// RemovedAt is when the removal was first observed, in Unix seconds.
+	RemovedAt int64 `json:"removed_at"`
+}
+
+// restriction returns why the status of an aweme makes it unavailable, or ""
+// if it is available.
+func restriction(a *tiktok.Aweme) TombstoneReason {
+	switch {
+	case a.Status.IsDelete:
+		return TombstoneDeleted
+	case a.Status.IsProhibited:
+		return TombstoneProhibited
+	case a.Status.PrivateStatus != 0:
+		return TombstonePrivate
+	}
+	return ""
+}
+
+func tombstoneTimeKey(t *Tombstone) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(t.RemovedAt))
+	return append(key, t.AwemeID...)
+}
+
+func getTombstone(txn Txn, awemeID string) (*Tombstone, error) {
+	value, err := txn.Get(tombstoneDb, []byte(awemeID))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tombstone{}
+	if err := decodeRecord(value, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// putTombstone tombstones an aweme unless it already is, so RemovedAt stays
+// the time the removal was first observed. It reports whether a tombstone
+// was added.
+func putTombstone(txn WriteTxn, t *Tombstone) (bool, error) {
+	if _, err := getTombstone(txn, t.AwemeID); err == nil {
+		return false, nil
+	} else if err != ErrNotFound {
+		return false, err
+	}
+
+	value, err := encodeRecord(t)
+	if err != nil {
+		return false, err
+	}
+
+	if err := txn.Put(tombstoneDb, []byte(t.AwemeID), value); err != nil {
+		return false, err
+	}
+
+	return true, txn.Put(tombstoneTimeIdx, tombstoneTimeKey(t), []byte(t.AwemeID))
+}
+
+// deleteTombstone removes the tombstone of an aweme, if it has one.
+func deleteTombstone(txn WriteTxn, awemeID string) error {
+	t, err := getTombstone(txn, awemeID)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := txn.Delete(tombstoneTimeIdx, tombstoneTimeKey(t)); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	return txn.Delete(tombstoneDb, []byte(awemeID))
+}
+
+// GetTombstone returns the tombstone of an aweme, or ErrNotFound if the
+// aweme is available.
+func (db *TikTokDB) GetTombstone(awemeID string) (*Tombstone, error) {
+	var t *Tombstone
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		var err error
+		t, err = getTombstone(txn, awemeID)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// MarkMissing tombstones the user's awemes that were last seen before
+// seenSince, typically when the full sync that ended at at started, and
+// returns the new tombstones.
+func (db *TikTokDB) MarkMissing(at time.Time, userID string, seenSince time.Time) ([]Tombstone, error) {
+	var added []Tombstone
+
+	err := db.Backend.Update(func(txn WriteTxn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		var missing []string
+
+		err := txn.Scan(awemeAuthorIdx, prefixKey(userID), prefixEnd(userID), func(_, id []byte) error {
+			record, err := getAwemeRecord(txn, string(id))
+			if err != nil {
+				return err
+			}
+			if record.LastSeen < seenSince.Unix() {
+				missing = append(missing, record.Aweme.AwemeID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range missing {
+			t := Tombstone{AwemeID: id, UserID: userID, Reason: TombstoneMissing, RemovedAt: at.Unix()}
+			ok, err := putTombstone(txn, &t)
+			if err != nil {
+				return err
+			}
+			if ok {
+				added = append(added, t)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return added, nil
+}
+
+// RemovedSince returns the tombstones of awemes whose removal was first
+// observed at or after since, oldest first.
+func (db *TikTokDB) RemovedSince(since time.Time) ([]Tombstone, error) {
+	var tombstones []Tombstone
+
+	err := db.Backend.View(func(txn Txn) error {
+		db.wg.Add(1)
+		defer db.wg.Done()
+
+		var start []byte
+		if since.Unix() > 0 {
+			start = binary.BigEndian.AppendUint64(nil, uint64(since.Unix()))
+		}
+		return txn.Scan(tombstoneTimeIdx, start, nil, func(_, id []byte) error {
+			t, err := getTombstone(txn, string(id))
+			if err != nil {
+				return err
+			}
+			tombstones = append(tombstones, *t)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tombstones, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe/fakeprobe"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/faketiktok"
+)
+
+// The test binary stands in for ffprobe, which validates fetched videos.
+func TestMain(m *testing.M) {
+	fakeprobe.Main()
+	os.Exit(m.Run())
+}
+
+// storedVideoBytes returns the stored video of the aweme.
+func storedVideoBytes(t *testing.T, s *Server, awemeID string) []byte {
+	t.Helper()
+
+	access, ok := s.storedVideo(awemeID)
+	if !ok {
+		t.Fatalf("aweme %s has no stored video", awemeID)
+	}
+
+	r, err := s.VideoStorage.Open(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAddUpdateFetch(t *testing.T) {
+	s, fake := newTestServer(t)
+	fakeprobe.Use(t, "tiktok")
+	ctx := context.Background()
+
+	request(t, s.Handler(), "POST", "/users", addUserRequest{Username: fakeUsername}, http.StatusCreated, nil)
+	if err := s.UpdateAllOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	awemes, err := s.DB.GetAwemeList(fakeUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(awemes) != 5 {
+		t.Fatalf("got %d awemes after the update, want 5", len(awemes))
+	}
+
+	fetchAll(t, s)
+
+	for _, a := range awemes {
+		job, err := s.DB.GetJob("fetch-" + a.AwemeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != db.JobDone {
+			t.Errorf("fetch of aweme %s is %s: %s", a.AwemeID, job.State, job.LastError)
+			continue
+		}
+
+		// Stored as served, without rewriting its metadata
+		served, err := fs.ReadFile(fake.Fixtures, path.Join("media", a.AwemeID+".mp4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := storedVideoBytes(t, s, a.AwemeID); string(got) != string(served) {
+			t.Errorf("stored video of aweme %s differs from the %d bytes served", a.AwemeID, len(served))
+		}
+	}
+
+	// Stored videos are not fetched again
+	fetchAll(t, s)
+	for _, a := range awemes {
+		if n := fake.Requests("/media/" + a.AwemeID + ".mp4"); n != 1 {
+			t.Errorf("video of aweme %s was downloaded %d times, want once", a.AwemeID, n)
+		}
+	}
+}
+
+// fetchAll queues the fetches of the fake user's videos and processes them,
+// like RunJobs does once woken.
+func fetchAll(t *testing.T, s *Server) {
+	t.Helper()
+
+	if err := s.FetchAllVideos(fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-s.wake:
+	default:
+		t.Fatal("queued fetches did not wake RunJobs")
+	}
+
+	if err := s.ProcessJobs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// truncateMedia cuts the aweme's video in fake short, and returns a function
+// that restores it.
+func truncateMedia(t *testing.T, fake *faketiktok.Server, awemeID string) func() {
+	t.Helper()
+
+	name := path.Join("media", awemeID+".mp4")
+	data, err := fs.ReadFile(fake.Fixtures, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures := fstest.MapFS{}
+	err = fs.WalkDir(fake.Fixtures, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fake.Fixtures, name)
+		fixtures[name] = &fstest.MapFile{Data: data}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures[name] = &fstest.MapFile{Data: data[:len(data)-100]}
+	fake.Fixtures = fixtures
+
+	return func() {
+		fixtures[name] = &fstest.MapFile{Data: data}
+	}
+}
+
+func TestFetchRetriesCorruptVideo(t *testing.T) {
+	s, fake := newTestServer(t)
+	fakeprobe.Use(t, "tiktok")
+	ctx := context.Background()
+
+	if err := s.AddUsername(ctx, fakeUsername); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	const awemeID = "7220000000000000005"
+	restore := truncateMedia(t, fake, awemeID)
+
+	fetchAll(t, s)
+
+	job, err := s.DB.GetJob("fetch-" + awemeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != db.JobPending || !strings.Contains(job.LastError, "corrupt video") {
+		t.Fatalf("got %s job with error %q, want it pending a retry of the corrupt video", job.State, job.LastError)
+	}
+
+	quarantined, err := os.ReadDir(s.QuarantineDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 1 || !strings.HasPrefix(quarantined[0].Name(), awemeID) {
+		t.Errorf("got %v in the quarantine, want the video of aweme %s", quarantined, awemeID)
+	}
+
+	// The retry downloads the whole video again
+	restore()
+	job.NextAttempt = time.Now()
+	if err := s.DB.PutJob(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ProcessJobs(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = s.DB.GetJob("fetch-" + awemeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != db.JobDone {
+		t.Fatalf("retried fetch is %s: %s", job.State, job.LastError)
+	}
+	served, err := fs.ReadFile(fake.Fixtures, path.Join("media", awemeID+".mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storedVideoBytes(t, s, awemeID); string(got) != string(served) {
+		t.Errorf("stored video differs from the %d bytes served", len(served))
+	}
+}
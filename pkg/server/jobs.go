@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/videoprocessor"
+)
+
+const (
+	maxJobAttempts  = 5
+	jobBackoffBase  = 30 * time.Second
+	jobBackoffMax   = time.Hour
+	jobPollInterval = time.Minute
+)
+
+// jobBackoff returns how long to wait before retrying a job that failed its
+// n-th attempt.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBackoffBase
+	for i := 1; i < attempts && backoff < jobBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > jobBackoffMax {
+		backoff = jobBackoffMax
+	}
+	return backoff
+}
+
+func newJob(id string, kind db.JobKind, userID string, a *tiktok.Aweme) *db.Job {
+	now := time.Now()
+	return &db.Job{
+		ID:          id,
+		Kind:        kind,
+		UserID:      userID,
+		AwemeID:     a.AwemeID,
+		ShareURL:    a.ShareURL,
+		State:       db.JobPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		NextAttempt: now,
+	}
+}
+
+// EnqueueFetch queues a fetch job for the aweme, unless it was already
+// fetched or is queued. Failed fetches are queued again.
+func (s *Server) EnqueueFetch(userID string, a *tiktok.Aweme) error {
+	id := fmt.Sprintf("fetch-%s", a.AwemeID)
+
+	job, err := s.DB.GetJob(id)
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+	if job != nil && job.State != db.JobFailed {
+		return nil
+	}
+
+	return s.DB.PutJob(newJob(id, db.JobFetch, userID, a))
+}
+
+// EnqueueRender queues a job that generates a commented video of the aweme.
+func (s *Server) EnqueueRender(userID string, a *tiktok.Aweme, commentUsername, commentText, imagePath string) (*db.Job, error) {
+	id := fmt.Sprintf("render-%s-%d", a.AwemeID, time.Now().UnixNano())
+
+	job := newJob(id, db.JobRender, userID, a)
+	job.CommentUsername = commentUsername
+	job.CommentText = commentText
+	job.ImagePath = imagePath
+
+	if err := s.DB.PutJob(job); err != nil {
+		return nil, err
+	}
+	s.wakeJobs()
+
+	return job, nil
+}
+
+// wakeJobs makes RunJobs look for due jobs without waiting for its timer.
+func (s *Server) wakeJobs() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunJobs processes queued jobs as they become due, until ctx is done.
+func (s *Server) RunJobs(ctx context.Context) error {
+	for {
+		if err := s.ProcessJobs(ctx); err != nil {
+			return err
+		}
+
+		wait := jobPollInterval
+		next, err := s.DB.NextJobTime()
+		if err == nil && time.Until(next) < wait {
+			wait = time.Until(next)
+		} else if err != nil && err != db.ErrNotFound {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Server) finishJob(ctx context.Context, job *db.Job, result string, err error) error {
+	now := time.Now()
+	job.UpdatedAt = now
+
+	switch {
+	case err == nil:
+		job.State = db.JobDone
+		job.Result = result
+		job.LastError = ""
+	case ctx.Err() != nil:
+		// Interrupted by shutdown, so the attempt does not count
+		job.State = db.JobPending
+		job.Attempts--
+		job.NextAttempt = now
+	default:
+		log.Printf("job %s failed (attempt %d): %s", job.ID, job.Attempts, err)
+		job.LastError = err.Error()
+		if job.Attempts >= maxJobAttempts || permanentJobError(err) {
+			job.State = db.JobFailed
+		} else {
+			job.State = db.JobPending
+			job.NextAttempt = now.Add(jobBackoff(job.Attempts))
+		}
+	}
+
+	return s.DB.PutJob(job)
+}
+
+// permanentJobError reports whether retrying a job that failed with err is
+// pointless, e.g. because the video is gone or is not playable. Corrupt
+// downloads are retried.
+func permanentJobError(err error) bool {
+	return errors.Is(err, apierror.ErrNotFound) ||
+		errors.Is(err, apierror.ErrUnauthorized) ||
+		errors.Is(err, apierror.ErrQuotaExceeded) ||
+		errors.Is(err, videoprocessor.ErrInvalidVideo)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/videoprocessor"
+)
+
+func TestPermanentJobError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: no video stream", videoprocessor.ErrInvalidVideo), true},
+		{fmt.Errorf("%w: truncated mdat atom", videoprocessor.ErrCorruptVideo), false},
+		{apierror.FromMessage(200, 0, "video not found"), true},
+		{apierror.FromMessage(429, 0, "rate limit exceeded"), false},
+		{errors.New("connection reset"), false},
+	}
+
+	for _, tt := range tests {
+		// Quarantining wraps the validation error
+		err := fmt.Errorf("%w (quarantined as video.mp4)", tt.err)
+		if got := permanentJobError(err); got != tt.want {
+			t.Errorf("permanentJobError(%v) = %v, want %v", err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/metadata"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/videoprocessor"
+)
+
+// StageLimits caps how many jobs each pipeline stage works on at once.
+// Stages hand jobs over without buffering, so a busy stage blocks the ones
+// before it instead of letting their output pile up on disk.
+type StageLimits struct {
+	Resolve  int
+	Download int
+	Validate int
+	Process  int
+	Store    int
+}
+
+var DefaultStageLimits = StageLimits{
+	Resolve:  2,
+	Download: 4,
+	Validate: 4,
+	Process:  2,
+	Store:    4,
+}
+
+func (l StageLimits) withDefaults() StageLimits {
+	fix := func(n, def int) int {
+		if n <= 0 {
+			return def
+		}
+		return n
+	}
+
+	return StageLimits{
+		Resolve:  fix(l.Resolve, DefaultStageLimits.Resolve),
+		Download: fix(l.Download, DefaultStageLimits.Download),
+		Validate: fix(l.Validate, DefaultStageLimits.Validate),
+		Process:  fix(l.Process, DefaultStageLimits.Process),
+		Store:    fix(l.Store, DefaultStageLimits.Store),
+	}
+}
+
+// pipelineJob is a job on its way through the pipeline. path is the temporary
+// file currently owned by the job, if any. video is the access key of the
+// aweme's video if it is already stored. A job whose result is set is done
+// and passes through the remaining stages.
+type pipelineJob struct {
+	job    *db.Job
+	url    string
+	video  string
+	path   string
+	result string
+}
+
+type pipeline struct {
+	s   *Server
+	ctx context.Context
+	vp  *videoprocessor.VideoProcessor
+
+	errOnce sync.Once
+	err     error
+}
+
+// ProcessJobs runs due jobs through the resolve, download, validate, process
+// and store stages until no more jobs are due.
+func (s *Server) ProcessJobs(ctx context.Context) error {
+	limits := s.Limits.withDefaults()
+	p := &pipeline{
+		s:   s,
+		ctx: ctx,
+		vp:  s.videoProcessor(),
+	}
+
+	claimed := make(chan *pipelineJob)
+	go p.claim(claimed)
+
+	resolved := p.stage(limits.Resolve, claimed, p.resolve)
+	downloaded := p.stage(limits.Download, resolved, p.download)
+	validated := p.stage(limits.Validate, downloaded, p.validate)
+	processed := p.stage(limits.Process, validated, p.process)
+	stored := p.stage(limits.Store, processed, p.store)
+
+	for pj := range stored {
+		p.finish(pj, nil)
+	}
+
+	if p.err != nil {
+		return p.err
+	}
+
+	return ctx.Err()
+}
+
+// claim feeds due jobs into the pipeline. A job is only claimed once the
+// resolve stage is ready to take it.
+func (p *pipeline) claim(out chan<- *pipelineJob) {
+	defer close(out)
+
+	for p.ctx.Err() == nil {
+		job, err := p.s.DB.ClaimJob(time.Now())
+		if err != nil {
+			if err != db.ErrNotFound {
+				p.fail(err)
+			}
+			return
+		}
+
+		out <- &pipelineJob{job: job}
+	}
+}
+
+// stage runs fn on n workers. Jobs that fail leave the pipeline, the others
+// are passed on to the returned channel.
+func (p *pipeline) stage(n int, in <-chan *pipelineJob, fn func(*pipelineJob) error) <-chan *pipelineJob {
+	out := make(chan *pipelineJob)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pj := range in {
+				if err := p.ctx.Err(); err != nil {
+					p.finish(pj, err)
+					continue
+				}
+				if pj.result != "" {
+					out <- pj
+					continue
+				}
+				if err := fn(pj); err != nil {
+					p.finish(pj, err)
+					continue
+				}
+				out <- pj
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+func (p *pipeline) resolve(pj *pipelineJob) error {
+	// A stored video is neither resolved nor downloaded again
+	if access, ok := p.s.storedVideo(pj.job.AwemeID); ok {
+		if pj.job.Kind == db.JobFetch {
+			pj.result = access
+		}
+		pj.video = access
+		return nil
+	}
+
+	url, err := p.s.Fetcher.GetVideoURLContext(p.ctx, pj.job.ShareURL)
+	if err != nil {
+		return err
+	}
+
+	pj.url = url
+	return nil
+}
+
+func (p *pipeline) download(pj *pipelineJob) error {
+	var path string
+	var err error
+	if pj.video != "" {
+		path, err = p.vp.Retrieve(pj.video)
+	} else {
+		// Named by the job, so a retry resumes an interrupted download
+		path, err = p.vp.Download(p.ctx, pj.url, pj.job.ID+".mp4")
+	}
+	if err != nil {
+		return err
+	}
+
+	pj.path = path
+	return nil
+}
+
+// validate rejects downloads that are not a playable video of the aweme.
+// Stored videos were validated when they were fetched.
+func (p *pipeline) validate(pj *pipelineJob) error {
+	if pj.video != "" {
+		return nil
+	}
+
+	var expected time.Duration
+	a, err := p.s.DB.GetAweme(pj.job.AwemeID)
+	if err == nil {
+		expected = time.Duration(a.Video.Duration) * time.Millisecond
+	} else if err != db.ErrNotFound {
+		return err
+	}
+
+	err = p.s.validateVideo(p.ctx, p.vp, pj.path, pj.job.AwemeID, expected)
+	if quarantinedError(err) {
+		// Moved to the quarantine, or removed
+		pj.path = ""
+	}
+
+	return err
+}
+
+func (p *pipeline) process(pj *pipelineJob) error {
+	switch pj.job.Kind {
+	case db.JobFetch:
+	case db.JobRender:
+		commentPath, err := p.vp.FetchComment(pj.job.CommentUsername, pj.job.CommentText, pj.job.ImagePath)
+		if err != nil {
+			return fmt.Errorf("failed to fetch comment: %w", err)
+		}
+
+		// ffmpeg reads what Get returns, a local file or a presigned URL
+		commentFile, err := p.s.CommentStorage.Get(commentPath)
+		if err != nil {
+			return err
+		}
+
+		combined, err := p.vp.Overlay(p.ctx, pj.path, commentFile)
+		if err != nil {
+			return fmt.Errorf("failed to combine video and comment: %w", err)
+		}
+
+		os.Remove(pj.path)
+		pj.path = combined
+
+		// Edit metadata of the result only, fetched videos are stored as
+		// downloaded so content addressed storage finds copies of them
+		return metadata.GenerateMetadataAndWriteToFileContext(p.ctx, pj.path)
+	default:
+		return fmt.Errorf("unknown job kind %q", pj.job.Kind)
+	}
+
+	return nil
+}
+
+func (p *pipeline) store(pj *pipelineJob) error {
+	storage := p.s.VideoStorage
+	if pj.job.Kind == db.JobRender {
+		storage = p.s.ResultStorage
+	}
+
+	access, err := storage.Store(pj.path)
+	if err != nil {
+		return err
+	}
+
+	if pj.job.Kind == db.JobFetch {
+		if err := p.s.linkVideo(pj.job.AwemeID, access); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(pj.path)
+	pj.path = ""
+	pj.result = access
+	return nil
+}
+
+// finish removes the job's temporary file and records its outcome.
+func (p *pipeline) finish(pj *pipelineJob, err error) {
+	if pj.path != "" {
+		os.Remove(pj.path)
+	}
+
+	if err := p.s.finishJob(p.ctx, pj.job, pj.result, err); err != nil {
+		p.fail(err)
+	}
+}
+
+func (p *pipeline) fail(err error) {
+	p.errOnce.Do(func() {
+		p.err = err
+	})
+}
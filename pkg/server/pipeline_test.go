@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+)
+
+func TestFetchStoresDownloadAsIs(t *testing.T) {
+	s, _ := newTestServer(t)
+	p := &pipeline{s: s, ctx: context.Background(), vp: s.videoProcessor()}
+
+	content := []byte("downloaded video")
+
+	// Two awemes whose downloads are the same video
+	var results []string
+	for _, id := range []string{"1", "2"} {
+		path := filepath.Join(t.TempDir(), id+".mp4")
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		pj := &pipelineJob{job: &db.Job{ID: id, Kind: db.JobFetch, AwemeID: id}, path: path}
+		if err := p.process(pj); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.store(pj); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, pj.result)
+	}
+
+	if results[0] != results[1] {
+		t.Errorf("identical downloads were stored as %s and %s", results[0], results[1])
+	}
+
+	f, err := s.VideoStorage.Open(results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stored, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Errorf("stored video %q differs from the download %q", stored, content)
+	}
+}
+
+func TestFetchWithoutAwemeIndex(t *testing.T) {
+	s, _ := newTestServer(t)
+	videos := storer.NewMemStorer()
+	s.VideoStorage = videos
+	p := &pipeline{s: s, ctx: context.Background(), vp: s.videoProcessor()}
+
+	path := filepath.Join(t.TempDir(), "1.mp4")
+	if err := os.WriteFile(path, []byte("downloaded video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pj := &pipelineJob{job: &db.Job{ID: "1", Kind: db.JobFetch, AwemeID: "1"}, path: path}
+	if err := p.store(pj); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("download was not removed after storing: %v", err)
+	}
+
+	infos, err := videos.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Access != pj.result {
+		t.Fatalf("got stored videos %v, want only %s", infos, pj.result)
+	}
+
+	// The storage cannot remember the aweme's video, so it is fetched again
+	if access, ok := s.storedVideo("1"); ok {
+		t.Errorf("got stored video %s from a storage without an aweme index", access)
+	}
+}
@@ -1,36 +1,37 @@
 package server
 
 import (
+	"context"
 	"log"
+	"time"
 
-	lmdb "wellquite.org/golmdb"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
 )
 
-func (s *Server) Update(userID string) error {
-	panic("THIS IS FUCKED UP AND NOT WORKING CORRECTLY")
+// Defaults of a new Server.
+const (
+	DefaultStatsWindow      = 7 * 24 * time.Hour
+	DefaultFullSyncInterval = 7 * 24 * time.Hour
+)
 
+func (s *Server) Update(ctx context.Context, userID string) error {
 	log.Printf("updating user #%s", userID)
 	log.Printf("fetching user data for #%s", userID)
 	// Refresh the user info
-	user, err := s.Scraper.FetchUserData(userID)
+	user, err := s.Provider.FetchUserDataContext(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if err := s.DB.SetUser(userID, user); err != nil {
+	if err := s.recordUser(userID, user); err != nil {
 		return err
 	}
 
-	log.Printf("fetching new awemes for user @%s #%s", user.UniqueID, userID)
-	// Fetch new Awemes
 	awemeList, err := s.DB.GetAwemeList(userID)
 	if err != nil {
-		if err == lmdb.NotFound {
+		if err == db.ErrNotFound {
 			log.Printf("user @%s #%s not found in the database", user.UniqueID, userID)
-			awemeList, err = s.Scraper.FetchUserAwemeList(userID)
-			if err != nil {
-				return err
-			}
-			if err := s.DB.SetAwemeList(userID, awemeList); err != nil {
+			if err := s.fullSync(ctx, userID); err != nil {
 				return err
 			}
 
@@ -40,51 +41,247 @@ func (s *Server) Update(userID string) error {
 		return err
 	}
 
-	minCursor := int64(0)
-	if len(awemeList) > 0 {
-		minCursor = awemeList[len(awemeList)-1].CreateTime
+	// Databases written before the high-water mark existed only have the
+	// aweme list, so derive the mark from it.
+	state, err := s.DB.GetSyncState(userID)
+	if err != nil {
+		if err != db.ErrNotFound {
+			return err
+		}
+		state = newSyncState(awemeList)
 	}
 
-	newAwemes, err := s.Scraper.FetchUserAwemeListAfterCursor(userID, minCursor)
+	// A full sync that was interrupted is finished first, or the awemes
+	// past its cursor would never be fetched. Only full syncs notice deleted
+	// awemes, so one is also run every FullSyncInterval.
+	if state.FullSyncCursor != 0 || s.fullSyncDue(state) {
+		if err := s.fullSync(ctx, userID); err != nil {
+			return err
+		}
+
+		log.Printf("updated user @%s #%s with a full sync", user.UniqueID, userID)
+		return nil
+	}
+
+	log.Printf("fetching recent awemes for user @%s #%s", user.UniqueID, userID)
+	newAwemes, seen, err := s.fetchRecentAwemes(ctx, userID, awemeList, state.HighWaterMark)
 	if err != nil {
 		return err
 	}
 
-	// Append new Awemes to the existing list
-	awemeList = append(awemeList, newAwemes...)
-	if err := s.DB.SetAwemeList(userID, awemeList); err != nil {
+	if err := s.saveAwemes(userID, seen); err != nil {
 		return err
 	}
 
-	log.Printf("updated user @%s #%s", user.UniqueID, userID)
+	newState := newSyncState(append(awemeList, newAwemes...))
+	newState.FullSyncCursor = state.FullSyncCursor
+	newState.FullSyncStart = state.FullSyncStart
+	newState.LastFullSync = state.LastFullSync
+	if err := s.DB.SetSyncState(userID, newState); err != nil {
+		return err
+	}
+
+	log.Printf("updated user @%s #%s with %d new awemes, %d seen", user.UniqueID, userID, len(newAwemes), len(seen))
 
 	return nil
 }
 
-func (s *Server) FullUpdate(userID string) error {
+func (s *Server) FullUpdate(ctx context.Context, userID string) error {
 	log.Printf("performing full update for user #%s", userID)
 	// Refresh the user info
-	user, err := s.Scraper.FetchUserData(userID)
+	user, err := s.Provider.FetchUserDataContext(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if err := s.DB.SetUser(userID, user); err != nil {
+	if err := s.recordUser(userID, user); err != nil {
 		return err
 	}
 
-	// Refetch all Awemes
-	awemeList, err := s.Scraper.FetchUserAwemeList(userID)
-	if err != nil {
+	if err := s.fullSync(ctx, userID); err != nil {
 		return err
 	}
 
-	log.Printf("awemes: +%v", awemeList)
+	log.Printf("performed full update for user @%s #%s", user.UniqueID, userID)
+
+	return nil
+}
 
-	if err := s.DB.SetAwemeList(userID, awemeList); err != nil {
+// recordUser stores the refreshed user info and logs how the profile changed
+// since the last sync.
+func (s *Server) recordUser(userID string, user *tiktok.User) error {
+	changes, err := s.DB.RecordUser(time.Now(), userID, user)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("performed full update for user @%s #%s", user.UniqueID, userID)
+	for _, c := range changes {
+		switch c.Field {
+		case "UniqueID":
+			log.Printf("user #%s was renamed from @%s to @%s", userID, c.Old, c.New)
+		default:
+			log.Printf("user @%s #%s changed %s from %q to %q", user.UniqueID, userID, c.Field, c.Old, c.New)
+		}
+	}
 
 	return nil
 }
+
+// fullSync refetches every aweme of the user and resets the high-water mark.
+// Progress is saved after every page, so a full sync that fails part way
+// resumes where it stopped the next time. Stored awemes the full sync did not
+// see are tombstoned as missing once it completes.
+func (s *Server) fullSync(ctx context.Context, userID string) error {
+	state, err := s.DB.GetSyncState(userID)
+	if err != nil {
+		if err != db.ErrNotFound {
+			return err
+		}
+		state = &db.SyncState{}
+	}
+
+	if state.FullSyncCursor != 0 {
+		log.Printf("resuming full sync of user #%s from cursor %d", userID, state.FullSyncCursor)
+	} else {
+		state.FullSyncStart = time.Now().Unix()
+	}
+
+	var page []tiktok.Aweme
+	it := tiktok.NewFeedIterator(ctx, s.Provider, userID, state.FullSyncCursor)
+	for it.Next() {
+		page = append(page, *it.Aweme())
+		if !it.EndOfPage() {
+			continue
+		}
+
+		if err := s.saveAwemes(userID, page); err != nil {
+			return err
+		}
+		page = nil
+
+		state.FullSyncCursor = it.MaxCursor()
+		if err := s.DB.SetSyncState(userID, state); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	if err := s.saveAwemes(userID, page); err != nil {
+		return err
+	}
+
+	// A full sync resumed from a state written before FullSyncStart existed
+	// cannot tell which awemes it saw.
+	if state.FullSyncStart != 0 {
+		missing, err := s.DB.MarkMissing(time.Now(), userID, time.Unix(state.FullSyncStart, 0))
+		if err != nil {
+			return err
+		}
+		logTombstones(missing)
+	}
+
+	awemeList, err := s.DB.GetAwemeList(userID)
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+
+	newState := newSyncState(awemeList)
+	newState.LastFullSync = time.Now().Unix()
+	return s.DB.SetSyncState(userID, newState)
+}
+
+// fullSyncDue reports whether the last full sync is older than
+// FullSyncInterval. States written before LastFullSync existed are due.
+func (s *Server) fullSyncDue(state *db.SyncState) bool {
+	if s.FullSyncInterval <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(state.LastFullSync, 0)) >= s.FullSyncInterval
+}
+
+// saveAwemes stores awemes fetched from the user's feed and a statistics
+// snapshot of them.
+func (s *Server) saveAwemes(userID string, awemes []tiktok.Aweme) error {
+	now := time.Now()
+
+	restricted, err := s.DB.PutAwemes(now, userID, awemes)
+	if err != nil {
+		return err
+	}
+	logTombstones(restricted)
+
+	return s.DB.AppendStats(now, awemes)
+}
+
+func logTombstones(tombstones []db.Tombstone) {
+	for _, t := range tombstones {
+		log.Printf("aweme #%s of user #%s was removed: %s", t.AwemeID, t.UserID, t.Reason)
+	}
+}
+
+// fetchRecentAwemes pages through the user's feed until it has seen every
+// aweme newer than the high-water mark or created within StatsWindow, and
+// returns the new awemes and every aweme it saw, so their statistics can be
+// snapshot. Pinned awemes are skipped over rather than treated as the end of
+// the new ones.
+func (s *Server) fetchRecentAwemes(ctx context.Context, userID string, known []tiktok.Aweme, highWaterMark int64) (newAwemes, seen []tiktok.Aweme, err error) {
+	knownIDs := make(map[string]bool, len(known))
+	for _, a := range known {
+		knownIDs[a.AwemeID] = true
+	}
+	seenIDs := make(map[string]bool)
+	windowStart := time.Now().Add(-s.StatsWindow).Unix()
+
+	// The rest of the page the window ends on is kept too, since it has been
+	// fetched anyway.
+	done := false
+	it := tiktok.NewFeedIterator(ctx, s.Provider, userID, 0)
+	for it.Next() {
+		a := it.Aweme()
+		if !seenIDs[a.AwemeID] {
+			seen = append(seen, *a)
+			seenIDs[a.AwemeID] = true
+		}
+
+		switch {
+		case knownIDs[a.AwemeID]:
+		case it.IsPinned() || a.CreateTime > highWaterMark:
+			newAwemes = append(newAwemes, *a)
+			knownIDs[a.AwemeID] = true
+		}
+
+		if !it.IsPinned() && a.CreateTime <= highWaterMark && a.CreateTime < windowStart {
+			done = true
+		}
+		if done && it.EndOfPage() {
+			break
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return newAwemes, seen, nil
+}
+
+// newSyncState computes the high-water mark of an aweme list, ignoring awemes
+// flagged as pinned.
+func newSyncState(awemeList []tiktok.Aweme) *db.SyncState {
+	state := &db.SyncState{
+		LastSync: time.Now().Unix(),
+	}
+
+	for _, a := range awemeList {
+		if a.IsTop != 0 {
+			continue
+		}
+		if a.CreateTime > state.HighWaterMark {
+			state.HighWaterMark = a.CreateTime
+			state.NewestAwemeID = a.AwemeID
+		}
+	}
+
+	return state
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"path"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/faketiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/scraperapi"
+)
+
+// editFeed rewrites the fake user's feed page at cursor with fn. The fixtures
+// of fake are replaced by an in-memory copy the first time.
+func editFeed(t *testing.T, fake *faketiktok.Server, cursor string, fn func(chunk *scraperapi.FeedChunk)) {
+	t.Helper()
+
+	fixtures, ok := fake.Fixtures.(fstest.MapFS)
+	if !ok {
+		fixtures = fstest.MapFS{}
+		err := fs.WalkDir(fake.Fixtures, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := fs.ReadFile(fake.Fixtures, name)
+			if err != nil {
+				return err
+			}
+			fixtures[name] = &fstest.MapFile{Data: data}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.Fixtures = fixtures
+	}
+
+	name := path.Join("feeds", fakeUserID, cursor+".json")
+	var response scraperapi.UserFeedResponse
+	if err := json.Unmarshal(fixtures[name].Data, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	fn(&response.Data)
+
+	data, err := json.Marshal(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures[name] = &fstest.MapFile{Data: data}
+}
+
+// awemeIDs returns the IDs of the awemes stored for the fake user.
+func awemeIDs(t *testing.T, s *Server) map[string]bool {
+	t.Helper()
+
+	list, err := s.DB.GetAwemeList(fakeUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool, len(list))
+	for _, a := range list {
+		ids[a.AwemeID] = true
+	}
+	return ids
+}
+
+func TestUpdateResumesFullSync(t *testing.T) {
+	s, fake := newTestServer(t)
+	ctx := context.Background()
+
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+	if ids := awemeIDs(t, s); len(ids) != 5 {
+		t.Fatalf("got %d awemes after the first update, want 5", len(ids))
+	}
+
+	// An old aweme only a full sync reaches
+	editFeed(t, fake, "1680000000000", func(chunk *scraperapi.FeedChunk) {
+		a := chunk.AwemeList[0]
+		a.AwemeID = "7220000000000000009"
+		a.CreateTime = 1679400000
+		chunk.AwemeList = append(chunk.AwemeList, a)
+	})
+
+	// A full sync that stopped after the first page
+	state, err := s.DB.GetSyncState(fakeUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.FullSyncCursor = 1680000000000
+	state.FullSyncStart = time.Now().Unix()
+	if err := s.DB.SetSyncState(fakeUserID, state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := awemeIDs(t, s); !ids["7220000000000000009"] {
+		t.Errorf("resumed full sync did not store the aweme past its cursor, got %v", ids)
+	}
+
+	state, err = s.DB.GetSyncState(fakeUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.FullSyncCursor != 0 || state.FullSyncStart != 0 {
+		t.Errorf("got full sync cursor %d started at %d after it completed, want none", state.FullSyncCursor, state.FullSyncStart)
+	}
+	if state.HighWaterMark != 1681200000 {
+		t.Errorf("got high-water mark %d, want 1681200000", state.HighWaterMark)
+	}
+}
+
+// latestDiggs returns the digg count of the latest statistics snapshot of
+// each aweme. Snapshots are keyed by the second, so the test tells them apart
+// by their counts.
+func latestDiggs(t *testing.T, s *Server, ids []string) map[string]int {
+	t.Helper()
+
+	diggs := make(map[string]int, len(ids))
+	for _, id := range ids {
+		series, err := s.DB.GetStatsSeries(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(series) == 0 {
+			t.Fatalf("aweme %s has no statistics", id)
+		}
+		diggs[id] = series[len(series)-1].DiggCount
+	}
+	return diggs
+}
+
+// setDiggs sets the digg count of every aweme in the fake user's feed.
+func setDiggs(t *testing.T, fake *faketiktok.Server, diggs int) {
+	t.Helper()
+
+	for _, cursor := range []string{"0", "1680000000000"} {
+		editFeed(t, fake, cursor, func(chunk *scraperapi.FeedChunk) {
+			for i := range chunk.AwemeList {
+				chunk.AwemeList[i].Statistics.DiggCount = diggs
+			}
+		})
+	}
+}
+
+func TestUpdateSnapshotsRecentAwemes(t *testing.T) {
+	s, fake := newTestServer(t)
+	ctx := context.Background()
+
+	ids := []string{
+		"7210000000000000001",
+		"7220000000000000005",
+		"7220000000000000004",
+		"7220000000000000003",
+		"7220000000000000002",
+	}
+
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The window ends on the first page, which is snapshot whole
+	setDiggs(t, fake, 1000)
+	s.StatsWindow = time.Since(time.Unix(1680800000, 0))
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	got := latestDiggs(t, s, ids)
+	for _, id := range ids[:4] {
+		if got[id] != 1000 {
+			t.Errorf("aweme %s on the first page was not snapshot, got %d diggs", id, got[id])
+		}
+	}
+	if got[ids[4]] == 1000 {
+		t.Errorf("aweme %s past the window was snapshot", ids[4])
+	}
+
+	// A window reaching the second page snapshots it too
+	setDiggs(t, fake, 2000)
+	s.StatsWindow = time.Since(time.Unix(1679000000, 0))
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	got = latestDiggs(t, s, ids)
+	for _, id := range ids {
+		if got[id] != 2000 {
+			t.Errorf("aweme %s in the window was not snapshot, got %d diggs", id, got[id])
+		}
+	}
+}
+
+func TestUpdateNoticesDeletions(t *testing.T) {
+	s, fake := newTestServer(t)
+	ctx := context.Background()
+
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Last seen before the next update starts, which is only told apart by
+	// the second
+	deleted, err := s.DB.GetAweme("7220000000000000004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.PutAwemes(time.Now().Add(-time.Hour), fakeUserID, []tiktok.Aweme{*deleted}); err != nil {
+		t.Fatal(err)
+	}
+
+	editFeed(t, fake, "0", func(chunk *scraperapi.FeedChunk) {
+		var kept []scraperapi.Aweme
+		for _, a := range chunk.AwemeList {
+			if a.AwemeID != deleted.AwemeID {
+				kept = append(kept, a)
+			}
+		}
+		chunk.AwemeList = kept
+	})
+
+	// The full sync of the first update is recent
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.GetTombstone(deleted.AwemeID); err != db.ErrNotFound {
+		t.Fatalf("got tombstone error %v before a full sync was due, want db.ErrNotFound", err)
+	}
+
+	s.FullSyncInterval = time.Nanosecond
+	if err := s.Update(ctx, fakeUserID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.GetTombstone(deleted.AwemeID); err != nil {
+		t.Fatalf("deleted aweme was not tombstoned by the periodic full sync: %v", err)
+	}
+
+	state, err := s.DB.GetSyncState(fakeUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(time.Unix(state.LastFullSync, 0)) > time.Minute {
+		t.Errorf("got last full sync at %d, want now", state.LastFullSync)
+	}
+}
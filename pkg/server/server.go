@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -13,36 +15,70 @@ import (
 	"github.com/bjornpagen/tiktok-video-processor/pkg/metadata"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/server/db"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/fetcherapi"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/scraperapi"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/videoprocessor"
-
-	lmdb "wellquite.org/golmdb"
 )
 
 type Server struct {
 	DB             *db.TikTokDB
-	Scraper        *scraperapi.Scraper
+	Provider       tiktok.Provider
 	Fetcher        *fetcherapi.Fetcher
 	VideoStorage   storer.Storer
 	CommentStorage storer.Storer
 	ResultStorage  storer.Storer
+	Limits         StageLimits
+
+	// StatsWindow is how far back Update refetches awemes to snapshot their
+	// statistics, besides the new ones. Older awemes are only refreshed by
+	// full syncs.
+	StatsWindow time.Duration
+
+	// FullSyncInterval is how often Update refetches the whole feed instead
+	// of the recent awemes, which is how deleted awemes are noticed. Zero
+	// disables periodic full syncs.
+	FullSyncInterval time.Duration
+
+	// QuarantineDir is where downloaded videos that fail validation are
+	// kept for inspection, instead of being stored.
+	QuarantineDir string
+
+	// Addr is the address the management API listens on. It is disabled if
+	// empty.
+	Addr string
+
+	// BackupDir is where database snapshots are written every
+	// BackupInterval, keeping the newest BackupKeep. Scheduled backups are
+	// disabled if BackupDir is empty.
+	BackupDir      string
+	BackupInterval time.Duration
+	BackupKeep     int
+
+	wake chan struct{}
 }
 
 func New(dbPath, outPath, fetcherApiKey, scraperApiKey string) *Server {
 	return &Server{
-		DB:             db.New(dbPath),
-		Scraper:        scraperapi.New(scraperApiKey),
-		Fetcher:        fetcherapi.New(fetcherApiKey),
-		VideoStorage:   storer.NewLocalStorer(filepath.Join(outPath, "videos")),
-		CommentStorage: storer.NewLocalStorer(filepath.Join(outPath, "comments")),
-		ResultStorage:  storer.NewLocalStorer(filepath.Join(outPath, "results")),
+		DB:               db.New(dbPath),
+		Provider:         scraperapi.New(scraperApiKey),
+		Fetcher:          fetcherapi.New(fetcherApiKey),
+		VideoStorage:     storer.NewCASStorer(filepath.Join(outPath, "videos")),
+		CommentStorage:   storer.NewLocalStorer(filepath.Join(outPath, "comments")),
+		ResultStorage:    storer.NewLocalStorer(filepath.Join(outPath, "results")),
+		Limits:           DefaultStageLimits,
+		StatsWindow:      DefaultStatsWindow,
+		FullSyncInterval: DefaultFullSyncInterval,
+		QuarantineDir:    filepath.Join(outPath, "quarantine"),
+		BackupInterval:   24 * time.Hour,
+		BackupKeep:       DefaultBackupKeep,
+		wake:             make(chan struct{}, 1),
 	}
 }
 
-func (s *Server) AddUsername(username string) error {
+func (s *Server) AddUsername(ctx context.Context, username string) error {
 	log.Printf("adding @%s to the database", username)
-	userId, err := s.Scraper.FetchUserId(username)
+	userId, err := s.Provider.FetchUserIdContext(ctx, username)
 	if err != nil {
 		return err
 	}
@@ -50,14 +86,15 @@ func (s *Server) AddUsername(username string) error {
 	// Fetch current userIds, append the new one
 	userIds, err := s.DB.GetUserIDList()
 	if err != nil {
-		// if MDB_NOTFOUND, then create a new list
-		if err == lmdb.NotFound {
+		// if not found, then create a new list
+		if err == db.ErrNotFound {
 			userIds = []string{userId}
 			if err := s.DB.SetUserIDList(userIds); err != nil {
 				return err
 			}
 			return nil
 		}
+		return err
 	}
 
 	// Check if the userId already exists
@@ -78,8 +115,8 @@ func (s *Server) AddUsername(username string) error {
 	return nil
 }
 
-func (s *Server) RemoveUsername(username string) error {
-	userId, err := s.Scraper.FetchUserId(username)
+func (s *Server) RemoveUsername(ctx context.Context, username string) error {
+	userId, err := s.Provider.FetchUserIdContext(ctx, username)
 	if err != nil {
 		return err
 	}
@@ -113,22 +150,64 @@ func (s *Server) Run() error {
 	}
 	defer s.DB.Close()
 
+	// Resume jobs that were interrupted by the last shutdown
+	n, err := s.DB.RequeueRunningJobs(time.Now())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("requeued %d interrupted jobs", n)
+	}
+
 	// Run the server
 	return s.runWithSignalHandling()
 }
 
 func (s *Server) runWithSignalHandling() error {
-	// Create a channel to listen for os signals
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	// Cancel the context on os signals, so in-flight downloads and ffmpeg
+	// jobs are stopped and cleaned up before the database is closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Work through the job queue in the background, until updates stop
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	wg.Add(1)
 	go func() {
-		<-signalChan
-		log.Println("received an interrupt signal, stopping updates...")
-		os.Exit(0)
+		defer wg.Done()
+		if err := s.RunJobs(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("job queue stopped: %s", err)
+		}
 	}()
 
-	if err := s.UpdateAllDaily(); err != nil {
+	if s.Addr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.ListenAndServe(ctx); err != nil {
+				log.Printf("management API stopped: %s", err)
+			}
+		}()
+	}
+
+	if s.BackupDir != "" && s.BackupInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.RunBackups(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("scheduled backups stopped: %s", err)
+			}
+		}()
+	}
+
+	if err := s.UpdateAllDaily(ctx); err != nil {
+		if ctx.Err() != nil {
+			log.Println("received an interrupt signal, stopped updates")
+			return nil
+		}
 		log.Printf("update failed: %s", err)
 		return err
 	}
@@ -136,21 +215,25 @@ func (s *Server) runWithSignalHandling() error {
 	return nil
 }
 
-func (s *Server) UpdateAllDaily() error {
+func (s *Server) UpdateAllDaily(ctx context.Context) error {
 	ticker := time.NewTicker(24 * time.Hour)
 	defer ticker.Stop()
 
 	for {
-		if err := s.UpdateAllOnce(); err != nil {
+		if err := s.UpdateAllOnce(ctx); err != nil {
 			return err
 		}
 
 		// Wait for the next tick
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
-func (s *Server) UpdateAllOnce() error {
+func (s *Server) UpdateAllOnce(ctx context.Context) error {
 	// Fetch all the userIds
 	ids, err := s.DB.GetUserIDList()
 	if err != nil {
@@ -159,7 +242,7 @@ func (s *Server) UpdateAllOnce() error {
 
 	// For all users, update them
 	for _, userID := range ids {
-		if err := s.FullUpdate(userID); err != nil {
+		if err := s.Update(ctx, userID); err != nil {
 			return err
 		}
 	}
@@ -167,15 +250,15 @@ func (s *Server) UpdateAllOnce() error {
 	return nil
 }
 
-func (s *Server) GenerateCommentedVideo(a *scraperapi.Aweme, commentUsername, commentText, imagePath string) (string, error) {
-	dlUrl, err := s.Fetcher.GetVideoURL(a.ShareURL)
+func (s *Server) GenerateCommentedVideo(ctx context.Context, a *tiktok.Aweme, commentUsername, commentText, imagePath string) (string, error) {
+	videoPath, err := s.FetchVideo(ctx, a)
 	if err != nil {
 		return "", err
 	}
 
-	vp := videoprocessor.New(s.VideoStorage, s.CommentStorage, s.ResultStorage)
-	videoPath, err := vp.FetchVideo(dlUrl)
-	if err != nil {
+	vp := s.videoProcessor()
+
+	if err := ctx.Err(); err != nil {
 		return "", err
 	}
 
@@ -191,36 +274,123 @@ func (s *Server) GenerateCommentedVideo(a *scraperapi.Aweme, commentUsername, co
 		return "", fmt.Errorf("failed to fetch comment: %w", err)
 	}
 
+	// ffmpeg reads what Get returns, a local file or a presigned URL
+	videoFile, err := s.VideoStorage.Get(videoPath)
+	if err != nil {
+		return "", err
+	}
+	commentFile, err := s.CommentStorage.Get(commentPath)
+	if err != nil {
+		return "", err
+	}
+
 	// Combine the video and comment
-	finalPath, err := vp.Combine(videoPath, commentPath)
+	combined, err := vp.Overlay(ctx, videoFile, commentFile)
 	if err != nil {
 		return "", fmt.Errorf("failed to combine video and comment: %w", err)
 	}
+	defer os.Remove(combined)
 
-	// Edit metadata
-	metadata.GenerateMetadataAndWriteToFile(finalPath)
+	// Edit metadata before storing, the stored file may not be local
+	if err := metadata.GenerateMetadataAndWriteToFileContext(ctx, combined); err != nil {
+		return "", err
+	}
+
+	return s.ResultStorage.Store(combined)
+}
+
+// UseS3 stores videos, comments and results in an S3-compatible bucket, each
+// under its own prefix, instead of on the local disk.
+func (s *Server) UseS3(config storer.S3Config) error {
+	storages := []struct {
+		storage *storer.Storer
+		prefix  string
+	}{
+		{&s.VideoStorage, "videos/"},
+		{&s.CommentStorage, "comments/"},
+		{&s.ResultStorage, "results/"},
+	}
 
-	return finalPath, nil
+	for _, st := range storages {
+		s3, err := storer.NewS3Storer(config, st.prefix)
+		if err != nil {
+			return err
+		}
+		*st.storage = s3
+	}
+
+	return nil
 }
 
-func (s *Server) FetchVideo(a *scraperapi.Aweme) (string, error) {
-	dlUrl, err := s.Fetcher.GetVideoURL(a.ShareURL)
+// FetchVideo stores the video of the aweme and returns its access key. A
+// video that is already stored is not fetched again. The video is stored as
+// downloaded, so content addressed storage finds copies of it; its metadata
+// is only rewritten in the results made from it.
+func (s *Server) FetchVideo(ctx context.Context, a *tiktok.Aweme) (string, error) {
+	if access, ok := s.storedVideo(a.AwemeID); ok {
+		return access, nil
+	}
+
+	dlUrl, err := s.Fetcher.GetVideoURLContext(ctx, a.ShareURL)
 	if err != nil {
 		return "", err
 	}
 
-	vp := videoprocessor.New(s.VideoStorage, s.CommentStorage, s.ResultStorage)
-	videoPath, err := vp.FetchVideo(dlUrl)
+	vp := s.videoProcessor()
+	tmpPath, err := vp.Download(ctx, dlUrl, "video-"+a.AwemeID+".mp4")
 	if err != nil {
 		return "", err
 	}
+	defer os.Remove(tmpPath)
+
+	expected := time.Duration(a.Video.Duration) * time.Millisecond
+	if err := s.validateVideo(ctx, vp, tmpPath, a.AwemeID, expected); err != nil {
+		return "", err
+	}
 
-	// Edit metadata
-	metadata.GenerateMetadataAndWriteToFile(videoPath)
+	videoPath, err := s.VideoStorage.Store(tmpPath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.linkVideo(a.AwemeID, videoPath); err != nil {
+		return "", err
+	}
 
 	return videoPath, nil
 }
 
+// storedVideo returns the access key of the aweme's video if the video
+// storage remembers it.
+func (s *Server) storedVideo(awemeID string) (string, bool) {
+	index, ok := s.VideoStorage.(storer.AwemeIndex)
+	if !ok {
+		return "", false
+	}
+
+	access, err := index.LookupAweme(awemeID)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to look up the stored video of %s: %s", awemeID, err)
+		}
+		return "", false
+	}
+
+	return access, true
+}
+
+// linkVideo records that access holds the aweme's video, if the video storage
+// can remember it.
+func (s *Server) linkVideo(awemeID, access string) error {
+	index, ok := s.VideoStorage.(storer.AwemeIndex)
+	if !ok {
+		return nil
+	}
+	return index.LinkAweme(awemeID, access)
+}
+
+// FetchAllVideos queues a fetch job for each aweme of the user and wakes
+// RunJobs to process them.
 func (s *Server) FetchAllVideos(userID string) error {
 	// Fetch all the awemes for the user
 	awemes, err := s.DB.GetAwemeList(userID)
@@ -228,19 +398,52 @@ func (s *Server) FetchAllVideos(userID string) error {
 		return err
 	}
 
-	// Let's do it concurrently instead.
-	var wg sync.WaitGroup
-	for _, a := range awemes {
-		wg.Add(1)
-		go func(a scraperapi.Aweme) {
-			defer wg.Done()
-			_, err := s.FetchVideo(&a)
-			if err != nil {
-				log.Printf("failed to fetch video: %s", err)
-			}
-		}(a)
+	// Queue a fetch job per aweme, so failures are recorded and retried.
+	// Removed awemes cannot be fetched anymore, whatever media was stored
+	// for them is kept.
+	for i := range awemes {
+		if _, err := s.DB.GetTombstone(awemes[i].AwemeID); err == nil {
+			continue
+		} else if err != db.ErrNotFound {
+			return err
+		}
+
+		if err := s.EnqueueFetch(userID, &awemes[i]); err != nil {
+			return err
+		}
 	}
-	wg.Wait()
 
+	s.wakeJobs()
 	return nil
 }
+
+func (s *Server) videoProcessor() *videoprocessor.VideoProcessor {
+	vp := videoprocessor.New(s.VideoStorage, s.CommentStorage, s.ResultStorage)
+	vp.QuarantinePath = s.QuarantineDir
+	return vp
+}
+
+// validateVideo checks a downloaded video of the aweme. A video that is not
+// playable or is corrupt is moved to the quarantine, and the returned error
+// says where. It is removed if it cannot be quarantined.
+func (s *Server) validateVideo(ctx context.Context, vp *videoprocessor.VideoProcessor, videoPath, awemeID string, expected time.Duration) error {
+	err := vp.Validate(ctx, videoPath, expected)
+	if !quarantinedError(err) {
+		return err
+	}
+
+	quarantined, qErr := vp.Quarantine(videoPath, awemeID+filepath.Ext(videoPath))
+	if qErr != nil {
+		os.Remove(videoPath)
+		return fmt.Errorf("%w (failed to quarantine: %s)", err, qErr)
+	}
+
+	log.Printf("quarantined video of aweme %s as %s: %s", awemeID, quarantined, err)
+	return fmt.Errorf("%w (quarantined as %s)", err, quarantined)
+}
+
+// quarantinedError reports whether validateVideo moved the video that failed
+// with err out of the way.
+func quarantinedError(err error) bool {
+	return errors.Is(err, videoprocessor.ErrInvalidVideo) || errors.Is(err, videoprocessor.ErrCorruptVideo)
+}
@@ -0,0 +1,184 @@
+package storer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AwemeIndex is implemented by storers that remember which stored file holds
+// the video of an aweme, so it is not fetched again.
+type AwemeIndex interface {
+	// LookupAweme returns the access key of the aweme's video, or an error
+	// wrapping os.ErrNotExist if it is not stored.
+	LookupAweme(awemeID string) (access string, err error)
+	// LinkAweme records that access holds the aweme's video.
+	LinkAweme(awemeID, access string) error
+}
+
+// CASStorer is a content-addressed storer. Files are stored once, named by
+// the SHA-256 of their content, so storing the same video again returns the
+// access key of the existing copy. It is laid out as:
+//
+//	blobs/{first 2 hex digits}/{sha256 hex}{ext}  stored files
+//	refs/{aweme ID}                               access key of the aweme's video
+type CASStorer struct {
+	Path string
+}
+
+func NewCASStorer(path string) *CASStorer {
+	return &CASStorer{
+		Path: path,
+	}
+}
+
+func (cs *CASStorer) Store(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return cs.Put(file, f)
+}
+
+func (cs *CASStorer) Get(access string) (string, error) {
+	// Blobs are local files, so the access key is the path
+	return access, nil
+}
+
+// Put stores what r reads as a blob named by its SHA-256 and the extension of
+// name. The content is hashed while it is written to a temporary file, which
+// is renamed to the blob, or dropped if the blob exists.
+func (cs *CASStorer) Put(name string, r io.Reader) (string, error) {
+	blobsPath := filepath.Join(cs.Path, "blobs")
+	if err := os.MkdirAll(blobsPath, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	tmpPath := filepath.Join(blobsPath, fmt.Sprintf("%d.tmp", time.Now().UnixNano()))
+	defer os.Remove(tmpPath)
+
+	h := sha256.New()
+	if err := copyTo(tmpPath, io.TeeReader(r, h)); err != nil {
+		return "", err
+	}
+
+	blob := hex.EncodeToString(h.Sum(nil)) + strings.ToLower(filepath.Ext(name))
+	dstPath := filepath.Join(blobsPath, blob[:2], blob)
+
+	// Already stored, content addressing makes it the same file
+	if _, err := os.Stat(dstPath); err == nil {
+		return dstPath, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		return "", err
+	}
+
+	return dstPath, nil
+}
+
+func (cs *CASStorer) Open(access string) (io.ReadCloser, error) {
+	if err := cs.check(access); err != nil {
+		return nil, err
+	}
+	return os.Open(access)
+}
+
+func (cs *CASStorer) Stat(access string) (*Info, error) {
+	if err := cs.check(access); err != nil {
+		return nil, err
+	}
+	return statFile(access)
+}
+
+// List returns the blobs whose name, the SHA-256 hex of their content, starts
+// with prefix.
+func (cs *CASStorer) List(prefix string) ([]Info, error) {
+	var infos []Info
+
+	err := filepath.WalkDir(filepath.Join(cs.Path, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isTemp(d.Name()) || !strings.HasPrefix(d.Name(), prefix) {
+			return nil
+		}
+
+		info, err := statFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		infos = append(infos, *info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortInfos(infos)
+	return infos, nil
+}
+
+// Delete removes a blob. Refs to it are dropped when they are looked up.
+func (cs *CASStorer) Delete(access string) error {
+	if err := cs.check(access); err != nil {
+		return err
+	}
+	return os.Remove(access)
+}
+
+func (cs *CASStorer) check(access string) error {
+	return checkWithin(filepath.Join(cs.Path, "blobs"), access)
+}
+
+func (cs *CASStorer) refPath(awemeID string) (string, error) {
+	if awemeID == "" || strings.ContainsAny(awemeID, `/\`) || awemeID == "." || awemeID == ".." {
+		return "", fmt.Errorf("invalid aweme ID %q", awemeID)
+	}
+	return filepath.Join(cs.Path, "refs", awemeID), nil
+}
+
+func (cs *CASStorer) LookupAweme(awemeID string) (string, error) {
+	refPath, err := cs.refPath(awemeID)
+	if err != nil {
+		return "", err
+	}
+
+	access, err := os.ReadFile(refPath)
+	if err != nil {
+		return "", err
+	}
+
+	// The ref is stale if the blob was removed
+	if _, err := os.Stat(string(access)); err != nil {
+		return "", err
+	}
+
+	return string(access), nil
+}
+
+func (cs *CASStorer) LinkAweme(awemeID, access string) error {
+	refPath, err := cs.refPath(awemeID)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(refPath, strings.NewReader(access), 0)
+}
@@ -0,0 +1,198 @@
+package storer_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+)
+
+func TestCASPut(t *testing.T) {
+	cs := storer.NewCASStorer(t.TempDir())
+
+	a, err := cs.Put("/tmp/a.MP4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256("video")
+	const sum = "0cab1c9617404faf2b24e221e189ca5945813e14d3f766345b09ca13bbe28ffc"
+	if want := filepath.Join(cs.Path, "blobs", sum[:2], sum+".mp4"); a != want {
+		t.Errorf("got access key %s, want %s", a, want)
+	}
+
+	// The same content under another name is the same blob
+	b, err := cs.Put("/tmp/b.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != a {
+		t.Errorf("stored identical content as %s and %s", a, b)
+	}
+
+	c, err := cs.Put("/tmp/c.mp4", strings.NewReader("other video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == a {
+		t.Error("stored different content as the same blob")
+	}
+
+	r, err := cs.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "video" {
+		t.Errorf("got content %q, want \"video\"", data)
+	}
+
+	// No temporary files are left behind
+	infos, err := cs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Errorf("got %d blobs, want 2", len(infos))
+	}
+	tmps, err := filepath.Glob(filepath.Join(cs.Path, "blobs", "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) != 0 {
+		t.Errorf("left temporary files %v", tmps)
+	}
+}
+
+func TestCASList(t *testing.T) {
+	cs := storer.NewCASStorer(t.TempDir())
+
+	if infos, err := cs.List(""); err != nil || len(infos) != 0 {
+		t.Fatalf("got %v and error %v listing an empty storer, want nothing", infos, err)
+	}
+
+	var want []string
+	for _, content := range []string{"a", "b", "c"} {
+		access, err := cs.Put("video.mp4", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, access)
+	}
+	if err := cs.LinkAweme("7220000000000000001", want[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refs are not listed, only blobs
+	infos, err := cs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("got %d files, want the %d blobs", len(infos), len(want))
+	}
+	for i, info := range infos {
+		if strings.Contains(info.Access, "refs") {
+			t.Errorf("listed the ref %s", info.Access)
+		}
+		if i > 0 && infos[i-1].Access >= info.Access {
+			t.Errorf("listed %s before %s", infos[i-1].Access, info.Access)
+		}
+		if info.Size != 1 {
+			t.Errorf("%s: got size %d, want 1", info.Access, info.Size)
+		}
+	}
+
+	// The prefix matches the hex digest; "ca978112..." is sha256("a")
+	infos, err = cs.List("ca97")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Access != want[0] {
+		t.Errorf("got %v for prefix ca97, want %s", infos, want[0])
+	}
+}
+
+func TestCASDelete(t *testing.T) {
+	cs := storer.NewCASStorer(t.TempDir())
+
+	access, err := cs.Put("video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Stat(access); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.Delete(access); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Stat(access); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v for a deleted blob, want fs.ErrNotExist", err)
+	}
+	if err := cs.Delete(access); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v deleting twice, want fs.ErrNotExist", err)
+	}
+
+	// Files outside the storer cannot be deleted through it
+	outside := filepath.Join(t.TempDir(), "outside.mp4")
+	if err := os.WriteFile(outside, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Delete(outside); err == nil {
+		t.Error("deleted a file outside the storer")
+	}
+	if err := cs.Delete(filepath.Join(cs.Path, "blobs", "..", "..", "outside.mp4")); err == nil {
+		t.Error("deleted a file outside the storer")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the storer is gone: %v", err)
+	}
+}
+
+func TestCASAwemeIndex(t *testing.T) {
+	cs := storer.NewCASStorer(t.TempDir())
+	const awemeID = "7220000000000000001"
+
+	if _, err := cs.LookupAweme(awemeID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v looking up an unlinked aweme, want fs.ErrNotExist", err)
+	}
+
+	access, err := cs.Put("video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.LinkAweme(awemeID, access); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cs.LookupAweme(awemeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != access {
+		t.Errorf("got access key %q, want %q", got, access)
+	}
+
+	// A ref to a deleted blob is stale
+	if err := cs.Delete(access); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.LookupAweme(awemeID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v looking up a deleted video, want fs.ErrNotExist", err)
+	}
+
+	for _, id := range []string{"", ".", "..", "../x", `a\b`} {
+		if err := cs.LinkAweme(id, access); err == nil {
+			t.Errorf("linked the invalid aweme ID %q", id)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+// Package fakes3 is an in-process stand-in for an S3-compatible server. It
+// keeps objects in memory and checks request signatures, so S3Storer can run
+// end to end without a cloud account.
+//
+// It speaks the path-style subset of the S3 API that S3Storer uses: object
+// PUT, GET, HEAD and DELETE, ListObjectsV2, and multipart uploads.
+package fakes3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+)
+
+const (
+	AccessKey = "fake-access-key"
+	SecretKey = "fake-secret-key"
+	Region    = "us-east-1"
+)
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+type upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+type Server struct {
+	*httptest.Server
+	// MinPartSize is the smallest part accepted, except for the last one
+	MinPartSize int
+	// MaxKeys is the most keys a list response holds
+	MaxKeys int
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*object
+	uploads  map[string]*upload
+	nextID   int
+	requests map[string]int
+}
+
+// New starts a fake S3 server with the given buckets. Call Close when done.
+func New(buckets ...string) *Server {
+	s := &Server{
+		MinPartSize: storer.MinPartSize,
+		MaxKeys:     1000,
+		buckets:     make(map[string]map[string]*object),
+		uploads:     make(map[string]*upload),
+		requests:    make(map[string]int),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Config returns the config of a storer for a bucket of the fake server.
+func (s *Server) Config(bucket string) storer.S3Config {
+	return storer.S3Config{
+		Endpoint:  s.URL,
+		Region:    Region,
+		Bucket:    bucket,
+		AccessKey: AccessKey,
+		SecretKey: SecretKey,
+	}
+}
+
+// Object returns the content of an object.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Uploads returns how many multipart uploads are in progress.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Requests returns how many requests of an operation were made, e.g.
+// "PUT object", "PUT part" or "POST uploads".
+func (s *Server) Requests(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[op]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verify(r); err != nil {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	op := r.Method + " object"
+	switch {
+	case key == "":
+		op = r.Method + " bucket"
+	case query.Has("uploads"):
+		op = r.Method + " uploads"
+	case query.Has("partNumber"):
+		op = r.Method + " part"
+	case query.Has("uploadId"):
+		op = r.Method + " upload"
+	}
+	s.requests[op]++
+
+	switch op {
+	case "GET bucket":
+		s.serveList(w, objects, query)
+	case "PUT object":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		o := newObject(body)
+		objects[key] = o
+		w.Header().Set("ETag", o.etag)
+	case "GET object", "HEAD object":
+		o, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Last-Modified", o.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		if r.Method == http.MethodGet {
+			w.Write(o.data)
+		}
+	case "DELETE object":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "POST uploads":
+		s.nextID++
+		id := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[id] = &upload{key: key, parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case "PUT part":
+		u, ok := s.uploads[query.Get("uploadId")]
+		n, err := strconv.Atoi(query.Get("partNumber"))
+		if !ok || u.key != key || err != nil || n < 1 {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		u.parts[n] = body
+		w.Header().Set("ETag", etag(body))
+	case "POST upload":
+		s.completeUpload(w, r, objects, key, query.Get("uploadId"))
+	case "DELETE upload":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", op+" is not implemented")
+	}
+}
+
+func (s *Server) serveList(w http.ResponseWriter, objects map[string]*object, query url.Values) {
+	if query.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 is implemented")
+		return
+	}
+
+	prefix := query.Get("prefix")
+	after := query.Get("continuation-token")
+
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type contents struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+		ETag         string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []contents
+	}{Prefix: prefix}
+
+	if len(keys) > s.MaxKeys {
+		keys = keys[:s.MaxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+
+	result.KeyCount = len(keys)
+	for _, key := range keys {
+		o := objects[key]
+		result.Contents = append(result.Contents, contents{Key: key, Size: len(o.data), LastModified: o.modTime.UTC(), ETag: o.etag})
+	}
+
+	writeXML(w, result)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, objects map[string]*object, key, id string) {
+	u, ok := s.uploads[id]
+	if !ok || u.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	var complete struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil || len(complete.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+
+	var data bytes.Buffer
+	for i, p := range complete.Parts {
+		part, ok := u.parts[p.PartNumber]
+		if !ok || p.PartNumber != i+1 || p.ETag != etag(part) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		if i < len(complete.Parts)-1 && len(part) < s.MinPartSize {
+			writeError(w, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+			return
+		}
+		data.Write(part)
+	}
+
+	delete(s.uploads, id)
+	o := newObject(data.Bytes())
+	objects[key] = o
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string
+		ETag    string
+	}{Key: key, ETag: o.etag})
+}
+
+func newObject(data []byte) *object {
+	return &object{data: data, etag: etag(data), modTime: time.Now()}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+// verify checks the AWS Signature Version 4 of a request, signed either in
+// the Authorization header or in the query of a presigned URL.
+func verify(r *http.Request) error {
+	query := r.URL.Query()
+
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields := map[string]string{}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			fields[name] = value
+		}
+		credential, signedHeaders, signature = fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		if payloadHash != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("payload hash does not match the body")
+		}
+	} else if query.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+		credential, signedHeaders, signature = query.Get("X-Amz-Credential"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+		query.Del("X-Amz-Signature")
+
+		t, err := time.Parse("20060102T150405Z", amzDate)
+		expires, _ := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || time.Now().After(t.Add(time.Duration(expires)*time.Second)) {
+			return fmt.Errorf("request has expired")
+		}
+	} else {
+		return fmt.Errorf("request is not signed")
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] != AccessKey || parts[2] != Region || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential %q", credential)
+	}
+	if !strings.HasPrefix(amzDate, parts[1]) {
+		return fmt.Errorf("credential date does not match the request date")
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	// The canonical query is sorted by key and encoded like the path
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, encode(k, true)+"="+encode(v, true))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		encode(r.URL.Path, false),
+		strings.Join(pairs, "&"),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join(parts[1:], "/")
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + SecretKey)
+	for _, part := range parts[1:] {
+		key = sign(key, part)
+	}
+
+	if !hmac.Equal([]byte(hex.EncodeToString(sign(key, stringToSign))), []byte(signature)) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,150 @@
+package storer
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStorer keeps files in memory, for tests. Access keys are the basenames
+// files are stored under.
+type MemStorer struct {
+	mu    sync.Mutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemStorer() *MemStorer {
+	return &MemStorer{
+		files: make(map[string]memFile),
+	}
+}
+
+func (ms *MemStorer) Store(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return ms.Put(file, f)
+}
+
+// Get writes the file to a temporary file, which the caller is responsible
+// for removing.
+func (ms *MemStorer) Get(access string) (string, error) {
+	data, err := ms.data("get", access)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "memstorer-*"+filepath.Ext(access))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (ms *MemStorer) Put(name string, r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	access := filepath.Base(name)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.files[access] = memFile{data: data, modTime: time.Now()}
+
+	return access, nil
+}
+
+func (ms *MemStorer) Open(access string) (io.ReadCloser, error) {
+	data, err := ms.data("open", access)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ms *MemStorer) Stat(access string) (*Info, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	f, ok := ms.files[access]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: access, Err: fs.ErrNotExist}
+	}
+
+	return f.info(access), nil
+}
+
+func (ms *MemStorer) List(prefix string) ([]Info, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var infos []Info
+	for access, f := range ms.files {
+		if strings.HasPrefix(access, prefix) {
+			infos = append(infos, *f.info(access))
+		}
+	}
+
+	sortInfos(infos)
+	return infos, nil
+}
+
+func (ms *MemStorer) Delete(access string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.files[access]; !ok {
+		return &fs.PathError{Op: "delete", Path: access, Err: fs.ErrNotExist}
+	}
+
+	delete(ms.files, access)
+	return nil
+}
+
+// data returns the content of a file. Stored slices are never modified, so
+// it can be shared.
+func (ms *MemStorer) data(op, access string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	f, ok := ms.files[access]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: access, Err: fs.ErrNotExist}
+	}
+
+	return f.data, nil
+}
+
+func (f memFile) info(access string) *Info {
+	return &Info{
+		Access:  access,
+		Name:    access,
+		Size:    int64(len(f.data)),
+		ModTime: f.modTime,
+	}
+}
@@ -0,0 +1,620 @@
+package storer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPartSize is the size of multipart upload parts. Objects smaller
+	// than a part are uploaded in one request.
+	DefaultPartSize = 16 << 20
+	// MinPartSize is the smallest part S3 accepts, except for the last one.
+	MinPartSize = 5 << 20
+
+	DefaultPresignExpiry = time.Hour
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3RefsDir holds the refs of LinkAweme under Prefix, one object per
+	// aweme holding the access key of its video.
+	s3RefsDir = ".refs/"
+
+	// abortTimeout bounds aborting a failed multipart upload, which is done
+	// even if the upload failed because its context was canceled.
+	abortTimeout = time.Minute
+)
+
+// S3Config locates an S3-compatible bucket. Objects are addressed
+// path-style, {Endpoint}/{Bucket}/{key}, which AWS and self-hosted servers
+// such as MinIO all accept.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// S3Storer stores files as objects under Prefix in an S3-compatible bucket.
+// Access keys are object keys, and Get returns a presigned URL of the object,
+// which anything that reads URLs, e.g. ffmpeg, can use without credentials.
+// It implements AwemeIndex with ref objects under Prefix + ".refs/", which
+// List leaves out.
+type S3Storer struct {
+	Config     S3Config
+	Prefix     string
+	HttpClient *http.Client
+	// PartSize is the size of multipart upload parts, at least MinPartSize
+	PartSize int64
+	// PresignExpiry is how long URLs returned by Get are valid
+	PresignExpiry time.Duration
+
+	endpoint *url.URL
+}
+
+func NewS3Storer(config S3Config, prefix string) (*S3Storer, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: scheme must be http or https", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("missing S3 bucket")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	return &S3Storer{
+		Config: config,
+		Prefix: prefix,
+		// Bodies are streamed for as long as they take, so only connecting
+		// and waiting for a response are timed out
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+			},
+		},
+		PartSize:      DefaultPartSize,
+		PresignExpiry: DefaultPresignExpiry,
+		endpoint:      endpoint,
+	}, nil
+}
+
+func (s3 *S3Storer) Store(file string) (string, error) {
+	return s3.StoreContext(context.Background(), file)
+}
+
+// StoreContext is like Store, but aborts the upload when ctx is done.
+func (s3 *S3Storer) StoreContext(ctx context.Context, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s3.PutContext(ctx, file, f)
+}
+
+// Get returns a presigned GET URL of the object, valid for PresignExpiry.
+func (s3 *S3Storer) Get(access string) (string, error) {
+	if err := s3.check(access); err != nil {
+		return "", err
+	}
+
+	u := s3.objectURL(access)
+	now := time.Now().UTC()
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s3.Config.AccessKey+"/"+s3.scope(now))
+	q.Set("X-Amz-Date", now.Format(amzDateFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(s3.PresignExpiry.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = q.Encode()
+
+	signature := s3.signature(http.MethodGet, u, nil, []string{"host"}, unsignedPayload, now)
+
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// Put uploads what r reads as Prefix + basename of name. Content of at least
+// PartSize is uploaded in parts, so memory use is bounded by one part.
+func (s3 *S3Storer) Put(name string, r io.Reader) (string, error) {
+	return s3.PutContext(context.Background(), name, r)
+}
+
+// PutContext is like Put, but aborts the upload when ctx is done.
+func (s3 *S3Storer) PutContext(ctx context.Context, name string, r io.Reader) (string, error) {
+	key := s3.Prefix + filepath.Base(name)
+
+	partSize := s3.PartSize
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+
+	part, err := readPart(r, partSize)
+	if err != nil {
+		return "", err
+	}
+
+	if int64(len(part)) < partSize {
+		_, err := s3.do(ctx, http.MethodPut, key, nil, part, http.StatusOK)
+		if err != nil {
+			return "", err
+		}
+		return key, nil
+	}
+
+	if err := s3.putMultipart(ctx, key, part, r, partSize); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// putMultipart uploads an object in parts, starting with first. The upload
+// is aborted if a part fails, so no parts are left behind.
+func (s3 *S3Storer) putMultipart(ctx context.Context, key string, first []byte, r io.Reader, partSize int64) (err error) {
+	resp, err := s3.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiate); err != nil {
+		return fmt.Errorf("invalid multipart upload response: %w", err)
+	}
+
+	uploadID := initiate.UploadID
+	defer func() {
+		if err != nil {
+			abortCtx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+			defer cancel()
+			s3.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, http.StatusNoContent)
+		}
+	}()
+
+	var complete completeMultipartUpload
+	for part := first; len(part) > 0; {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(len(complete.Parts) + 1)},
+			"uploadId":   {uploadID},
+		}
+
+		etag, err := s3.uploadPart(ctx, key, query, part)
+		if err != nil {
+			return fmt.Errorf("part %d: %w", len(complete.Parts)+1, err)
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: len(complete.Parts) + 1, ETag: etag})
+
+		if int64(len(part)) < partSize {
+			break
+		}
+		if part, err = readPart(r, partSize); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	resp, err = s3.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	// Completing can fail after the status is sent, which is reported in
+	// the body
+	var s3Err s3Error
+	if xml.Unmarshal(resp, &s3Err) == nil && s3Err.Code != "" {
+		return &s3Err
+	}
+
+	return nil
+}
+
+func (s3 *S3Storer) uploadPart(ctx context.Context, key string, query url.Values, part []byte) (string, error) {
+	req, err := s3.newRequest(ctx, http.MethodPut, key, query, part)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s3.HttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp, key)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s3 *S3Storer) Open(access string) (io.ReadCloser, error) {
+	return s3.OpenContext(context.Background(), access)
+}
+
+// OpenContext is like Open, but the returned reader fails once ctx is done.
+func (s3 *S3Storer) OpenContext(ctx context.Context, access string) (io.ReadCloser, error) {
+	if err := s3.check(access); err != nil {
+		return nil, err
+	}
+
+	req, err := s3.newRequest(ctx, http.MethodGet, access, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s3.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp, access)
+	}
+
+	return resp.Body, nil
+}
+
+func (s3 *S3Storer) Stat(access string) (*Info, error) {
+	if err := s3.check(access); err != nil {
+		return nil, err
+	}
+
+	req, err := s3.newRequest(context.Background(), http.MethodHead, access, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s3.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, access)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &Info{
+		Access:  access,
+		Name:    strings.TrimPrefix(access, s3.Prefix),
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s3 *S3Storer) List(prefix string) ([]Info, error) {
+	var infos []Info
+
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s3.Prefix + prefix},
+	}
+	for {
+		resp, err := s3.do(context.Background(), http.MethodGet, "", query, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		if err := xml.Unmarshal(resp, &result); err != nil {
+			return nil, fmt.Errorf("invalid list response: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			if strings.HasPrefix(object.Key, s3.Prefix+s3RefsDir) {
+				continue
+			}
+			infos = append(infos, Info{
+				Access:  object.Key,
+				Name:    strings.TrimPrefix(object.Key, s3.Prefix),
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	sortInfos(infos)
+	return infos, nil
+}
+
+// Delete removes an object. S3 does not tell whether the object existed, so
+// deleting a missing object is not an error.
+func (s3 *S3Storer) Delete(access string) error {
+	if err := s3.check(access); err != nil {
+		return err
+	}
+
+	_, err := s3.do(context.Background(), http.MethodDelete, access, nil, nil, http.StatusNoContent)
+	return err
+}
+
+func (s3 *S3Storer) refKey(awemeID string) (string, error) {
+	if awemeID == "" || strings.ContainsAny(awemeID, `/\`) || awemeID == "." || awemeID == ".." {
+		return "", fmt.Errorf("invalid aweme ID %q", awemeID)
+	}
+	return s3.Prefix + s3RefsDir + awemeID, nil
+}
+
+func (s3 *S3Storer) LookupAweme(awemeID string) (string, error) {
+	key, err := s3.refKey(awemeID)
+	if err != nil {
+		return "", err
+	}
+
+	access, err := s3.do(context.Background(), http.MethodGet, key, nil, nil, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+
+	// The ref is stale if the object was removed
+	if _, err := s3.Stat(string(access)); err != nil {
+		return "", err
+	}
+
+	return string(access), nil
+}
+
+func (s3 *S3Storer) LinkAweme(awemeID, access string) error {
+	key, err := s3.refKey(awemeID)
+	if err != nil {
+		return err
+	}
+	if err := s3.check(access); err != nil {
+		return err
+	}
+
+	_, err = s3.do(context.Background(), http.MethodPut, key, nil, []byte(access), http.StatusOK)
+	return err
+}
+
+// check makes sure an access key is an object under Prefix, so a storer
+// cannot reach the objects of another.
+func (s3 *S3Storer) check(access string) error {
+	if access == "" || !strings.HasPrefix(access, s3.Prefix) || access == s3.Prefix {
+		return fmt.Errorf("%s is not stored under %q", access, s3.Prefix)
+	}
+	return nil
+}
+
+// objectURL returns the path-style URL of a key, or of the bucket if key is
+// empty.
+func (s3 *S3Storer) objectURL(key string) *url.URL {
+	u := *s3.endpoint
+	u.Path = path.Join("/", u.Path, s3.Config.Bucket)
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	return &u
+}
+
+func (s3 *S3Storer) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := s3.objectURL(key)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	now := time.Now().UTC()
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signature := s3.signature(method, u, req.Header, signedHeaders, payloadHash, now)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.Config.AccessKey, s3.scope(now), strings.Join(signedHeaders, ";"), signature))
+
+	return req, nil
+}
+
+// do sends a signed request and returns the response body, or an error if
+// the status is not want.
+func (s3 *S3Storer) do(ctx context.Context, method, key string, query url.Values, body []byte, want int) ([]byte, error) {
+	req, err := s3.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s3.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Some servers answer deletes with 200 instead of 204
+	if resp.StatusCode != want && !(want == http.StatusNoContent && resp.StatusCode == http.StatusOK) {
+		return nil, responseError(resp, key)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// s3Error is the error document S3 responds with.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// responseError returns the error of a failed response. Missing objects are
+// errors wrapping fs.ErrNotExist, like the other storers.
+func responseError(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: strings.ToLower(resp.Request.Method), Path: key, Err: fs.ErrNotExist}
+	}
+
+	e := &s3Error{Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, e)
+	return e
+}
+
+// Requests are signed with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+
+const amzDateFormat = "20060102T150405Z"
+
+func (s3 *S3Storer) scope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", t.Format("20060102"), s3.Config.Region)
+}
+
+func (s3 *S3Storer) signature(method string, u *url.URL, header http.Header, signedHeaders []string, payloadHash string, t time.Time) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := header.Get(name)
+		if name == "host" {
+			value = u.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		uriEncode(u.Path, false),
+		canonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format(amzDateFormat),
+		s3.scope(t),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s3.Config.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s3.Config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and '/'
+// unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
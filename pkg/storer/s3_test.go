@@ -0,0 +1,306 @@
+package storer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer/fakes3"
+)
+
+const testBucket = "videos"
+
+// newTestS3 returns a storer with the smallest part size for a bucket of a
+// new fake S3 server.
+func newTestS3(t *testing.T, prefix string) (*storer.S3Storer, *fakes3.Server) {
+	t.Helper()
+
+	fake := fakes3.New(testBucket)
+	t.Cleanup(fake.Close)
+
+	s3, err := storer.NewS3Storer(fake.Config(testBucket), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.PartSize = storer.MinPartSize
+
+	return s3, fake
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestS3Put(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		multipart bool
+		parts     int
+	}{
+		{"below part size", storer.MinPartSize - 1, false, 0},
+		{"at part size", storer.MinPartSize, true, 1},
+		{"above part size", 2*storer.MinPartSize + storer.MinPartSize/2, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3, fake := newTestS3(t, "videos/")
+			data := randomBytes(tt.size)
+
+			access, err := s3.Put("/tmp/video.mp4", bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if access != "videos/video.mp4" {
+				t.Errorf("got access key %q, want videos/video.mp4", access)
+			}
+
+			got, ok := fake.Object(testBucket, access)
+			if !ok {
+				t.Fatal("object was not stored")
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("stored %d bytes that differ from the %d put", len(got), len(data))
+			}
+
+			if n := fake.Requests("POST uploads"); (n == 1) != tt.multipart {
+				t.Errorf("got %d multipart uploads, want multipart %v", n, tt.multipart)
+			}
+			if n := fake.Requests("PUT part"); n != tt.parts {
+				t.Errorf("got %d parts, want %d", n, tt.parts)
+			}
+			if n := fake.Uploads(); n != 0 {
+				t.Errorf("%d uploads left in progress", n)
+			}
+		})
+	}
+}
+
+// failingReader returns err once r is exhausted.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestS3PutAbort(t *testing.T) {
+	readErr := errors.New("read failed")
+
+	t.Run("read error", func(t *testing.T) {
+		s3, fake := newTestS3(t, "")
+		r := &failingReader{r: bytes.NewReader(randomBytes(storer.MinPartSize + 1)), err: readErr}
+
+		if _, err := s3.Put("video.mp4", r); !errors.Is(err, readErr) {
+			t.Fatalf("got error %v, want %v", err, readErr)
+		}
+		checkAborted(t, fake)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		s3, fake := newTestS3(t, "")
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// The context is canceled once the first part was read
+		r := io.MultiReader(
+			bytes.NewReader(randomBytes(storer.MinPartSize)),
+			readerFunc(func(p []byte) (int, error) {
+				cancel()
+				return copy(p, "more"), io.EOF
+			}),
+		)
+
+		if _, err := s3.PutContext(ctx, "video.mp4", r); !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want context.Canceled", err)
+		}
+		checkAborted(t, fake)
+	})
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func checkAborted(t *testing.T, fake *fakes3.Server) {
+	t.Helper()
+
+	if n := fake.Requests("DELETE upload"); n != 1 {
+		t.Errorf("got %d aborts, want 1", n)
+	}
+	if n := fake.Uploads(); n != 0 {
+		t.Errorf("%d uploads left in progress", n)
+	}
+	if _, ok := fake.Object(testBucket, "video.mp4"); ok {
+		t.Error("failed upload was stored")
+	}
+}
+
+func TestS3List(t *testing.T) {
+	s3, fake := newTestS3(t, "videos/")
+	fake.MaxKeys = 2
+
+	other, err := storer.NewS3Storer(fake.Config(testBucket), "other/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Put("a.mp4", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"videos/a.mp4", "videos/b.mp4", "videos/c.mp4", "videos/d.mp4", "videos/e.mp4"}
+	for _, access := range want {
+		if _, err := s3.Put(access, strings.NewReader(access)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s3.LinkAweme("7220000000000000001", want[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := s3.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, info := range infos {
+		got = append(got, info.Access)
+		if info.Size != int64(len(info.Access)) {
+			t.Errorf("%s: got size %d, want %d", info.Access, info.Size, len(info.Access))
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Four keys with the ref, two per page
+	if n := fake.Requests("GET bucket"); n != 3 {
+		t.Errorf("listed %d pages, want 3", n)
+	}
+}
+
+func TestS3Get(t *testing.T) {
+	s3, _ := newTestS3(t, "videos/")
+
+	access, err := s3.Put("video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string) (int, string) {
+		t.Helper()
+
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	url, err := s3.Get(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(url); status != http.StatusOK || body != "video" {
+		t.Errorf("got %d %q, want 200 \"video\"", status, body)
+	}
+
+	// A URL changed after signing is refused
+	tampered := strings.Replace(url, "video.mp4", "other.mp4", 1)
+	if status, _ := get(tampered); status != http.StatusForbidden {
+		t.Errorf("got status %d for a tampered URL, want 403", status)
+	}
+
+	s3.PresignExpiry = -storer.DefaultPresignExpiry
+	expired, err := s3.Get(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get(expired); status != http.StatusForbidden {
+		t.Errorf("got status %d for an expired URL, want 403", status)
+	}
+
+	if _, err := s3.Get("other/video.mp4"); err == nil {
+		t.Error("got a URL of an object outside the prefix")
+	}
+}
+
+func TestS3Open(t *testing.T) {
+	s3, _ := newTestS3(t, "")
+
+	if _, err := s3.Open("missing.mp4"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v opening a missing object, want fs.ErrNotExist", err)
+	}
+
+	access, err := s3.Put("video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s3.OpenContext(ctx, access); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v opening with a canceled context, want context.Canceled", err)
+	}
+}
+
+func TestS3AwemeIndex(t *testing.T) {
+	s3, _ := newTestS3(t, "videos/")
+	const awemeID = "7220000000000000001"
+
+	if _, err := s3.LookupAweme(awemeID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v looking up an unlinked aweme, want fs.ErrNotExist", err)
+	}
+
+	access, err := s3.Put("video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.LinkAweme(awemeID, access); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s3.LookupAweme(awemeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != access {
+		t.Errorf("got access key %q, want %q", got, access)
+	}
+
+	// A ref to a removed object is stale
+	if err := s3.Delete(access); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.LookupAweme(awemeID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v looking up a removed video, want fs.ErrNotExist", err)
+	}
+
+	if err := s3.LinkAweme("../x", access); err == nil {
+		t.Error("linked an invalid aweme ID")
+	}
+}
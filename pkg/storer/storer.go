@@ -1,14 +1,38 @@
 package storer
 
 import (
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 type Storer interface {
 	Store(path string) (access string, err error)
 	Get(access string) (tmpfile string, err error)
+
+	// Put stores what r reads under name and returns the access key.
+	Put(name string, r io.Reader) (access string, err error)
+	// Open returns a reader of a stored file.
+	Open(access string) (io.ReadCloser, error)
+	Stat(access string) (*Info, error)
+	// List returns the stored files whose name starts with prefix, ordered
+	// by access key.
+	List(prefix string) ([]Info, error)
+	Delete(access string) error
+}
+
+// Info describes a stored file. Storers return errors wrapping
+// fs.ErrNotExist for files they do not have.
+type Info struct {
+	Access  string
+	Name    string
+	Size    int64
+	ModTime time.Time
 }
 
 type LocalStorer struct {
@@ -22,21 +46,19 @@ func NewLocalStorer(path string) *LocalStorer {
 }
 
 func (ls *LocalStorer) Store(file string) (string, error) {
-	// Make sure path exists
-	if _, err := os.Stat(ls.Path); os.IsNotExist(err) {
-		err = os.MkdirAll(ls.Path, os.ModePerm)
-		if err != nil {
-			return "", err
-		}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	// Copy the input file to the destination directory
-	dstPath := filepath.Join(ls.Path, filepath.Base(file))
-	err := copyFile(file, dstPath)
+	fi, err := f.Stat()
 	if err != nil {
 		return "", err
 	}
-	return dstPath, nil
+
+	// The copy keeps the mode of the source file
+	return ls.put(file, f, fi.Mode())
 }
 
 func (ls *LocalStorer) Get(access string) (string, error) {
@@ -44,38 +66,154 @@ func (ls *LocalStorer) Get(access string) (string, error) {
 	return access, nil
 }
 
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+// Put copies r to Path/basename of name. The file only appears once it is
+// complete.
+func (ls *LocalStorer) Put(name string, r io.Reader) (string, error) {
+	return ls.put(name, r, 0)
+}
+
+func (ls *LocalStorer) put(name string, r io.Reader, mode fs.FileMode) (string, error) {
+	dstPath := filepath.Join(ls.Path, filepath.Base(name))
+	if err := writeFile(dstPath, r, mode); err != nil {
+		return "", err
+	}
+	return dstPath, nil
+}
+
+func (ls *LocalStorer) Open(access string) (io.ReadCloser, error) {
+	if err := ls.check(access); err != nil {
+		return nil, err
+	}
+	return os.Open(access)
+}
+
+func (ls *LocalStorer) Stat(access string) (*Info, error) {
+	if err := ls.check(access); err != nil {
+		return nil, err
+	}
+	return statFile(access)
+}
+
+func (ls *LocalStorer) List(prefix string) ([]Info, error) {
+	entries, err := os.ReadDir(ls.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for _, entry := range entries {
+		if entry.IsDir() || isTemp(entry.Name()) || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+
+		info, err := statFile(filepath.Join(ls.Path, entry.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+
+	return infos, nil
+}
+
+func (ls *LocalStorer) Delete(access string) error {
+	if err := ls.check(access); err != nil {
 		return err
 	}
-	defer sourceFile.Close()
+	return os.Remove(access)
+}
+
+// check makes sure an access key is a file of the storer, so arbitrary files
+// cannot be read or deleted through it.
+func (ls *LocalStorer) check(access string) error {
+	return checkWithin(ls.Path, access)
+}
+
+func checkWithin(dir, access string) error {
+	rel, err := filepath.Rel(dir, access)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is not stored in %s", access, dir)
+	}
+	return nil
+}
 
-	destinationFile, err := os.Create(dst)
+func statFile(path string) (*Info, error) {
+	fi, err := os.Stat(path)
 	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+
+	return &Info{
+		Access:  path,
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// writeFile copies r to a temporary file next to path and renames it into
+// place, so path is never seen half written. The file gets mode, unless it is
+// 0.
+func writeFile(path string, r io.Reader, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
 		return err
 	}
-	defer destinationFile.Close()
 
-	_, err = io.Copy(destinationFile, sourceFile)
-	if err != nil {
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := copyTo(tmpPath, r); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	err = destinationFile.Sync()
-	if err != nil {
+	if mode != 0 {
+		if err := os.Chmod(tmpPath, mode); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
 
-	sourceFileStat, err := sourceFile.Stat()
+	return nil
+}
+
+func copyTo(path string, r io.Reader) error {
+	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 
-	err = os.Chmod(dst, sourceFileStat.Mode())
-	if err != nil {
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
 		return err
 	}
 
-	return nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func isTemp(name string) bool {
+	return strings.HasSuffix(name, ".tmp")
+}
+
+func sortInfos(infos []Info) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Access < infos[j].Access
+	})
 }
@@ -0,0 +1,178 @@
+package storer_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
+)
+
+func TestLocalPut(t *testing.T) {
+	ls := storer.NewLocalStorer(filepath.Join(t.TempDir(), "out"))
+
+	access, err := ls.Put("/tmp/video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(ls.Path, "video.mp4"); access != want {
+		t.Errorf("got access key %s, want %s", access, want)
+	}
+
+	// Putting the same name again replaces the file
+	if _, err := ls.Put("video.mp4", strings.NewReader("new video")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ls.Open(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new video" {
+		t.Errorf("got content %q, want \"new video\"", data)
+	}
+
+	entries, err := os.ReadDir(ls.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only video.mp4", len(entries))
+	}
+}
+
+func TestLocalStoreKeepsMode(t *testing.T) {
+	ls := storer.NewLocalStorer(filepath.Join(t.TempDir(), "out"))
+
+	for _, mode := range []fs.FileMode{0600, 0755} {
+		src := filepath.Join(t.TempDir(), "video.mp4")
+		if err := os.WriteFile(src, []byte("video"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(src, mode); err != nil {
+			t.Fatal(err)
+		}
+
+		access, err := ls.Store(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(access)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("got mode %v, want the source's %v", fi.Mode(), mode)
+		}
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	ls := storer.NewLocalStorer(filepath.Join(t.TempDir(), "out"))
+
+	if infos, err := ls.List(""); err != nil || len(infos) != 0 {
+		t.Fatalf("got %v and error %v listing a missing directory, want nothing", infos, err)
+	}
+
+	for _, name := range []string{"b.mp4", "a.mp4", "comment.png"} {
+		if _, err := ls.Put(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Directories and temporary files are not listed
+	if err := os.Mkdir(filepath.Join(ls.Path, "a.dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ls.Path, "a.mp4.1.tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"a.mp4", "b.mp4", "comment.png"}},
+		{"a", []string{"a.mp4"}},
+		{"c", []string{"comment.png"}},
+		{"x", nil},
+	}
+
+	for _, tt := range tests {
+		infos, err := ls.List(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, info := range infos {
+			got = append(got, info.Name)
+			if info.Access != filepath.Join(ls.Path, info.Name) {
+				t.Errorf("%s: got access key %s", info.Name, info.Access)
+			}
+			if info.Size != int64(len(info.Name)) {
+				t.Errorf("%s: got size %d, want %d", info.Name, info.Size, len(info.Name))
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("prefix %q: got %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestLocalStatDelete(t *testing.T) {
+	ls := storer.NewLocalStorer(filepath.Join(t.TempDir(), "out"))
+
+	access, err := ls.Put("video.mp4", strings.NewReader("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ls.Stat(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Access != access || info.Name != "video.mp4" || info.Size != 5 || info.ModTime.IsZero() {
+		t.Errorf("got info %+v", info)
+	}
+	dir := filepath.Join(ls.Path, "dir")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v for a directory, want fs.ErrNotExist", err)
+	}
+
+	if err := ls.Delete(access); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Stat(access); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v for a deleted file, want fs.ErrNotExist", err)
+	}
+	if err := ls.Delete(access); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v deleting twice, want fs.ErrNotExist", err)
+	}
+
+	// Files outside the storer cannot be read or deleted through it
+	outside := filepath.Join(t.TempDir(), "outside.mp4")
+	if err := os.WriteFile(outside, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Stat(outside); err == nil {
+		t.Error("got the info of a file outside the storer")
+	}
+	if err := ls.Delete(outside); err == nil {
+		t.Error("deleted a file outside the storer")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the storer is gone: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Package apierror classifies the errors returned by the TikTok APIs, and
+// retries the ones that are worth retrying.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors an *Error can be matched against with errors.Is.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrServer        = errors.New("server error")
+	ErrMalformed     = errors.New("malformed response")
+)
+
+// Error is an error returned by an API. Kind is one of the sentinel errors,
+// or nil if the error could not be classified.
+type Error struct {
+	StatusCode int
+	Code       int
+	Message    string
+	RetryAfter time.Duration
+	Kind       error
+	Err        error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString("API error")
+	if e.Kind != nil {
+		fmt.Fprintf(&b, " (%s)", e.Kind)
+	}
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&b, ": status %d", e.StatusCode)
+	}
+	if e.Code != 0 {
+		fmt.Fprintf(&b, ", code %d", e.Code)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, ": %s", e.Err)
+	}
+	return b.String()
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FromResponse returns an *Error for a response with a non-2xx status, or nil
+// if the status is a success.
+func FromResponse(res *http.Response, body []byte) *Error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Message:    responseMessage(body),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		// RapidAPI answers 429 both for the per-second rate limit and for
+		// the monthly quota, which no amount of retrying will fix.
+		if strings.Contains(strings.ToLower(e.Message), "quota") {
+			e.Kind = ErrQuotaExceeded
+		} else {
+			e.Kind = ErrRateLimited
+		}
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		e.Kind = ErrUnauthorized
+	case res.StatusCode == http.StatusNotFound:
+		e.Kind = ErrNotFound
+	case res.StatusCode >= 500:
+		e.Kind = ErrServer
+	}
+
+	return e
+}
+
+// Messages the APIs give for videos and users that do not exist. tikwm style
+// APIs answer "Url parsing is failed" for deleted videos.
+var notFoundMessages = []string{
+	"not found",
+	"not exist",
+	"no longer available",
+	"url parsing is failed",
+}
+
+// FromMessage returns an *Error for a response that reported a failure in
+// its body rather than its status, classified by the message. A message that
+// does not say what went wrong is taken as a server error, so it is retried
+// rather than failing the request for good.
+func FromMessage(statusCode, code int, message string) *Error {
+	e := &Error{
+		StatusCode: statusCode,
+		Code:       code,
+		Message:    message,
+		Kind:       ErrServer,
+	}
+
+	msg := strings.ToLower(message)
+	switch {
+	case strings.Contains(msg, "quota"):
+		e.Kind = ErrQuotaExceeded
+	case strings.Contains(msg, "limit"):
+		e.Kind = ErrRateLimited
+	default:
+		for _, m := range notFoundMessages {
+			if strings.Contains(msg, m) {
+				e.Kind = ErrNotFound
+				break
+			}
+		}
+	}
+
+	return e
+}
+
+// Malformed returns an *Error for a body that could not be decoded.
+func Malformed(res *http.Response, err error) *Error {
+	return &Error{
+		StatusCode: res.StatusCode,
+		Message:    "error unmarshaling JSON response",
+		Kind:       ErrMalformed,
+		Err:        err,
+	}
+}
+
+// responseMessage extracts the message of a RapidAPI style JSON error body,
+// falling back to the start of the raw body.
+func responseMessage(body []byte) string {
+	var msg struct {
+		Message string `json:"message"`
+		Msg     string `json:"msg"`
+	}
+	if err := json.Unmarshal(body, &msg); err == nil {
+		if msg.Message != "" {
+			return msg.Message
+		}
+		if msg.Msg != "" {
+			return msg.Msg
+		}
+	}
+
+	s := strings.TrimSpace(string(body))
+	if len(s) > 200 {
+		s = s[:200]
+	}
+	return s
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP
+// date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
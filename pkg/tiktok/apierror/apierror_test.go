@@ -0,0 +1,119 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		kind    error
+	}{
+		{"Url parsing is failed! Please check url.", ErrNotFound},
+		{"Video not found", ErrNotFound},
+		{"User does not exist", ErrNotFound},
+		{"This video is no longer available", ErrNotFound},
+		{"Free Api Limit: 1 request/second.", ErrRateLimited},
+		{"You have exceeded the MONTHLY quota", ErrQuotaExceeded},
+		{"Internal error, try again later", ErrServer},
+		{"", ErrServer},
+	}
+
+	for _, tt := range tests {
+		err := FromMessage(http.StatusOK, -1, tt.message)
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("FromMessage(%q) = %v, want %v", tt.message, err.Kind, tt.kind)
+		}
+	}
+}
+
+func TestFromMessageRetryable(t *testing.T) {
+	if !Retryable(FromMessage(http.StatusOK, -1, "something went wrong")) {
+		t.Error("unknown message is not retryable")
+	}
+	if Retryable(FromMessage(http.StatusOK, -1, "Url parsing is failed! Please check url.")) {
+		t.Error("not found is retryable")
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		kind       error
+		message    string
+		wait       time.Duration
+	}{
+		{"success", http.StatusOK, "", "", nil, "", 0},
+		{"rate limited", http.StatusTooManyRequests, "3", `{"message": "Too many requests"}`, ErrRateLimited, "Too many requests", 3 * time.Second},
+		{"quota", http.StatusTooManyRequests, "", `{"message": "You have exceeded the MONTHLY quota"}`, ErrQuotaExceeded, "You have exceeded the MONTHLY quota", 0},
+		{"unauthorized", http.StatusUnauthorized, "", `{"msg": "Invalid API key"}`, ErrUnauthorized, "Invalid API key", 0},
+		{"forbidden", http.StatusForbidden, "", "", ErrUnauthorized, "", 0},
+		{"not found", http.StatusNotFound, "", "no such user", ErrNotFound, "no such user", 0},
+		{"server error", http.StatusBadGateway, "", "  <html>bad gateway</html>\n", ErrServer, "<html>bad gateway</html>", 0},
+		{"unclassified", http.StatusTeapot, "", "", nil, "", 0},
+		{"long body", http.StatusBadRequest, "", strings.Repeat("x", 300), nil, strings.Repeat("x", 200), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+			if tt.retryAfter != "" {
+				res.Header.Set("Retry-After", tt.retryAfter)
+			}
+
+			err := FromResponse(res, []byte(tt.body))
+			if tt.status == http.StatusOK {
+				if err != nil {
+					t.Fatalf("got error %v for a success", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error for status %d", tt.status)
+			}
+
+			if err.StatusCode != tt.status || err.Kind != tt.kind {
+				t.Errorf("got status %d and kind %v, want %d and %v", err.StatusCode, err.Kind, tt.status, tt.kind)
+			}
+			if err.Message != tt.message {
+				t.Errorf("got message %q, want %q", err.Message, tt.message)
+			}
+			if err.RetryAfter != tt.wait {
+				t.Errorf("got Retry-After %s, want %s", err.RetryAfter, tt.wait)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+		{"Mon, 10 Apr 2023 12:00:30 GMT", 30 * time.Second},
+		{"Monday, 10-Apr-23 12:01:00 GMT", time.Minute},
+		{"Mon Apr 10 12:00:05 2023", 5 * time.Second},
+		// A date in the past asks for no wait
+		{"Mon, 10 Apr 2023 11:59:00 GMT", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Retryable reports whether the request that failed with err may succeed
+// when retried.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Kind == ErrRateLimited || apiErr.Kind == ErrServer
+	}
+
+	// Dropped connections and timeouts of the HTTP client
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Backoff retries retryable errors with exponential backoff and full jitter.
+// A Retry-After given by the API is used as the lower bound of the delay, but
+// no delay is longer than MaxDelay, so a server asking for hours does not
+// stall the caller.
+type Backoff struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable, or
+// runs out of attempts.
+func (b Backoff) Do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !Retryable(err) || attempt >= b.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(b.delay(attempt, err))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (b Backoff) delay(attempt int, err error) time.Duration {
+	ceiling := b.BaseDelay
+	for i := 1; i < attempt && ceiling < b.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > b.MaxDelay {
+		ceiling = b.MaxDelay
+	}
+
+	var delay time.Duration
+	if ceiling > 0 {
+		delay = time.Duration(rand.Int63n(int64(ceiling) + 1))
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+		delay = apiErr.RetryAfter
+	}
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+
+	return delay
+}
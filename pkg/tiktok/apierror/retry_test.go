@@ -0,0 +1,139 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"canceled", context.Canceled, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"rate limited", &Error{Kind: ErrRateLimited}, true},
+		{"server error", &Error{Kind: ErrServer}, true},
+		{"not found", &Error{Kind: ErrNotFound}, false},
+		{"quota", &Error{Kind: ErrQuotaExceeded}, false},
+		{"unclassified", &Error{StatusCode: http.StatusTeapot}, false},
+		{"dropped connection", io.ErrUnexpectedEOF, true},
+		{"other", errors.New("invalid user ID"), false},
+	}
+
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	errServer := &Error{Kind: ErrServer}
+
+	// Full jitter: anywhere from 0 to BaseDelay doubled per attempt, up to
+	// MaxDelay
+	ceilings := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, ceiling := range ceilings {
+		attempt := i + 1
+		for n := 0; n < 200; n++ {
+			if d := b.delay(attempt, errServer); d < 0 || d > ceiling {
+				t.Fatalf("attempt %d: got delay %s, want at most %s", attempt, d, ceiling)
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{"retry after raises the delay", 500 * time.Millisecond, 500 * time.Millisecond},
+		{"retry after is capped at MaxDelay", time.Hour, time.Second},
+	}
+	for _, tt := range tests {
+		// The first attempt's jitter is at most 100ms, below both
+		err := &Error{Kind: ErrRateLimited, RetryAfter: tt.retryAfter}
+		if d := b.delay(1, err); d != tt.want {
+			t.Errorf("%s: got delay %s, want %s", tt.name, d, tt.want)
+		}
+	}
+
+	if d := (Backoff{}).delay(3, errServer); d != 0 {
+		t.Errorf("got delay %s without a base delay, want 0", d)
+	}
+}
+
+func TestBackoffDo(t *testing.T) {
+	b := Backoff{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	errServer := &Error{Kind: ErrServer}
+	errNotFound := &Error{Kind: ErrNotFound}
+
+	tests := []struct {
+		name  string
+		errs  []error
+		want  error
+		calls int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"retried", []error{errServer, errServer, nil}, nil, 3},
+		{"out of attempts", []error{errServer, errServer, errServer, nil}, errServer, 3},
+		{"not retryable", []error{errNotFound, nil}, errNotFound, 1},
+		{"retried until not retryable", []error{errServer, errNotFound, nil}, errNotFound, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := b.Do(context.Background(), func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if err != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			if calls != tt.calls {
+				t.Errorf("called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestBackoffDoCanceled(t *testing.T) {
+	b := Backoff{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	errRateLimited := &Error{Kind: ErrRateLimited, RetryAfter: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Do(ctx, func() error {
+			calls++
+			return errRateLimited
+		})
+	}()
+
+	// Do is waiting an hour before the second attempt
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != errRateLimited {
+			t.Errorf("got error %v, want the last attempt's", err)
+		}
+		if calls != 1 {
+			t.Errorf("called %d times, want once", calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do kept waiting after the context was canceled")
+	}
+}
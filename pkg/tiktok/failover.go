@@ -0,0 +1,133 @@
+package tiktok
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+)
+
+// Failover is a Provider that tries its providers in order, moving on to the
+// next one when a provider fails rather than the request. A user that one
+// provider reports as missing is not looked up in the others.
+//
+// Feed cursors only mean something to the provider that issued them, so the
+// next page of a feed is fetched from the provider that served the last one.
+// If that provider fails, the feed restarts from its first page on the next
+// provider, and callers see its awemes again. A cursor Failover did not
+// issue, such as one saved before a restart, is taken to be the first
+// provider's.
+type Failover struct {
+	Providers []Provider
+
+	mu sync.Mutex
+	// feeds is the last cursor issued for the feed of each user, and the
+	// index of the provider that issued it.
+	feeds map[string]feedCursor
+}
+
+type feedCursor struct {
+	cursor   int64
+	provider int
+}
+
+func NewFailover(providers ...Provider) *Failover {
+	return &Failover{
+		Providers: providers,
+	}
+}
+
+// shouldFailover reports whether err says the provider is unusable, rather
+// than that the request can not succeed anywhere.
+func shouldFailover(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	return errors.Is(err, apierror.ErrRateLimited) ||
+		errors.Is(err, apierror.ErrQuotaExceeded) ||
+		errors.Is(err, apierror.ErrUnauthorized) ||
+		errors.Is(err, apierror.ErrServer) ||
+		errors.Is(err, apierror.ErrMalformed) ||
+		apierror.Retryable(err)
+}
+
+// failover calls call with the index of each provider in order, starting
+// with the first, until one succeeds.
+func failover[T any](f *Failover, first int, call func(i int) (T, error)) (T, error) {
+	var zero T
+	err := errors.New("no providers configured")
+
+	n := len(f.Providers)
+	for j := 0; j < n; j++ {
+		i := (first + j) % n
+
+		var v T
+		v, err = call(i)
+		if err == nil {
+			return v, nil
+		}
+		if !shouldFailover(err) {
+			return zero, err
+		}
+
+		if j < n-1 {
+			log.Printf("provider %d failed, failing over: %s", i, err)
+		}
+	}
+
+	return zero, err
+}
+
+func (f *Failover) FetchUserIdContext(ctx context.Context, username string) (string, error) {
+	return failover(f, 0, func(i int) (string, error) {
+		return f.Providers[i].FetchUserIdContext(ctx, username)
+	})
+}
+
+func (f *Failover) FetchUserDataContext(ctx context.Context, userId string) (*User, error) {
+	return failover(f, 0, func(i int) (*User, error) {
+		return f.Providers[i].FetchUserDataContext(ctx, userId)
+	})
+}
+
+func (f *Failover) FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*FeedChunk, error) {
+	issuer := f.issuer(userId, maxCursor)
+
+	return failover(f, issuer, func(i int) (*FeedChunk, error) {
+		cursor := maxCursor
+		if i != issuer && cursor != 0 {
+			log.Printf("restarting the feed of user #%s on provider %d", userId, i)
+			cursor = 0
+		}
+
+		chunk, err := f.Providers[i].FetchUserFeedContext(ctx, userId, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.feeds == nil {
+			f.feeds = make(map[string]feedCursor)
+		}
+		f.feeds[userId] = feedCursor{cursor: chunk.MaxCursor, provider: i}
+
+		return chunk, nil
+	})
+}
+
+// issuer returns the index of the provider that issued cursor for the feed of
+// the user. The first page can be fetched from any provider, so it is the
+// first provider's.
+func (f *Failover) issuer(userId string, cursor int64) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if feed, ok := f.feeds[userId]; ok && cursor != 0 && feed.cursor == cursor {
+		return feed.provider
+	}
+	return 0
+}
@@ -0,0 +1,201 @@
+package tiktok
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+)
+
+var (
+	errRateLimited = &apierror.Error{StatusCode: http.StatusTooManyRequests, Kind: apierror.ErrRateLimited}
+	errNotFound    = &apierror.Error{StatusCode: http.StatusNotFound, Kind: apierror.ErrNotFound}
+)
+
+// fakeProvider serves a feed of three pages of one aweme each. The awemes are
+// the same for every provider, but the cursors start at base so they tell
+// the providers apart, and so does the description of the awemes.
+type fakeProvider struct {
+	name string
+	base int64
+	err  error
+
+	// cursors are the cursors the feed was fetched with
+	cursors []int64
+	calls   int
+}
+
+func (p *fakeProvider) FetchUserIdContext(ctx context.Context, username string) (string, error) {
+	p.calls++
+	if p.err != nil {
+		return "", p.err
+	}
+	return p.name, nil
+}
+
+func (p *fakeProvider) FetchUserDataContext(ctx context.Context, userId string) (*User, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &User{UID: userId, Nickname: p.name}, nil
+}
+
+func (p *fakeProvider) FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*FeedChunk, error) {
+	p.calls++
+	p.cursors = append(p.cursors, maxCursor)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	page := int64(0)
+	if maxCursor != 0 {
+		page = maxCursor - p.base
+	}
+	return &FeedChunk{
+		MaxCursor: p.base + page + 1,
+		HasMore:   page < 2,
+		AwemeList: []Aweme{{AwemeID: strconv.FormatInt(page, 10), Desc: p.name, CreateTime: 100 - page}},
+	}, nil
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		primaryErr error
+		want       string
+		wantErr    error
+		// secondaryCalls is how often the secondary should be called
+		secondaryCalls int
+	}{
+		{name: "primary works", want: "primary"},
+		{name: "rate limited", primaryErr: errRateLimited, want: "secondary", secondaryCalls: 1},
+		{name: "server error", primaryErr: apierror.FromMessage(http.StatusOK, 0, ""), want: "secondary", secondaryCalls: 1},
+		{name: "not found", primaryErr: errNotFound, wantErr: apierror.ErrNotFound},
+		{name: "canceled", primaryErr: context.Canceled, wantErr: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &fakeProvider{name: "primary", err: tt.primaryErr}
+			secondary := &fakeProvider{name: "secondary"}
+			f := NewFailover(primary, secondary)
+
+			got, err := f.FetchUserIdContext(ctx, "someone")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if primary.calls != 1 || secondary.calls != tt.secondaryCalls {
+				t.Errorf("called the primary %d times and the secondary %d times, want once and %d times", primary.calls, secondary.calls, tt.secondaryCalls)
+			}
+		})
+	}
+}
+
+func TestFailoverAllFail(t *testing.T) {
+	f := NewFailover(&fakeProvider{err: errRateLimited}, &fakeProvider{err: errRateLimited})
+	if _, err := f.FetchUserDataContext(context.Background(), "1"); !errors.Is(err, apierror.ErrRateLimited) {
+		t.Errorf("got error %v, want the last provider's", err)
+	}
+
+	if _, err := NewFailover().FetchUserDataContext(context.Background(), "1"); err == nil {
+		t.Error("got no error without providers")
+	}
+}
+
+func TestFailoverFeedCursors(t *testing.T) {
+	ctx := context.Background()
+	primary := &fakeProvider{name: "primary", base: 1000}
+	secondary := &fakeProvider{name: "secondary", base: 2000}
+	f := NewFailover(primary, secondary)
+
+	chunk, err := f.FetchUserFeedContext(ctx, "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary's cursor is not sent to the secondary, which starts over
+	primary.err = errRateLimited
+	chunk, err = f.FetchUserFeedContext(ctx, "1", chunk.MaxCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := chunk.AwemeList[0]; a.Desc != "secondary" || a.AwemeID != "0" {
+		t.Fatalf("got aweme %s of the %s, want the secondary's first", a.AwemeID, a.Desc)
+	}
+
+	// The secondary's cursor stays with the secondary, even once the
+	// primary is back
+	primary.err = nil
+	if _, err := f.FetchUserFeedContext(ctx, "1", chunk.MaxCursor); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int64{0, 1001}; !equalCursors(primary.cursors, want) {
+		t.Errorf("primary got cursors %v, want %v", primary.cursors, want)
+	}
+	if want := []int64{0, 2001}; !equalCursors(secondary.cursors, want) {
+		t.Errorf("secondary got cursors %v, want %v", secondary.cursors, want)
+	}
+}
+
+func TestFailoverAwemeList(t *testing.T) {
+	primary := &fakeProvider{name: "primary", base: 1000}
+	secondary := &fakeProvider{name: "secondary", base: 2000}
+	f := NewFailover(primary, secondary)
+
+	// The primary fails after the first page, so the feed restarts on the
+	// secondary
+	failing := &failAfter{Provider: f, pages: 1, fail: func() { primary.err = errRateLimited }}
+	awemes, err := AwemeListAfterCursor(context.Background(), failing, "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, a := range awemes {
+		ids = append(ids, a.AwemeID)
+	}
+	if len(ids) != 3 || ids[0] != "0" || ids[1] != "1" || ids[2] != "2" {
+		t.Errorf("got awemes %v, want each of the three once", ids)
+	}
+}
+
+// failAfter calls fail once pages pages of the feed have been fetched.
+type failAfter struct {
+	Provider
+	pages int
+	fail  func()
+}
+
+func (p *failAfter) FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*FeedChunk, error) {
+	if p.pages == 0 {
+		p.fail()
+	}
+	p.pages--
+	return p.Provider.FetchUserFeedContext(ctx, userId, maxCursor)
+}
+
+func equalCursors(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+// Package faketiktok serves recorded responses of the scraper and fetcher
+// APIs, and the media they point at, from a local HTTP server. It lets the
+// clients and the server run end to end without network access.
+//
+// Fixtures are laid out as:
+//
+//	users/{id}.json              /user/id/{id}, and /user/{unique_id}
+//	feeds/{id}/{max_cursor}.json /user/id/{id}/feed?max_cursor={max_cursor}
+//	media/{aweme_id}.mp4         the video the /analysis endpoint links to
+//
+// The videos are real but tiny: 15 seconds of a single 16x16 H.264 frame,
+// in a different color for each aweme.
+package faketiktok
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/fetcherapi"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/scraperapi"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// Fixtures returns the fixtures recorded for the fake user @fakeuser.
+func Fixtures() fs.FS {
+	sub, err := fs.Sub(fixtures, "fixtures")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+type Server struct {
+	*httptest.Server
+	Fixtures fs.FS
+
+	mu       sync.Mutex
+	failures []int
+	requests map[string]int
+}
+
+// New starts a fake API server serving the given fixtures. Call Close when
+// done.
+func New(fixtures fs.FS) *Server {
+	s := &Server{
+		Fixtures: fixtures,
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Configure points the clients at the fake server.
+func (s *Server) Configure(scraper *scraperapi.Scraper, fetcher *fetcherapi.Fetcher) error {
+	if scraper != nil {
+		if err := scraper.SetBaseURL(s.URL); err != nil {
+			return err
+		}
+	}
+	if fetcher != nil {
+		if err := fetcher.SetBaseURL(s.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FailNext makes the next requests fail with the given HTTP statuses, in
+// order, before any fixture is served.
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// Requests returns how many requests were made for the path.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	var status int
+	if len(s.failures) > 0 {
+		status, s.failures = s.failures[0], s.failures[1:]
+	}
+	s.mu.Unlock()
+
+	if status != 0 {
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		writeJSON(w, status, map[string]string{"message": http.StatusText(status)})
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "user" && parts[1] == "id" && parts[3] == "feed":
+		s.serveFeed(w, parts[2], r.URL.Query().Get("max_cursor"))
+	case len(parts) == 3 && parts[0] == "user" && parts[1] == "id":
+		s.serveFixture(w, path.Join("users", parts[2]+".json"), userNotFound)
+	case len(parts) == 2 && parts[0] == "user":
+		s.serveUsername(w, parts[1])
+	case len(parts) == 1 && parts[0] == "analysis":
+		s.serveAnalysis(w, r)
+	case len(parts) == 2 && parts[0] == "media":
+		s.serveMedia(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var userNotFound = map[string]interface{}{
+	"status": "ok",
+	"data":   map[string]interface{}{"status_code": 10221},
+}
+
+func (s *Server) serveFixture(w http.ResponseWriter, name string, notFound interface{}) {
+	data, err := fs.ReadFile(s.Fixtures, name)
+	if err != nil {
+		writeJSON(w, http.StatusOK, notFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *Server) serveFeed(w http.ResponseWriter, userID, maxCursor string) {
+	if maxCursor == "" {
+		maxCursor = "0"
+	}
+
+	name := path.Join("feeds", userID, maxCursor+".json")
+	s.serveFixture(w, name, map[string]string{"status": "error"})
+}
+
+// serveUsername looks the user up by unique_id among the user fixtures.
+func (s *Server) serveUsername(w http.ResponseWriter, username string) {
+	names, err := fs.Glob(s.Fixtures, "users/*.json")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, name := range names {
+		data, err := fs.ReadFile(s.Fixtures, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var response scraperapi.UserDataResponse
+		if err := json.Unmarshal(data, &response); err != nil {
+			http.Error(w, fmt.Sprintf("invalid fixture %s: %s", name, err), http.StatusInternalServerError)
+			return
+		}
+
+		if response.Data.User.UniqueID == username {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, userNotFound)
+}
+
+// serveAnalysis resolves a share URL to the media fixture of its aweme.
+func (s *Server) serveAnalysis(w http.ResponseWriter, r *http.Request) {
+	shareURL, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil {
+		writeJSON(w, http.StatusOK, fetcherapi.Response{Code: -1, Msg: "Url parsing is failed! Please check url."})
+		return
+	}
+
+	awemeID := path.Base(shareURL.Path)
+	if _, err := fs.Stat(s.Fixtures, path.Join("media", awemeID+".mp4")); err != nil {
+		writeJSON(w, http.StatusOK, fetcherapi.Response{Code: -1, Msg: "Url parsing is failed! Please check url."})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fetcherapi.Response{
+		Code: 0,
+		Msg:  "success",
+		Data: fetcherapi.Data{
+			AwemeID: awemeID,
+			ID:      awemeID,
+			Play:    fmt.Sprintf("%s/media/%s.mp4", s.URL, awemeID),
+		},
+	})
+}
+
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.Fixtures.Open(path.Join("media", name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	// Serve through ServeContent so Range requests work like on a CDN
+	w.Header().Set("Content-Type", "video/mp4")
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, time.Time{}, rs)
+		return
+	}
+
+	http.Error(w, "fixture is not seekable", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
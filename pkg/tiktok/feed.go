@@ -0,0 +1,152 @@
+package tiktok
+
+import (
+	"context"
+	"errors"
+)
+
+// FeedFetcher fetches a page of a user's feed. Every Provider is one.
+type FeedFetcher interface {
+	FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*FeedChunk, error)
+}
+
+// ErrCursorStuck is returned when the feed claims to have more pages, but
+// keeps returning the same cursor.
+var ErrCursorStuck = errors.New("feed cursor did not advance")
+
+// FeedIterator streams the awemes of a user's feed, newest first, fetching
+// one page at a time. Iteration can be resumed from the cursor returned by
+// MaxCursor, so a long feed can be synced across failures and restarts:
+//
+//	it := NewFeedIterator(ctx, provider, userId, savedCursor)
+//	for it.Next() {
+//		process(it.Aweme())
+//		if it.EndOfPage() {
+//			savedCursor = it.MaxCursor()
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type FeedIterator struct {
+	ctx    context.Context
+	f      FeedFetcher
+	userId string
+
+	cursor int64
+	page   *FeedChunk
+	i      int
+	done   bool
+	err    error
+}
+
+// NewFeedIterator returns an iterator over the feed of the user, starting at
+// the page fetched with cursor. A cursor of 0 starts at the newest aweme.
+func NewFeedIterator(ctx context.Context, f FeedFetcher, userId string, cursor int64) *FeedIterator {
+	return &FeedIterator{
+		ctx:    ctx,
+		f:      f,
+		userId: userId,
+		cursor: cursor,
+	}
+}
+
+// Next advances to the next aweme, fetching the next page when needed. It
+// returns false at the end of the feed or on error.
+func (it *FeedIterator) Next() bool {
+	for !it.done && it.err == nil {
+		if it.page != nil && it.i+1 < len(it.page.AwemeList) {
+			it.i++
+			return true
+		}
+
+		if it.page != nil {
+			if !it.page.HasMore {
+				it.done = true
+				return false
+			}
+			if it.page.MaxCursor == it.cursor {
+				it.err = ErrCursorStuck
+				return false
+			}
+			it.cursor = it.page.MaxCursor
+		}
+
+		page, err := it.f.FetchUserFeedContext(it.ctx, it.userId, it.cursor)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.page = page
+		it.i = -1
+	}
+
+	return false
+}
+
+// Aweme returns the current aweme.
+func (it *FeedIterator) Aweme() *Aweme {
+	return &it.page.AwemeList[it.i]
+}
+
+// IsPinned reports whether the current aweme is pinned to the top of the
+// profile, see FeedChunk.IsPinned.
+func (it *FeedIterator) IsPinned() bool {
+	return it.page.IsPinned(it.i)
+}
+
+// EndOfPage reports whether the current aweme is the last of its page, which
+// is when MaxCursor moves on.
+func (it *FeedIterator) EndOfPage() bool {
+	return it.page != nil && it.i == len(it.page.AwemeList)-1
+}
+
+// MaxCursor returns the cursor to resume from without skipping any aweme
+// that has not been returned yet. Once the current page is used up, that is
+// the cursor of the next page.
+func (it *FeedIterator) MaxCursor() int64 {
+	if it.EndOfPage() && it.page.HasMore {
+		return it.page.MaxCursor
+	}
+	return it.cursor
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *FeedIterator) Err() error {
+	return it.err
+}
+
+// AwemeListAfterCursor pages through the feed of the user and returns the
+// awemes created after cursor. Awemes seen again, as when a Failover restarts
+// the feed, are only returned once.
+func AwemeListAfterCursor(ctx context.Context, f FeedFetcher, userId string, cursor int64) ([]Aweme, error) {
+	var allAwemes []Aweme
+	seen := make(map[string]bool)
+
+	it := NewFeedIterator(ctx, f, userId, 0)
+	for it.Next() {
+		aweme := it.Aweme()
+		if aweme.CreateTime > cursor {
+			if !seen[aweme.AwemeID] {
+				allAwemes = append(allAwemes, *aweme)
+				seen[aweme.AwemeID] = true
+			}
+			continue
+		}
+
+		// Pinned awemes can be older than the cursor without marking the
+		// end of the new ones, so skip past them.
+		if it.IsPinned() {
+			continue
+		}
+
+		break
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return allAwemes, nil
+}
@@ -1,6 +1,7 @@
 package fetcherapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,27 +9,48 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
 	"go.uber.org/ratelimit"
 )
 
 type Fetcher struct {
+	APIScheme  string
 	APIHost    string
 	APIKey     string
 	RateLimit  ratelimit.Limiter
 	HttpClient *http.Client
+	Backoff    apierror.Backoff
 }
 
 func New(apiKey string) *Fetcher {
 	return &Fetcher{
+		APIScheme: "https",
 		APIHost:   "tiktok-download-without-watermark.p.rapidapi.com",
 		APIKey:    apiKey,
 		RateLimit: ratelimit.New(2, ratelimit.Per(time.Second)),
 		HttpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		Backoff: apierror.DefaultBackoff,
 	}
 }
 
+// SetBaseURL points the client at another server, such as a local fake of
+// the API. Only the scheme and host of baseURL are used.
+func (t *Fetcher) SetBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid base URL %q", baseURL)
+	}
+
+	t.APIScheme = u.Scheme
+	t.APIHost = u.Host
+	return nil
+}
+
 type Response struct {
 	Code          int     `json:"code"`
 	Msg           string  `json:"msg"`
@@ -79,33 +101,60 @@ type Author struct {
 
 // GetVideoURL fetches the video URL using the unofficial TikTok API
 func (t *Fetcher) GetVideoURL(tiktokURL string) (string, error) {
-	encodedURL := url.QueryEscape(tiktokURL)
-	apiURL := fmt.Sprintf("https://%s/analysis?url=%s&hd=1", t.APIHost, encodedURL)
-
-	req, _ := http.NewRequest("GET", apiURL, nil)
-
-	req.Header.Add("X-RapidAPI-Key", t.APIKey)
-	req.Header.Add("X-RapidAPI-Host", t.APIHost)
-
-	t.RateLimit.Take()
-	res, err := t.HttpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
+	return t.GetVideoURLContext(context.Background(), tiktokURL)
+}
 
-	defer res.Body.Close()
-	body, _ := io.ReadAll(res.Body)
+// GetVideoURLContext is like GetVideoURL, but aborts the request when ctx is done
+func (t *Fetcher) GetVideoURLContext(ctx context.Context, tiktokURL string) (string, error) {
+	encodedURL := url.QueryEscape(tiktokURL)
+	apiURL := fmt.Sprintf("%s://%s/analysis?url=%s&hd=1", t.APIScheme, t.APIHost, encodedURL)
 
 	var response Response
-	err = json.Unmarshal(body, &response)
+	err := t.Backoff.Do(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("X-RapidAPI-Key", t.APIKey)
+		req.Header.Add("X-RapidAPI-Host", t.APIHost)
+
+		t.RateLimit.Take()
+		res, err := t.HttpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		if apiErr := apierror.FromResponse(res, body); apiErr != nil {
+			return apiErr
+		}
+
+		if err := json.Unmarshal(body, &response); err != nil {
+			return apierror.Malformed(res, err)
+		}
+
+		return response.err()
+	})
 	if err != nil {
 		return "", err
 	}
 
-	if response.Code != 0 {
-		return "", fmt.Errorf("API error: %s", response.Msg)
-	}
-
 	videoURL := response.Data.Play
 	return videoURL, nil
 }
+
+// err classifies a non-zero response code. The API reports its own rate limit
+// through the code and message rather than the HTTP status.
+func (r *Response) err() error {
+	if r.Code == 0 {
+		return nil
+	}
+
+	return apierror.FromMessage(http.StatusOK, r.Code, r.Msg)
+}
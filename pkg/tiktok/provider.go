@@ -0,0 +1,19 @@
+// Package tiktok defines the interface the server uses to look up TikTok
+// users and their feeds, so it does not depend on a single API provider.
+package tiktok
+
+import "context"
+
+// Provider looks up TikTok users and pages through their feeds. Errors
+// should be *apierror.Error values where possible, so callers can tell a
+// missing user from a failing provider.
+type Provider interface {
+	FetchUserIdContext(ctx context.Context, username string) (string, error)
+	FetchUserDataContext(ctx context.Context, userId string) (*User, error)
+	FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*FeedChunk, error)
+}
+
+// FetchAwemeList pages through the whole feed of the user.
+func FetchAwemeList(ctx context.Context, p Provider, userId string) ([]Aweme, error) {
+	return AwemeListAfterCursor(ctx, p, userId, 0)
+}
@@ -1,37 +1,61 @@
 package scraperapi
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
 	"go.uber.org/ratelimit"
 )
 
 type Scraper struct {
+	APIScheme  string
 	APIHost    string
 	APIKey     string
 	RateLimit  ratelimit.Limiter
 	HttpClient *http.Client
+	Backoff    apierror.Backoff
 }
 
 func New(apiKey string) *Scraper {
 	return &Scraper{
+		APIScheme: "https",
 		APIHost:   "tiktok-best-experience.p.rapidapi.com",
 		APIKey:    apiKey,
 		RateLimit: ratelimit.New(50, ratelimit.Per(time.Minute)),
 		HttpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		Backoff: apierror.DefaultBackoff,
 	}
 }
 
+// SetBaseURL points the client at another server, such as a local fake of
+// the API. Only the scheme and host of baseURL are used.
+func (t *Scraper) SetBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid base URL %q", baseURL)
+	}
+
+	t.APIScheme = u.Scheme
+	t.APIHost = u.Host
+	return nil
+}
+
 type UserDataResponse struct {
-	Status string     `json:"status"`
-	Data   UserLookup `json:"data"`
+	Status  string     `json:"status"`
+	Message string     `json:"message"`
+	Data    UserLookup `json:"data"`
 }
 
 type UserLookup struct {
@@ -114,8 +138,9 @@ type VideoIcon struct {
 }
 
 type UserFeedResponse struct {
-	Status string    `json:"status"`
-	Data   FeedChunk `json:"data"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Data    FeedChunk `json:"data"`
 }
 
 type FeedChunk struct {
@@ -149,6 +174,7 @@ type Aweme struct {
 	MiscInfo       string       `json:"misc_info"`
 	DistributeType int          `json:"distribute_type"`
 	VideoControl   VideoControl `json:"video_control"`
+	IsTop          int          `json:"is_top"`
 }
 
 type TextExtra struct {
@@ -285,154 +311,236 @@ type Image struct {
 	Height  int      `json:"height"`
 }
 
-func (t *Scraper) FetchUserData(userId string) (*User, error) {
-	url := fmt.Sprintf("https://%s/user/id/%s", t.APIHost, userId)
+// get requests the API path and decodes the JSON response into v. Requests
+// that fail with a retryable error are retried according to t.Backoff.
+func (t *Scraper) get(ctx context.Context, path string, v interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s%s", t.APIScheme, t.APIHost, path)
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
+	return t.Backoff.Do(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+		if err != nil {
+			return err
+		}
 
-	req.Header.Add("X-RapidAPI-Key", t.APIKey)
-	req.Header.Add("X-RapidAPI-Host", t.APIHost)
+		req.Header.Add("X-RapidAPI-Key", t.APIKey)
+		req.Header.Add("X-RapidAPI-Host", t.APIHost)
 
-	t.RateLimit.Take()
-	res, err := t.HttpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
+		t.RateLimit.Take()
+		res, err := t.HttpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
 
-	var response UserDataResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling JSON response: %w", err)
-	}
+		if apiErr := apierror.FromResponse(res, body); apiErr != nil {
+			return apiErr
+		}
 
-	if response.Status != "ok" {
-		return nil, errors.New("endpoint failed to return ok status")
+		if err := json.Unmarshal(body, v); err != nil {
+			return apierror.Malformed(res, err)
+		}
+
+		return nil
+	})
+}
+
+func (t *Scraper) FetchUserData(userId string) (*tiktok.User, error) {
+	return t.FetchUserDataContext(context.Background(), userId)
+}
+
+func (t *Scraper) FetchUserDataContext(ctx context.Context, userId string) (*tiktok.User, error) {
+	var response UserDataResponse
+	if err := t.get(ctx, fmt.Sprintf("/user/id/%s", userId), &response); err != nil {
+		return nil, err
 	}
 
-	if response.Data.StatusCode != 0 {
-		return nil, errors.New("endpoint failed to find user")
+	if err := response.err(); err != nil {
+		return nil, err
 	}
 
-	return &response.Data.User, nil
+	return response.Data.User.normalize(), nil
 }
 
 func (t *Scraper) FetchUserId(username string) (string, error) {
-	url := fmt.Sprintf("https://%s/user/%s", t.APIHost, username)
+	return t.FetchUserIdContext(context.Background(), username)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
+func (t *Scraper) FetchUserIdContext(ctx context.Context, username string) (string, error) {
+	var response UserDataResponse
+	if err := t.get(ctx, fmt.Sprintf("/user/%s", username), &response); err != nil {
 		return "", err
 	}
 
-	req.Header.Add("X-RapidAPI-Key", t.APIKey)
-	req.Header.Add("X-RapidAPI-Host", t.APIHost)
-
-	t.RateLimit.Take()
-	res, err := t.HttpClient.Do(req)
-	if err != nil {
+	if err := response.err(); err != nil {
 		return "", err
 	}
-	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return "", err
-	}
+	return response.Data.User.UID, nil
+}
 
-	var response UserDataResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return "", fmt.Errorf("error unmarshaling JSON response: %w", err)
+func (r *UserDataResponse) err() error {
+	if r.Status != "ok" {
+		return statusError(r.Message, "endpoint failed to return ok status")
 	}
 
-	if response.Status != "ok" {
-		return "", errors.New("endpoint failed to return ok status")
+	if r.Data.StatusCode != 0 {
+		return &apierror.Error{
+			StatusCode: http.StatusOK,
+			Code:       r.Data.StatusCode,
+			Message:    "endpoint failed to find user",
+			Kind:       apierror.ErrNotFound,
+		}
 	}
 
-	if response.Data.StatusCode != 0 {
-		return "", errors.New("endpoint failed to find user")
+	return nil
+}
+
+// statusError classifies a response without an ok status by the message it
+// gave, falling back to fallback if it gave none. Failures that do not say
+// what went wrong are server errors, so they are retried and fail over.
+func statusError(message, fallback string) error {
+	if message == "" {
+		message = fallback
 	}
+	return apierror.FromMessage(http.StatusOK, 0, message)
+}
 
-	return response.Data.User.UID, nil
+func (t *Scraper) FetchUserFeed(userId string, maxCursor int64) (*tiktok.FeedChunk, error) {
+	return t.FetchUserFeedContext(context.Background(), userId, maxCursor)
 }
 
-func (t *Scraper) FetchUserFeed(userId string, maxCursor int64) (*FeedChunk, error) {
-	url := fmt.Sprintf("https://%s/user/id/%s/feed", t.APIHost, userId)
+func (t *Scraper) FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*tiktok.FeedChunk, error) {
+	path := fmt.Sprintf("/user/id/%s/feed", userId)
 	if maxCursor > 0 {
-		url = fmt.Sprintf("%s?max_cursor=%d", url, maxCursor)
+		path = fmt.Sprintf("%s?max_cursor=%d", path, maxCursor)
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
+	var response UserFeedResponse
+	if err := t.get(ctx, path, &response); err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("X-RapidAPI-Key", t.APIKey)
-	req.Header.Add("X-RapidAPI-Host", t.APIHost)
-
-	t.RateLimit.Take()
-	res, err := t.HttpClient.Do(req)
-	if err != nil {
-		return nil, err
+	if response.Status != "ok" {
+		return nil, statusError(response.Message, "failed to fetch user feed")
 	}
-	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
+	return response.Data.normalize(), nil
+}
 
-	var response UserFeedResponse
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling JSON response: %w", err)
-	}
+func (t *Scraper) FetchUserAwemeListAfterCursor(userId string, cursor int64) ([]tiktok.Aweme, error) {
+	return t.FetchUserAwemeListAfterCursorContext(context.Background(), userId, cursor)
+}
 
-	if response.Status != "ok" {
-		return nil, errors.New("failed to fetch user feed")
-	}
+func (t *Scraper) FetchUserAwemeListAfterCursorContext(ctx context.Context, userId string, cursor int64) ([]tiktok.Aweme, error) {
+	return tiktok.AwemeListAfterCursor(ctx, t, userId, cursor)
+}
 
-	return &response.Data, nil
+func (t *Scraper) FetchUserAwemeList(userId string) ([]tiktok.Aweme, error) {
+	return t.FetchUserAwemeListContext(context.Background(), userId)
 }
 
-func (t *Scraper) FetchUserAwemeListAfterCursor(userId string, cursor int64) ([]Aweme, error) {
-	var allAwemes []Aweme
-	var maxCursor int64
+func (t *Scraper) FetchUserAwemeListContext(ctx context.Context, userId string) ([]tiktok.Aweme, error) {
+	minCursor := int64(0)
+	return t.FetchUserAwemeListAfterCursorContext(ctx, userId, minCursor)
+}
 
-	for {
-		data, err := t.FetchUserFeed(userId, maxCursor)
-		if err != nil {
-			return nil, err
-		}
+var _ tiktok.Provider = (*Scraper)(nil)
 
-		for _, aweme := range data.AwemeList {
-			if aweme.CreateTime > cursor {
-				allAwemes = append(allAwemes, aweme)
-			} else {
-				return allAwemes, nil
-			}
-		}
+func avatar(a Avatar) tiktok.Avatar {
+	return tiktok.Avatar{URI: a.URI, URLList: a.URLList}
+}
 
-		if data.HasMore == 0 {
-			break
-		}
+func (u *User) normalize() *tiktok.User {
+	return &tiktok.User{
+		UID:            u.UID,
+		UniqueID:       u.UniqueID,
+		SecUID:         u.SecUID,
+		Nickname:       u.Nickname,
+		AvatarThumb:    avatar(u.AvatarThumb),
+		AvatarMedium:   avatar(u.AvatarMedium),
+		AvatarLarger:   avatar(u.AvatarLarger),
+		AwemeCount:     u.AwemeCount,
+		FollowerCount:  u.FollowerCount,
+		FollowingCount: u.FollowingCount,
+		TotalFavorited: u.TotalFavorited,
+	}
+}
+
+func (c *FeedChunk) normalize() *tiktok.FeedChunk {
+	chunk := &tiktok.FeedChunk{
+		MaxCursor: c.MaxCursor,
+		HasMore:   c.HasMore != 0,
+		AwemeList: make([]tiktok.Aweme, 0, len(c.AwemeList)),
+	}
 
-		maxCursor = data.MaxCursor
+	for i := range c.AwemeList {
+		chunk.AwemeList = append(chunk.AwemeList, c.AwemeList[i].normalize())
 	}
 
-	return allAwemes, nil
+	return chunk
 }
 
-func (t *Scraper) FetchUserAwemeList(userId string) ([]Aweme, error) {
-	minCursor := int64(0)
-	return t.FetchUserAwemeListAfterCursor(userId, minCursor)
+func (a *Aweme) normalize() tiktok.Aweme {
+	var chaList []tiktok.Challenge
+	for _, cha := range a.ChaList {
+		chaList = append(chaList, tiktok.Challenge{CID: cha.CID, ChaName: cha.ChaName})
+	}
+
+	var textExtra []tiktok.TextExtra
+	for _, extra := range a.TextExtra {
+		textExtra = append(textExtra, tiktok.TextExtra{
+			Start:       extra.Start,
+			End:         extra.End,
+			HashtagName: extra.HashtagName,
+			UserID:      extra.UserID,
+			Type:        extra.Type,
+		})
+	}
+
+	return tiktok.Aweme{
+		AwemeID:    a.AwemeID,
+		Desc:       a.Desc,
+		CreateTime: a.CreateTime,
+		Author: tiktok.Author{
+			UID:      a.Author.UID,
+			UniqueID: a.Author.UniqueID,
+			SecUID:   a.Author.SecUID,
+			Nickname: a.Author.Nickname,
+		},
+		AuthorUserID: a.AuthorUserID,
+		Music: tiktok.Music{
+			ID:         a.Music.ID,
+			Title:      a.Music.Title,
+			Author:     a.Music.Author,
+			Album:      a.Music.Album,
+			IsOriginal: a.Music.IsOriginal,
+		},
+		ChaList:   chaList,
+		TextExtra: textExtra,
+		Video: tiktok.Video{
+			Width:    a.Video.Width,
+			Height:   a.Video.Height,
+			Duration: a.Video.Duration,
+		},
+		ShareURL: a.ShareURL,
+		Statistics: tiktok.Statistics{
+			CommentCount:  a.Statistics.CommentCount,
+			DiggCount:     a.Statistics.DiggCount,
+			DownloadCount: a.Statistics.DownloadCount,
+			PlayCount:     a.Statistics.PlayCount,
+			ShareCount:    a.Statistics.ShareCount,
+		},
+		Status: tiktok.Status{
+			IsDelete:      a.Status.IsDelete,
+			IsProhibited:  a.Status.IsProhibited,
+			PrivateStatus: a.Status.PrivateStatus,
+		},
+		Region: a.Region,
+		IsTop:  a.IsTop,
+	}
 }
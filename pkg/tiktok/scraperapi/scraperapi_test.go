@@ -0,0 +1,54 @@
+package scraperapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+	"go.uber.org/ratelimit"
+)
+
+// newStatusScraper returns a scraper talking to a server that answers every
+// request with body.
+func newStatusScraper(t *testing.T, body string) *Scraper {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+
+	s := New("key")
+	s.RateLimit = ratelimit.NewUnlimited()
+	if err := s.SetBaseURL(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		body string
+		kind error
+	}{
+		{`{"status":"error"}`, apierror.ErrServer},
+		{`{"status":"error","message":"Internal Server Error"}`, apierror.ErrServer},
+		{`{"status":"error","message":"User not found"}`, apierror.ErrNotFound},
+		{`{"status":"error","message":"Too many requests, rate limit exceeded"}`, apierror.ErrRateLimited},
+	}
+
+	for _, tt := range tests {
+		s := newStatusScraper(t, tt.body)
+
+		if _, err := s.FetchUserIdContext(context.Background(), "someone"); !errors.Is(err, tt.kind) {
+			t.Errorf("FetchUserIdContext with %s: got %v, want %v", tt.body, err, tt.kind)
+		}
+		if _, err := s.FetchUserFeedContext(context.Background(), "1", 0); !errors.Is(err, tt.kind) {
+			t.Errorf("FetchUserFeedContext with %s: got %v, want %v", tt.body, err, tt.kind)
+		}
+	}
+}
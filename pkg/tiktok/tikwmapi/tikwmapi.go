@@ -0,0 +1,341 @@
+// Package tikwmapi is a tiktok.Provider backed by the TikWM API, served on
+// RapidAPI as tiktok-scraper7. Its responses are normalized into the tiktok
+// domain types.
+package tikwmapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+	"go.uber.org/ratelimit"
+)
+
+type Client struct {
+	APIScheme  string
+	APIHost    string
+	APIKey     string
+	RateLimit  ratelimit.Limiter
+	HttpClient *http.Client
+	Backoff    apierror.Backoff
+}
+
+func New(apiKey string) *Client {
+	return &Client{
+		APIScheme: "https",
+		APIHost:   "tiktok-scraper7.p.rapidapi.com",
+		APIKey:    apiKey,
+		RateLimit: ratelimit.New(1, ratelimit.Per(time.Second)),
+		HttpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		Backoff: apierror.DefaultBackoff,
+	}
+}
+
+// SetBaseURL points the client at another server, such as a local fake of
+// the API. Only the scheme and host of baseURL are used.
+func (c *Client) SetBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid base URL %q", baseURL)
+	}
+
+	c.APIScheme = u.Scheme
+	c.APIHost = u.Host
+	return nil
+}
+
+// postsPerPage is the largest page size the posts endpoint accepts.
+const postsPerPage = 35
+
+type Response struct {
+	Code          int             `json:"code"`
+	Msg           string          `json:"msg"`
+	ProcessedTime float64         `json:"processed_time"`
+	Data          json.RawMessage `json:"data"`
+}
+
+type UserInfo struct {
+	User  User      `json:"user"`
+	Stats UserStats `json:"stats"`
+}
+
+type User struct {
+	ID             string `json:"id"`
+	UniqueID       string `json:"uniqueId"`
+	Nickname       string `json:"nickname"`
+	AvatarThumb    string `json:"avatarThumb"`
+	AvatarMedium   string `json:"avatarMedium"`
+	AvatarLarger   string `json:"avatarLarger"`
+	Signature      string `json:"signature"`
+	Verified       bool   `json:"verified"`
+	SecUID         string `json:"secUid"`
+	PrivateAccount bool   `json:"privateAccount"`
+}
+
+type UserStats struct {
+	FollowingCount int `json:"followingCount"`
+	FollowerCount  int `json:"followerCount"`
+	HeartCount     int `json:"heartCount"`
+	VideoCount     int `json:"videoCount"`
+	DiggCount      int `json:"diggCount"`
+}
+
+type Posts struct {
+	Videos  []Video `json:"videos"`
+	Cursor  string  `json:"cursor"`
+	HasMore bool    `json:"hasMore"`
+}
+
+type Video struct {
+	AwemeID       string    `json:"aweme_id"`
+	VideoID       string    `json:"video_id"`
+	Region        string    `json:"region"`
+	Title         string    `json:"title"`
+	Cover         string    `json:"cover"`
+	Duration      int       `json:"duration"`
+	Play          string    `json:"play"`
+	WmPlay        string    `json:"wmplay"`
+	Size          int       `json:"size"`
+	MusicInfo     MusicInfo `json:"music_info"`
+	PlayCount     int       `json:"play_count"`
+	DiggCount     int       `json:"digg_count"`
+	CommentCount  int       `json:"comment_count"`
+	ShareCount    int       `json:"share_count"`
+	DownloadCount int       `json:"download_count"`
+	CreateTime    int64     `json:"create_time"`
+	IsTop         int       `json:"is_top"`
+	Author        Author    `json:"author"`
+}
+
+type MusicInfo struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Author   string `json:"author"`
+	Original bool   `json:"original"`
+	Album    string `json:"album"`
+}
+
+type Author struct {
+	ID       string `json:"id"`
+	UniqueID string `json:"unique_id"`
+	Nickname string `json:"nickname"`
+	Avatar   string `json:"avatar"`
+}
+
+// get requests the API path and decodes the data of the response into v.
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	apiURL := fmt.Sprintf("%s://%s%s?%s", c.APIScheme, c.APIHost, path, query.Encode())
+
+	return c.Backoff.Do(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("X-RapidAPI-Key", c.APIKey)
+		req.Header.Add("X-RapidAPI-Host", c.APIHost)
+
+		c.RateLimit.Take()
+		res, err := c.HttpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		if apiErr := apierror.FromResponse(res, body); apiErr != nil {
+			return apiErr
+		}
+
+		var response Response
+		if err := json.Unmarshal(body, &response); err != nil {
+			return apierror.Malformed(res, err)
+		}
+
+		if response.Code != 0 {
+			return apierror.FromMessage(res.StatusCode, response.Code, response.Msg)
+		}
+
+		if err := json.Unmarshal(response.Data, v); err != nil {
+			return apierror.Malformed(res, err)
+		}
+
+		return nil
+	})
+}
+
+func (c *Client) fetchUserInfo(ctx context.Context, query url.Values) (*UserInfo, error) {
+	var info UserInfo
+	if err := c.get(ctx, "/user/info", query, &info); err != nil {
+		return nil, err
+	}
+
+	if info.User.ID == "" {
+		return nil, &apierror.Error{
+			StatusCode: http.StatusOK,
+			Message:    "endpoint failed to find user",
+			Kind:       apierror.ErrNotFound,
+		}
+	}
+
+	return &info, nil
+}
+
+func (c *Client) FetchUserIdContext(ctx context.Context, username string) (string, error) {
+	info, err := c.fetchUserInfo(ctx, url.Values{"unique_id": {username}})
+	if err != nil {
+		return "", err
+	}
+
+	return info.User.ID, nil
+}
+
+func (c *Client) FetchUserDataContext(ctx context.Context, userId string) (*tiktok.User, error) {
+	info, err := c.fetchUserInfo(ctx, url.Values{"user_id": {userId}})
+	if err != nil {
+		return nil, err
+	}
+
+	return info.normalize(), nil
+}
+
+func (c *Client) FetchUserFeedContext(ctx context.Context, userId string, maxCursor int64) (*tiktok.FeedChunk, error) {
+	query := url.Values{
+		"user_id": {userId},
+		"count":   {strconv.Itoa(postsPerPage)},
+		"cursor":  {strconv.FormatInt(maxCursor, 10)},
+	}
+
+	var posts Posts
+	if err := c.get(ctx, "/user/posts", query, &posts); err != nil {
+		return nil, err
+	}
+
+	return posts.normalize()
+}
+
+func avatar(url string) tiktok.Avatar {
+	if url == "" {
+		return tiktok.Avatar{}
+	}
+	return tiktok.Avatar{URLList: []string{url}}
+}
+
+func (info *UserInfo) normalize() *tiktok.User {
+	return &tiktok.User{
+		AvatarLarger:   avatar(info.User.AvatarLarger),
+		AvatarMedium:   avatar(info.User.AvatarMedium),
+		AvatarThumb:    avatar(info.User.AvatarThumb),
+		AwemeCount:     info.Stats.VideoCount,
+		FollowerCount:  info.Stats.FollowerCount,
+		FollowingCount: info.Stats.FollowingCount,
+		Nickname:       info.User.Nickname,
+		SecUID:         info.User.SecUID,
+		TotalFavorited: info.Stats.HeartCount,
+		UID:            info.User.ID,
+		UniqueID:       info.User.UniqueID,
+	}
+}
+
+func (p *Posts) normalize() (*tiktok.FeedChunk, error) {
+	chunk := &tiktok.FeedChunk{
+		HasMore:   p.HasMore,
+		AwemeList: make([]tiktok.Aweme, 0, len(p.Videos)),
+	}
+
+	if p.Cursor != "" {
+		cursor, err := strconv.ParseInt(p.Cursor, 10, 64)
+		if err != nil {
+			return nil, &apierror.Error{
+				StatusCode: http.StatusOK,
+				Message:    "invalid cursor",
+				Kind:       apierror.ErrMalformed,
+				Err:        err,
+			}
+		}
+		chunk.MaxCursor = cursor
+	}
+
+	for _, v := range p.Videos {
+		chunk.AwemeList = append(chunk.AwemeList, v.normalize())
+	}
+
+	return chunk, nil
+}
+
+var hashtagRegexp = regexp.MustCompile(`#([\pL\pN_]+)`)
+
+func (v *Video) normalize() tiktok.Aweme {
+	// The API prefixes aweme_id, video_id is the ID TikTok uses
+	id := v.VideoID
+	if id == "" {
+		id = strings.TrimPrefix(v.AwemeID, "v")
+	}
+
+	musicID, _ := strconv.ParseInt(v.MusicInfo.ID, 10, 64)
+	authorID, _ := strconv.ParseInt(v.Author.ID, 10, 64)
+
+	// Hashtags are only part of the title here
+	var textExtra []tiktok.TextExtra
+	for _, m := range hashtagRegexp.FindAllStringSubmatchIndex(v.Title, -1) {
+		textExtra = append(textExtra, tiktok.TextExtra{
+			Start:       m[0],
+			End:         m[1],
+			HashtagName: v.Title[m[2]:m[3]],
+			Type:        1,
+		})
+	}
+
+	return tiktok.Aweme{
+		AwemeID:    id,
+		Desc:       v.Title,
+		CreateTime: v.CreateTime,
+		Author: tiktok.Author{
+			Nickname: v.Author.Nickname,
+			UID:      v.Author.ID,
+			UniqueID: v.Author.UniqueID,
+		},
+		Music: tiktok.Music{
+			ID:         musicID,
+			Title:      v.MusicInfo.Title,
+			Author:     v.MusicInfo.Author,
+			Album:      v.MusicInfo.Album,
+			IsOriginal: v.MusicInfo.Original,
+		},
+		AuthorUserID: authorID,
+		Video: tiktok.Video{
+			Duration: v.Duration * 1000,
+		},
+		ShareURL: fmt.Sprintf("https://www.tiktok.com/@%s/video/%s", v.Author.UniqueID, id),
+		Statistics: tiktok.Statistics{
+			CommentCount:  v.CommentCount,
+			DiggCount:     v.DiggCount,
+			DownloadCount: v.DownloadCount,
+			PlayCount:     v.PlayCount,
+			ShareCount:    v.ShareCount,
+		},
+		TextExtra: textExtra,
+		Region:    v.Region,
+		IsTop:     v.IsTop,
+	}
+}
+
+var _ tiktok.Provider = (*Client)(nil)
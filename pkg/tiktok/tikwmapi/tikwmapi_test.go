@@ -0,0 +1,184 @@
+package tikwmapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/tiktok/apierror"
+	"go.uber.org/ratelimit"
+)
+
+// newTestClient returns a client talking to a server that answers requests
+// to each path with the body in bodies.
+func newTestClient(t *testing.T, bodies map[string]string) *Client {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+
+	c := New("key")
+	c.RateLimit = ratelimit.NewUnlimited()
+	if err := c.SetBaseURL(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+const postsBody = `{
+	"code": 0,
+	"msg": "success",
+	"data": {
+		"videos": [
+			{
+				"aweme_id": "v07220000000000000002",
+				"video_id": "7220000000000000002",
+				"region": "US",
+				"title": "morning #coffee run with #café_vibes",
+				"duration": 15,
+				"music_info": {"id": "7100000000000000001", "title": "original sound", "author": "fake user", "original": true},
+				"play_count": 1200,
+				"digg_count": 300,
+				"comment_count": 12,
+				"share_count": 4,
+				"download_count": 2,
+				"create_time": 1681000000,
+				"is_top": 1,
+				"author": {"id": "6800000000000000001", "unique_id": "fakeuser", "nickname": "Fake User"}
+			},
+			{
+				"aweme_id": "v07220000000000000001",
+				"title": "no tags",
+				"create_time": 1680000000,
+				"author": {"id": "6800000000000000001", "unique_id": "fakeuser"}
+			}
+		],
+		"cursor": "1680000000000",
+		"hasMore": true
+	}
+}`
+
+func TestFetchUserFeed(t *testing.T) {
+	c := newTestClient(t, map[string]string{"/user/posts": postsBody})
+
+	chunk, err := c.FetchUserFeedContext(context.Background(), "6800000000000000001", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunk.MaxCursor != 1680000000000 || !chunk.HasMore {
+		t.Errorf("got cursor %d and more %v, want 1680000000000 and more", chunk.MaxCursor, chunk.HasMore)
+	}
+	if len(chunk.AwemeList) != 2 {
+		t.Fatalf("got %d awemes, want 2", len(chunk.AwemeList))
+	}
+
+	a := chunk.AwemeList[0]
+	if a.AwemeID != "7220000000000000002" || a.Statistics.PlayCount != 1200 || a.Statistics.DiggCount != 300 {
+		t.Errorf("got aweme %s with %d plays and %d diggs", a.AwemeID, a.Statistics.PlayCount, a.Statistics.DiggCount)
+	}
+	if a.Author.UID != "6800000000000000001" || a.AuthorUserID != 6800000000000000001 || a.Author.UniqueID != "fakeuser" {
+		t.Errorf("got author %+v and author ID %d", a.Author, a.AuthorUserID)
+	}
+	if a.Music.ID != 7100000000000000001 || !a.Music.IsOriginal {
+		t.Errorf("got music %+v", a.Music)
+	}
+	if a.Video.Duration != 15000 {
+		t.Errorf("got duration %d ms, want 15000", a.Video.Duration)
+	}
+	if a.ShareURL != "https://www.tiktok.com/@fakeuser/video/7220000000000000002" {
+		t.Errorf("got share URL %s", a.ShareURL)
+	}
+	if a.IsTop != 1 || a.Region != "US" {
+		t.Errorf("got top %d and region %q", a.IsTop, a.Region)
+	}
+
+	// Hashtags are found in the title, with their byte offsets
+	want := []struct {
+		name       string
+		start, end int
+	}{{"coffee", 8, 15}, {"café_vibes", 25, 37}}
+	if len(a.TextExtra) != len(want) {
+		t.Fatalf("got text extras %+v, want %v", a.TextExtra, want)
+	}
+	for i, w := range want {
+		extra := a.TextExtra[i]
+		if extra.HashtagName != w.name || extra.Start != w.start || extra.End != w.end || extra.Type != 1 {
+			t.Errorf("got text extra %+v, want hashtag %s at %d-%d", extra, w.name, w.start, w.end)
+		}
+		if tag := a.Desc[extra.Start:extra.End]; tag != "#"+w.name {
+			t.Errorf("text extra covers %q, want #%s", tag, w.name)
+		}
+	}
+
+	// Without a video_id, the ID is the aweme_id without its prefix
+	if b := chunk.AwemeList[1]; b.AwemeID != "07220000000000000001" || b.TextExtra != nil {
+		t.Errorf("got aweme %s with text extras %+v", b.AwemeID, b.TextExtra)
+	}
+}
+
+func TestFetchUserData(t *testing.T) {
+	c := newTestClient(t, map[string]string{"/user/info": `{
+		"code": 0,
+		"data": {
+			"user": {"id": "6800000000000000001", "uniqueId": "fakeuser", "nickname": "Fake User", "avatarLarger": "https://p16.example.com/large.jpeg?x-expires=1", "secUid": "MS4wLjABAAAA"},
+			"stats": {"followingCount": 10, "followerCount": 2000, "heartCount": 50000, "videoCount": 5}
+		}
+	}`})
+
+	user, err := c.FetchUserDataContext(context.Background(), "6800000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.UID != "6800000000000000001" || user.UniqueID != "fakeuser" || user.SecUID != "MS4wLjABAAAA" {
+		t.Errorf("got user %+v", user)
+	}
+	if user.FollowerCount != 2000 || user.FollowingCount != 10 || user.TotalFavorited != 50000 || user.AwemeCount != 5 {
+		t.Errorf("got counts %+v", user)
+	}
+	if len(user.AvatarLarger.URLList) != 1 || user.AvatarThumb.URLList != nil {
+		t.Errorf("got avatars %+v and %+v, want only the large one", user.AvatarLarger, user.AvatarThumb)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// feed is whether to fetch the feed rather than the user
+		feed bool
+		kind error
+	}{
+		{"unknown user", `{"code": 0, "data": {"user": {}, "stats": {}}}`, false, apierror.ErrNotFound},
+		{"error code", `{"code": -1, "msg": "Free Api Limit: 1 request/second."}`, false, apierror.ErrRateLimited},
+		{"invalid cursor", `{"code": 0, "data": {"videos": [], "cursor": "soon", "hasMore": false}}`, true, apierror.ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, map[string]string{"/user/info": tt.body, "/user/posts": tt.body})
+			c.Backoff.MaxAttempts = 1
+
+			var err error
+			if tt.feed {
+				_, err = c.FetchUserFeedContext(context.Background(), "1", 0)
+			} else {
+				_, err = c.FetchUserIdContext(context.Background(), "someone")
+			}
+			if !errors.Is(err, tt.kind) {
+				t.Errorf("got error %v, want %v", err, tt.kind)
+			}
+		})
+	}
+}
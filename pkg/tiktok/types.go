@@ -0,0 +1,122 @@
+package tiktok
+
+// The domain types are what the server stores and serves. Providers map their
+// API responses into them. The JSON names are the ones scraperapi responses
+// use, so records written before the types moved here still decode.
+
+type User struct {
+	UID            string `json:"uid"`
+	UniqueID       string `json:"unique_id"`
+	SecUID         string `json:"sec_uid"`
+	Nickname       string `json:"nickname"`
+	AvatarThumb    Avatar `json:"avatar_thumb"`
+	AvatarMedium   Avatar `json:"avatar_medium"`
+	AvatarLarger   Avatar `json:"avatar_larger"`
+	AwemeCount     int    `json:"aweme_count"`
+	FollowerCount  int    `json:"follower_count"`
+	FollowingCount int    `json:"following_count"`
+	TotalFavorited int    `json:"total_favorited"`
+}
+
+// Avatar is a profile picture. URI identifies the image, while the URLs in
+// URLList are signed and change from one request to the next.
+type Avatar struct {
+	URI     string   `json:"uri"`
+	URLList []string `json:"url_list"`
+}
+
+// FeedChunk is a page of a user's feed, newest first apart from pinned
+// awemes. MaxCursor fetches the next page if HasMore is set.
+type FeedChunk struct {
+	MaxCursor int64
+	HasMore   bool
+	AwemeList []Aweme
+}
+
+// IsPinned reports whether the i-th aweme of the chunk is pinned to the top of
+// the profile. Pinned awemes are served ahead of the newest-first ordering, so
+// they are either flagged with IsTop or older than an aweme listed after them.
+func (c *FeedChunk) IsPinned(i int) bool {
+	a := c.AwemeList[i]
+	if a.IsTop != 0 {
+		return true
+	}
+
+	for _, next := range c.AwemeList[i+1:] {
+		if next.CreateTime > a.CreateTime {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Aweme struct {
+	AwemeID      string      `json:"aweme_id"`
+	Desc         string      `json:"desc"`
+	CreateTime   int64       `json:"create_time"`
+	Author       Author      `json:"author"`
+	AuthorUserID int64       `json:"author_user_id"`
+	Music        Music       `json:"music"`
+	ChaList      []Challenge `json:"cha_list"`
+	TextExtra    []TextExtra `json:"text_extra"`
+	Video        Video       `json:"video"`
+	ShareURL     string      `json:"share_url"`
+	Statistics   Statistics  `json:"statistics"`
+	Status       Status      `json:"status"`
+	Region       string      `json:"region"`
+	IsTop        int         `json:"is_top"`
+}
+
+type Author struct {
+	UID      string `json:"uid"`
+	UniqueID string `json:"unique_id"`
+	SecUID   string `json:"sec_uid"`
+	Nickname string `json:"nickname"`
+}
+
+type Music struct {
+	ID         int64  `json:"id"`
+	Title      string `json:"title"`
+	Author     string `json:"author"`
+	Album      string `json:"album"`
+	IsOriginal bool   `json:"is_original"`
+}
+
+// Challenge is a hashtag the aweme was tagged with.
+type Challenge struct {
+	CID     string `json:"cid"`
+	ChaName string `json:"cha_name"`
+}
+
+// TextExtra marks a hashtag or a mention in the description, from byte
+// Start to End.
+type TextExtra struct {
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	HashtagName string `json:"hashtag_name,omitempty"`
+	UserID      string `json:"user_id,omitempty"`
+	Type        int    `json:"type,omitempty"`
+}
+
+// Video describes the video of an aweme. Duration is in milliseconds.
+type Video struct {
+	Width    int `json:"width"`
+	Height   int `json:"height"`
+	Duration int `json:"duration"`
+}
+
+type Statistics struct {
+	CommentCount  int `json:"comment_count"`
+	DiggCount     int `json:"digg_count"`
+	DownloadCount int `json:"download_count"`
+	PlayCount     int `json:"play_count"`
+	ShareCount    int `json:"share_count"`
+}
+
+// Status says whether the aweme is still available.
+type Status struct {
+	IsDelete      bool `json:"is_delete"`
+	IsProhibited  bool `json:"is_prohibited"`
+	PrivateStatus int  `json:"private_status"`
+}
@@ -0,0 +1,190 @@
+package videoprocessor
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe"
+)
+
+var (
+	// ErrInvalidVideo is returned by Validate for files that are not a
+	// playable video. Downloading them again is unlikely to help.
+	ErrInvalidVideo = errors.New("invalid video")
+	// ErrCorruptVideo is returned by Validate for files that were damaged on
+	// the way, e.g. cut short, so downloading them again may help.
+	ErrCorruptVideo = errors.New("corrupt video")
+)
+
+// Validate probes a downloaded video. It fails with an error wrapping
+// ErrCorruptVideo if it is truncated or ffprobe cannot read it, and with one
+// wrapping ErrInvalidVideo if it has no video stream, has no duration, or its
+// duration differs from expected. A zero expected duration is not checked.
+func (vp *VideoProcessor) Validate(ctx context.Context, videoPath string, expected time.Duration) error {
+	if err := checkAtoms(videoPath); err != nil {
+		return err
+	}
+
+	r, err := probe.Probe(ctx, videoPath)
+	if err != nil {
+		var probeErr *probe.Error
+		if errors.As(err, &probeErr) {
+			return fmt.Errorf("%w: %s", ErrCorruptVideo, probeErr)
+		}
+		return err
+	}
+
+	if r.VideoStream() == nil {
+		return fmt.Errorf("%w: no video stream", ErrInvalidVideo)
+	}
+
+	duration := r.Format.Duration.Duration()
+	if duration <= 0 {
+		return fmt.Errorf("%w: zero duration", ErrInvalidVideo)
+	}
+
+	if expected > 0 {
+		// TikTok rounds durations, so allow some slack
+		tolerance := expected / 10
+		if tolerance < time.Second {
+			tolerance = time.Second
+		}
+		diff := duration - expected
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > tolerance {
+			return fmt.Errorf("%w: duration %s does not match the expected %s", ErrInvalidVideo, duration.Round(time.Millisecond), expected)
+		}
+	}
+
+	return nil
+}
+
+// checkAtoms walks the top-level atoms of an MP4 file and makes sure none of
+// them runs past the end of the file and that there is a moov atom, without
+// which the video cannot be played. Files that are not MP4 are left to
+// ffprobe.
+func checkAtoms(videoPath string) error {
+	f, err := os.Open(videoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	hasMoov := false
+	header := make([]byte, 16)
+	for offset := int64(0); offset < size; {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%w: truncated atom header at byte %d", ErrCorruptVideo, offset)
+			}
+			return err
+		}
+
+		atomSize := int64(binary.BigEndian.Uint32(header[:4]))
+		atomType := string(header[4:8])
+		headerSize := int64(8)
+
+		// Anything but an ftyp atom up front means it is not an MP4
+		if offset == 0 && atomType != "ftyp" {
+			return nil
+		}
+
+		switch atomSize {
+		case 0:
+			// The atom extends to the end of the file
+			atomSize = size - offset
+		case 1:
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				if err == io.EOF {
+					return fmt.Errorf("%w: truncated %s atom header", ErrCorruptVideo, atomType)
+				}
+				return err
+			}
+			atomSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+
+		if atomSize < headerSize {
+			return fmt.Errorf("%w: invalid %s atom size %d", ErrCorruptVideo, atomType, atomSize)
+		}
+		if atomSize > size-offset {
+			return fmt.Errorf("%w: truncated %s atom, %d of %d bytes present", ErrCorruptVideo, atomType, size-offset, atomSize)
+		}
+
+		if atomType == "moov" {
+			hasMoov = true
+		}
+		offset += atomSize
+	}
+
+	if !hasMoov {
+		return fmt.Errorf("%w: moov atom not found", ErrCorruptVideo)
+	}
+
+	return nil
+}
+
+// Quarantine moves a video that failed validation out of the temporary
+// directory into QuarantinePath as name, so it can be inspected instead of
+// being stored. It returns the new path.
+func (vp *VideoProcessor) Quarantine(videoPath, name string) (string, error) {
+	dir := vp.QuarantinePath
+	if dir == "" {
+		dir = filepath.Join(vp.tmpPath, "quarantine")
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	quarantined := filepath.Join(dir, AddTimestampToFilename(name))
+	if err := os.Rename(videoPath, quarantined); err == nil {
+		return quarantined, nil
+	}
+
+	// The quarantine may be on another filesystem than the temporary
+	// directory, so fall back to copying
+	if err := copyFile(videoPath, quarantined); err != nil {
+		return "", err
+	}
+	os.Remove(videoPath)
+
+	return quarantined, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
@@ -0,0 +1,211 @@
+package videoprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe/fakeprobe"
+)
+
+func TestMain(m *testing.M) {
+	fakeprobe.Main()
+	os.Exit(m.Run())
+}
+
+// atom returns an MP4 atom of the given type holding payload.
+func atom(atomType string, payload []byte) []byte {
+	a := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	a = append(a, atomType...)
+	return append(a, payload...)
+}
+
+func mp4(atoms ...[]byte) []byte {
+	return bytes.Join(atoms, nil)
+}
+
+var (
+	ftyp = atom("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+	moov = atom("moov", make([]byte, 64))
+	mdat = atom("mdat", make([]byte, 1024))
+)
+
+func TestValidate(t *testing.T) {
+	tiktok, err := fakeprobe.Raw("tiktok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noDuration := bytes.ReplaceAll(tiktok, []byte(`"15.023311"`), []byte(`"N/A"`))
+
+	tests := []struct {
+		name     string
+		file     []byte
+		probe    func(t *testing.T)
+		expected time.Duration
+		// want is the error the result should wrap, or nil
+		want error
+	}{
+		{
+			name:     "valid",
+			file:     mp4(ftyp, moov, mdat),
+			probe:    func(t *testing.T) { fakeprobe.Use(t, "tiktok") },
+			expected: 15 * time.Second,
+		},
+		{
+			name:  "not mp4",
+			file:  []byte("\x1aE\xdf\xa3 matroska"),
+			probe: func(t *testing.T) { fakeprobe.Use(t, "tiktok") },
+		},
+		{
+			name: "truncated atom",
+			file: mp4(ftyp, moov, mdat[:100]),
+			want: ErrCorruptVideo,
+		},
+		{
+			name: "truncated atom header",
+			file: mp4(ftyp, moov, mdat[:4]),
+			want: ErrCorruptVideo,
+		},
+		{
+			name: "truncated large atom header",
+			file: mp4(ftyp, moov, []byte("\x00\x00\x00\x01mdat\x00\x00")),
+			want: ErrCorruptVideo,
+		},
+		{
+			name: "invalid atom size",
+			file: mp4(ftyp, []byte("\x00\x00\x00\x04moov")),
+			want: ErrCorruptVideo,
+		},
+		{
+			// The moov atom of a file cut short may not have arrived
+			name: "no moov atom",
+			file: mp4(ftyp, mdat),
+			want: ErrCorruptVideo,
+		},
+		{
+			name:  "unreadable",
+			file:  mp4(ftyp, moov, mdat),
+			probe: func(t *testing.T) { fakeprobe.Fail(t, "moov atom not found") },
+			want:  ErrCorruptVideo,
+		},
+		{
+			name:  "no video stream",
+			file:  mp4(ftyp, moov, mdat),
+			probe: func(t *testing.T) { fakeprobe.Use(t, "audioonly") },
+			want:  ErrInvalidVideo,
+		},
+		{
+			name:  "zero duration",
+			file:  mp4(ftyp, moov, mdat),
+			probe: func(t *testing.T) { fakeprobe.UseOutput(t, noDuration) },
+			want:  ErrInvalidVideo,
+		},
+		{
+			name:     "duration mismatch",
+			file:     mp4(ftyp, moov, mdat),
+			probe:    func(t *testing.T) { fakeprobe.Use(t, "tiktok") },
+			expected: 30 * time.Second,
+			want:     ErrInvalidVideo,
+		},
+		{
+			name:     "rounded duration",
+			file:     mp4(ftyp, moov, mdat),
+			probe:    func(t *testing.T) { fakeprobe.Use(t, "tiktok") },
+			expected: 16 * time.Second,
+		},
+	}
+
+	vp := New(nil, nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.probe != nil {
+				tt.probe(t)
+			} else {
+				fakeprobe.Fail(t, "ffprobe should not run")
+			}
+
+			path := filepath.Join(t.TempDir(), "video.mp4")
+			if err := os.WriteFile(path, tt.file, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := vp.Validate(context.Background(), path, tt.expected)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("got error %v, want none", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+
+			// Only videos that are not playable fail for good
+			if tt.want == ErrCorruptVideo && errors.Is(err, ErrInvalidVideo) {
+				t.Errorf("corrupt video error %v is also an invalid video error", err)
+			}
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	tests := []struct {
+		name       string
+		quarantine string
+	}{
+		{"configured", "quarantine-dir"},
+		{"default", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			vp := New(nil, nil, nil)
+			vp.tmpPath = filepath.Join(dir, "tmp")
+
+			want := filepath.Join(vp.tmpPath, "quarantine")
+			if tt.quarantine != "" {
+				vp.QuarantinePath = filepath.Join(dir, tt.quarantine)
+				want = vp.QuarantinePath
+			}
+
+			if err := os.MkdirAll(vp.tmpPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(vp.tmpPath, "video-1.mp4")
+			if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			quarantined, err := vp.Quarantine(path, "7220000000000000001.mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if filepath.Dir(quarantined) != want {
+				t.Errorf("quarantined in %s, want %s", filepath.Dir(quarantined), want)
+			}
+			name := filepath.Base(quarantined)
+			if !strings.HasPrefix(name, "7220000000000000001-") || filepath.Ext(name) != ".mp4" {
+				t.Errorf("quarantined as %s, want the aweme ID with a timestamp", name)
+			}
+
+			data, err := os.ReadFile(quarantined)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "video" {
+				t.Errorf("quarantined video holds %q, want %q", data, "video")
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("video is still in the temporary directory: %v", err)
+			}
+		})
+	}
+}
@@ -2,18 +2,17 @@ package videoprocessor
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
-	"github.com/bjornpagen/goplay/pkg/chrome"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/comment"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/downloader"
+	"github.com/bjornpagen/tiktok-video-processor/pkg/probe"
 	"github.com/bjornpagen/tiktok-video-processor/pkg/storer"
 )
 
@@ -21,7 +20,12 @@ type VideoProcessor struct {
 	VideoStorer   storer.Storer
 	CommentStorer storer.Storer
 	ResultStorer  storer.Storer
-	tmpPath       string
+
+	// QuarantinePath is where videos that fail validation are moved. It
+	// defaults to a directory in the temporary directory.
+	QuarantinePath string
+
+	tmpPath string
 }
 
 func New(videos, comments, results storer.Storer) *VideoProcessor {
@@ -41,8 +45,15 @@ func AddTimestampToFilename(filename string) string {
 	return newFilename
 }
 
-func (vp *VideoProcessor) FetchVideo(mediaURL string) (string, error) {
-	outFile := AddTimestampToFilename("video.mp4")
+// Download downloads the video into the temporary directory as name, without
+// storing it. A download of the same name that was interrupted is resumed, so
+// name should be stable across retries. An empty name picks a unique one. The
+// caller is responsible for removing the returned file.
+func (vp *VideoProcessor) Download(ctx context.Context, mediaURL, name string) (string, error) {
+	outFile := name
+	if outFile == "" {
+		outFile = AddTimestampToFilename("video.mp4")
+	}
 
 	// Create vp.path if it doesn't exist
 	if _, err := os.Stat(vp.tmpPath); os.IsNotExist(err) {
@@ -55,83 +66,91 @@ func (vp *VideoProcessor) FetchVideo(mediaURL string) (string, error) {
 	outFileFull := filepath.Join(vp.tmpPath, outFile)
 
 	dl := downloader.New()
-	dl.DownloadVideo(mediaURL, outFileFull)
-	defer os.Remove(outFileFull)
-
-	// Return the output file path
-	s, err := vp.VideoStorer.Store(outFileFull)
-	if err != nil {
+	if _, err := dl.DownloadVideoContext(ctx, mediaURL, outFileFull); err != nil {
 		return "", err
 	}
 
-	return s, nil
+	return outFileFull, nil
 }
 
-func (vp *VideoProcessor) FetchComment(username, commentText, imagePath string) (string, error) {
-	err := func() error {
-		c := &comment.CommentData{
-			Username:  username,
-			Comment:   commentText,
-			ImagePath: imagePath,
-		}
-		cb := comment.NewCommentBuilder()
-
-		ctx := context.Background()
-		defer ctx.Done()
+// Retrieve copies a video stored in VideoStorer into the temporary directory.
+// The caller is responsible for removing the returned file.
+func (vp *VideoProcessor) Retrieve(access string) (string, error) {
+	in, err := vp.VideoStorer.Open(access)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
 
-		chrome.Cleanup()
-		err := cb.Start()
+	// Create vp.path if it doesn't exist
+	if _, err := os.Stat(vp.tmpPath); os.IsNotExist(err) {
+		err = os.MkdirAll(vp.tmpPath, os.ModePerm)
 		if err != nil {
-			return err
+			return "", err
 		}
-		defer chrome.Cleanup()
+	}
 
-		err = cb.UpdateComment(c)
-		if err != nil {
-			return err
-		}
-		cb.DownloadComment()
-		time.Sleep(1 * time.Second)
-		return nil
-	}()
+	outFileFull := filepath.Join(vp.tmpPath, AddTimestampToFilename("video.mp4"))
+
+	out, err := os.Create(outFileFull)
 	if err != nil {
 		return "", err
 	}
 
-	// get the current user
-	u, err := user.Current()
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(outFileFull)
 		return "", err
 	}
 
-	// locate the Chrome downloads directory
-	downloadsDir := filepath.Join(u.HomeDir, "Downloads")
-	if _, err := os.Stat(downloadsDir); os.IsNotExist(err) {
-		return "", err
-	}
+	return outFileFull, nil
+}
 
-	// specify the file to move
-	filename := "Comment.png"
-	destFile := AddTimestampToFilename("comment.png")
-	srcPath := filepath.Join(downloadsDir, filename)
-	tmpPath := filepath.Join("/tmp", destFile)
+// Comments are rendered at commentScale, which suits a commentVideoWidth
+// pixel wide video. Overlay scales them to the width of the video.
+const (
+	commentScale      = 3
+	commentVideoWidth = 1080
+)
+
+// FetchComment renders the comment bubble as a PNG and stores it in
+// CommentStorer.
+func (vp *VideoProcessor) FetchComment(username, commentText, imagePath string) (string, error) {
+	c := comment.NewCommentData(username, commentText, imagePath)
+
+	// Create vp.path if it doesn't exist
+	if _, err := os.Stat(vp.tmpPath); os.IsNotExist(err) {
+		err = os.MkdirAll(vp.tmpPath, os.ModePerm)
+		if err != nil {
+			return "", err
+		}
+	}
 
-	err = os.Rename(srcPath, tmpPath)
+	tmpPath := filepath.Join(vp.tmpPath, AddTimestampToFilename("comment.png"))
+	f, err := os.Create(tmpPath)
 	if err != nil {
 		return "", err
 	}
 	defer os.Remove(tmpPath)
 
-	finPath, err := vp.CommentStorer.Store(tmpPath)
+	err = comment.RenderPNG(f, c, commentScale)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Println("File moved successfully.")
-	return finPath, nil
+	return vp.CommentStorer.Store(tmpPath)
 }
 
-func (vp *VideoProcessor) Combine(videoPath, commentPath string) (string, error) {
+// Overlay renders the comment on top of the video into the temporary
+// directory, without storing it. The caller is responsible for removing the
+// returned file.
+func (vp *VideoProcessor) Overlay(ctx context.Context, videoPath, commentPath string) (string, error) {
 	outFile := AddTimestampToFilename("combined.mp4")
 
 	// Create vp.path if it doesn't exist
@@ -145,20 +164,21 @@ func (vp *VideoProcessor) Combine(videoPath, commentPath string) (string, error)
 	outputPath := filepath.Join(vp.tmpPath, outFile)
 
 	// Apply the overlay using FFmpeg command-line tool and save the file locally
-	scaleFactor := 5
 	yPositionFactor := 0.12 // Set the desired value between 0 and 1
 	xPositionFactor := 0.1  // Set the desired value between 0 and 1
 
-	videoWidth, videoHeight, err := getVideoDimensions(videoPath)
+	videoWidth, videoHeight, err := getVideoDimensions(ctx, videoPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to get video dimensions: %w", err)
 	}
 
+	// Comments are rendered for a commentVideoWidth wide video
+	scale := float64(videoWidth) / commentVideoWidth
 	xPosition := int(float64(videoWidth) * xPositionFactor)
 	yPosition := int(float64(videoHeight) * yPositionFactor)
-	filterComplex := fmt.Sprintf("[1:v]scale=iw/%d:ih/%d[scaled];[0:v][scaled]overlay=x=%d:y=%d[out]", scaleFactor, scaleFactor, xPosition, yPosition)
+	filterComplex := fmt.Sprintf("[1:v]scale=iw*%.4f:ih*%.4f[scaled];[0:v][scaled]overlay=x=%d:y=%d[out]", scale, scale, xPosition, yPosition)
 
-	cmd := exec.Command("ffmpeg",
+	cmd := exec.CommandContext(ctx, "ffmpeg",
 		"-i", videoPath,
 		"-i", commentPath,
 		"-filter_complex", filterComplex,
@@ -171,38 +191,25 @@ func (vp *VideoProcessor) Combine(videoPath, commentPath string) (string, error)
 		"-y", outputPath,
 	)
 
+	// Remove the output if ffmpeg fails or is killed halfway through
 	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
 		return "", fmt.Errorf("failed to combine video and comment: %w", err)
 	}
-	defer os.Remove(outputPath)
 
-	// Return the output file path
-	s, err := vp.ResultStorer.Store(outputPath)
-	if err != nil {
-		return "", err
-	}
-
-	return s, nil
+	return outputPath, nil
 }
 
-func getVideoDimensions(videoPath string) (int, int, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=p=0", videoPath)
-	output, err := cmd.Output()
+func getVideoDimensions(ctx context.Context, videoPath string) (int, int, error) {
+	r, err := probe.Probe(ctx, videoPath)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	dimensions := strings.Split(strings.TrimSpace(string(output)), ",")
-
-	width, err := strconv.Atoi(dimensions[0])
-	if err != nil {
-		return 0, 0, err
-	}
-
-	height, err := strconv.Atoi(dimensions[1])
-	if err != nil {
-		return 0, 0, err
+	video := r.VideoStream()
+	if video == nil {
+		return 0, 0, errors.New("no video stream")
 	}
 
-	return width, height, nil
+	return video.Width, video.Height, nil
 }